@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+)
+
+// how often buffered access log is flushed
+const accessLogFlush = time.Second
+
+type accessRecord struct {
+	Method    string
+	Path      string
+	Route     string
+	Status    int
+	Latency   time.Duration
+	ReqBytes  int
+	RespBytes int
+	Remote    string
+}
+
+// AccessLog writes sampled requests as JSON through logrus off the request path
+type AccessLog struct {
+	rate    float64
+	seen    uint64
+	dropped uint64
+	records chan accessRecord
+	logger  *log.Logger
+	out     *bufio.Writer
+	done    chan struct{}
+
+	// guards records against sends after close
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewAccessLog logs rate share of requests (5xx are always logged) to w,
+// at most buffer records are queued, the rest are dropped
+func NewAccessLog(w io.Writer, rate float64, buffer int) *AccessLog {
+	a := &AccessLog{
+		rate:    rate,
+		records: make(chan accessRecord, buffer),
+		out:     bufio.NewWriter(w),
+		done:    make(chan struct{}),
+	}
+	a.logger = log.New()
+	a.logger.Formatter = &log.JSONFormatter{}
+	a.logger.Out = a.out
+	go a.run()
+
+	return a
+}
+
+func (a *AccessLog) run() {
+	defer close(a.done)
+
+	tick := time.NewTicker(accessLogFlush)
+	defer tick.Stop()
+
+	for {
+		select {
+		case r, ok := <-a.records:
+			if !ok {
+				a.out.Flush()
+				return
+			}
+			a.write(r)
+		case <-tick.C:
+			if n := atomic.SwapUint64(&a.dropped, 0); n > 0 {
+				a.logger.WithField("dropped", n).Warn("access log overflow")
+			}
+			a.out.Flush()
+		}
+	}
+}
+
+func (a *AccessLog) write(r accessRecord) {
+	a.logger.WithFields(log.Fields{
+		"method":     r.Method,
+		"path":       r.Path,
+		"route":      r.Route,
+		"status":     r.Status,
+		"latency_us": r.Latency.Nanoseconds() / 1000,
+		"req_bytes":  r.ReqBytes,
+		"resp_bytes": r.RespBytes,
+		"remote":     r.Remote,
+	}).Info("access")
+}
+
+// sampled decides whether n-th request is logged
+func (a *AccessLog) sampled(n uint64) bool {
+	return uint64(float64(n)*a.rate) != uint64(float64(n-1)*a.rate)
+}
+
+// Wrap logs requests served by h
+func (a *AccessLog) Wrap(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(c *fasthttp.RequestCtx) {
+		start := time.Now()
+		h(c)
+
+		status := c.Response.StatusCode()
+		if !a.sampled(atomic.AddUint64(&a.seen, 1)) && status < 500 {
+			return
+		}
+
+		// streamed bodies are not known in advance
+		respBytes := -1
+		if !c.Response.IsBodyStream() {
+			respBytes = len(c.Response.Body())
+		}
+		r := accessRecord{
+			Method:    string(c.Method()),
+			Path:      string(c.Path()),
+			Status:    status,
+			Latency:   time.Since(start),
+			ReqBytes:  len(c.Request.Body()),
+			RespBytes: respBytes,
+			Remote:    c.RemoteAddr().String(),
+		}
+		if rm, ok := c.UserValue(routeKey).(*RouteMetrics); ok {
+			r.Route = rm.Route
+		}
+
+		a.mu.RLock()
+		if !a.closed {
+			select {
+			case a.records <- r:
+			default:
+				atomic.AddUint64(&a.dropped, 1)
+			}
+		}
+		a.mu.RUnlock()
+	}
+}
+
+// Close flushes queued records, requests finished afterwards are not logged
+func (a *AccessLog) Close() {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return
+	}
+	a.closed = true
+	close(a.records)
+	a.mu.Unlock()
+
+	<-a.done
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestAccessLogSampled(t *testing.T) {
+	tests := []struct {
+		rate float64
+		n    int
+		want int
+	}{
+		{0, 100, 0},
+		{1, 100, 100},
+		{0.1, 100, 10},
+		{0.25, 10, 2},
+	}
+	for _, tt := range tests {
+		a := &AccessLog{rate: tt.rate}
+		got := 0
+		for i := 1; i <= tt.n; i++ {
+			if a.sampled(uint64(i)) {
+				got++
+			}
+		}
+		if got != tt.want {
+			t.Errorf("rate %g: %d of %d sampled, want %d", tt.rate, got, tt.n, tt.want)
+		}
+	}
+}
+
+func TestAccessLogWrap(t *testing.T) {
+	var out bytes.Buffer
+	a := NewAccessLog(&out, 0.5, 100)
+	h := a.Wrap(func(c *fasthttp.RequestCtx) {
+		switch string(c.Path()) {
+		case "/fail":
+			ErrorResponse(c, fasthttp.StatusInternalServerError, false)
+		default:
+			OkResponse(c, []byte(`{"ok":1}`), false)
+		}
+	})
+
+	tests := []struct {
+		path   string
+		logged bool
+	}{
+		{"/users/1", false},
+		{"/users/2", true},
+		// 5xx are logged regardless of sampling
+		{"/fail", true},
+		{"/users/3", true},
+	}
+	for _, tt := range tests {
+		var c fasthttp.RequestCtx
+		c.Request.Header.SetMethod("POST")
+		c.Request.SetRequestURI(tt.path)
+		c.Request.SetBodyString(`{}`)
+		h(&c)
+	}
+	a.Close()
+
+	var logged []string
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var r struct {
+			Method    string `json:"method"`
+			Path      string `json:"path"`
+			Status    int    `json:"status"`
+			ReqBytes  int    `json:"req_bytes"`
+			RespBytes int    `json:"resp_bytes"`
+		}
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("%q: %s", line, err)
+		}
+		if r.Method != "POST" || r.ReqBytes != 2 || r.RespBytes <= 0 {
+			t.Errorf("bad record %q", line)
+		}
+		logged = append(logged, r.Path)
+	}
+	for _, tt := range tests {
+		found := false
+		for _, p := range logged {
+			found = found || p == tt.path
+		}
+		if found != tt.logged {
+			t.Errorf("%s logged %v, want %v", tt.path, found, tt.logged)
+		}
+	}
+}
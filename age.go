@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// clock modes
+const (
+	// ages are counted against timestamp from options.txt
+	ClockFrozen = "frozen"
+	// ages are counted against current time
+	ClockWall = "wall"
+)
+
+// ages with precomputed birth date boundaries
+const maxAge = 150
+
+// Age returns full calendar years passed from bd to ref, dates are in UTC
+func Age(ref int64, bd int64) int {
+	ry, rm, rd := time.Unix(ref, 0).UTC().Date()
+	by, bm, bdd := time.Unix(bd, 0).UTC().Date()
+
+	age := ry - by
+	if rm < bm || (rm == bm && rd < bdd) {
+		age--
+	}
+
+	return age
+}
+
+// BirthCut returns the first timestamp of birth at which one is younger
+// than age at ref, i.e. Age(ref, bd) >= age <=> bd < BirthCut(ref, age)
+func BirthCut(ref int64, age int) int64 {
+	y, m, d := time.Unix(ref, 0).UTC().Date()
+	t := time.Date(y-age, m, d, 0, 0, 0, 0, time.UTC)
+	if t.Day() != d {
+		// february 29 in non-leap year is already normalized to march 1
+		return t.Unix()
+	}
+
+	return t.AddDate(0, 0, 1).Unix()
+}
+
+func dayStart(ts int64) int64 {
+	return ts - ((ts%86400)+86400)%86400
+}
+
+type ageTable struct {
+	day  int64
+	cuts [maxAge + 1]int64
+}
+
+// AgeClock is the reference time of age filters
+type AgeClock struct {
+	Mode   string
+	Frozen int64
+	table  atomic.Value
+}
+
+func NewAgeClock(mode string, frozen int64) (*AgeClock, error) {
+	if mode != ClockFrozen && mode != ClockWall {
+		return nil, fmt.Errorf("unknown clock %q", mode)
+	}
+
+	return &AgeClock{Mode: mode, Frozen: frozen}, nil
+}
+
+// Now returns reference time and keeps boundaries of its day precomputed
+func (a *AgeClock) Now() int64 {
+	now := a.Frozen
+	if a.Mode == ClockWall {
+		now = time.Now().Unix()
+	}
+
+	if t, ok := a.table.Load().(*ageTable); !ok || t.day != dayStart(now) {
+		t = &ageTable{day: dayStart(now)}
+		for age := range t.cuts {
+			t.cuts[age] = BirthCut(now, age)
+		}
+		a.table.Store(t)
+	}
+
+	return now
+}
+
+// Cut is BirthCut served from precomputed table when ref is within clock's day
+func (a *AgeClock) Cut(ref int64, age int) int64 {
+	if age >= 0 && age <= maxAge {
+		if t, ok := a.table.Load().(*ageTable); ok && t.day == dayStart(ref) {
+			return t.cuts[age]
+		}
+	}
+
+	return BirthCut(ref, age)
+}
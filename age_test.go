@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func unix(y int, m time.Month, d int) int64 {
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Unix()
+}
+
+func TestAge(t *testing.T) {
+	tests := []struct {
+		ref, bd int64
+		age     int
+	}{
+		{unix(2017, 8, 16), unix(1990, 8, 16), 27},
+		{unix(2017, 8, 15), unix(1990, 8, 16), 26},
+		{unix(2017, 8, 16) - 1, unix(1990, 8, 16), 26},
+		{unix(2017, 1, 1), unix(1990, 12, 31), 26},
+		// born on february 29 gets older on march 1 in non-leap years
+		{unix(2017, 2, 28), unix(2000, 2, 29), 16},
+		{unix(2017, 3, 1), unix(2000, 2, 29), 17},
+		{unix(2016, 2, 29), unix(2000, 2, 29), 16},
+		// before epoch
+		{unix(2017, 8, 16), unix(1930, 8, 17), 86},
+	}
+	for _, tt := range tests {
+		if age := Age(tt.ref, tt.bd); age != tt.age {
+			t.Errorf("Age(%d, %d) = %d, want %d", tt.ref, tt.bd, age, tt.age)
+		}
+	}
+}
+
+func TestBirthCut(t *testing.T) {
+	refs := []int64{unix(2017, 8, 16) + 3600, unix(2016, 2, 29), unix(2017, 3, 1), unix(2017, 12, 31) + 86399}
+	for _, ref := range refs {
+		for _, age := range []int{0, 1, 18, 30, 100} {
+			cut := BirthCut(ref, age)
+			if Age(ref, cut-1) < age || Age(ref, cut) >= age {
+				t.Errorf("BirthCut(%d, %d) = %d: ages %d, %d around it", ref, age, cut, Age(ref, cut-1), Age(ref, cut))
+			}
+		}
+	}
+}
+
+func TestAgeClock(t *testing.T) {
+	if _, err := NewAgeClock("lunar", 0); err == nil {
+		t.Error("unknown clock accepted")
+	}
+
+	frozen := unix(2017, 8, 16) + 3600
+	tests := []struct {
+		mode string
+		ref  int64
+	}{
+		{ClockFrozen, frozen},
+		{ClockWall, time.Now().Unix()},
+	}
+	for _, tt := range tests {
+		a, err := NewAgeClock(tt.mode, frozen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if now := a.Now(); now < tt.ref || now > tt.ref+5 {
+			t.Errorf("%s: Now() = %d, want %d", tt.mode, now, tt.ref)
+		}
+		for _, age := range []int{0, 25, maxAge, maxAge + 1} {
+			for _, ref := range []int64{tt.ref, tt.ref - 86400*400} {
+				if cut, want := a.Cut(ref, age), BirthCut(ref, age); cut != want {
+					t.Errorf("%s: Cut(%d, %d) = %d, want %d", tt.mode, ref, age, cut, want)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/valyala/fasthttp"
+)
+
+// errors of database operations shared by HTTP and gRPC APIs,
+// each maps them to its own statuses
+var (
+	ErrNotFound = errors.New("not found")
+	ErrInvalid  = errors.New("invalid request")
+	ErrConflict = errors.New("email already taken")
+)
+
+// errorStatus maps database operation error to HTTP status
+func errorStatus(err error) int {
+	switch err {
+	case ErrNotFound:
+		return fasthttp.StatusNotFound
+	case ErrConflict:
+		return fasthttp.StatusConflict
+	}
+
+	return fasthttp.StatusBadRequest
+}
+
+// UserVisits returns visits of user matching filters ordered by date,
+// as they were at asOf argument when history is kept
+func (d Database) UserVisits(id uint32, args *fasthttp.Args) ([]ShortVisit, error) {
+	at, past, err := d.asOf(args)
+	if err != nil {
+		return nil, ErrInvalid
+	}
+	user, location := d.Users.Get, d.Locations.Get
+	if past {
+		user = func(id uint32) (User, bool) { return d.UserAt(id, at) }
+		location = func(id uint32) (Location, bool) { return d.LocationAt(id, at) }
+	}
+
+	if _, ok := user(id); !ok {
+		return nil, ErrNotFound
+	}
+	filters, err := d.ParseFilters(args)
+	if err != nil {
+		return nil, ErrInvalid
+	}
+
+	var visits []Visit
+	if past {
+		visits = d.VisitsAt(true, id, at)
+	} else {
+		visits = d.LoadVisits(d.UserVisit.Get(id))
+	}
+
+	v := make([]ShortVisit, 0)
+	for _, value := range d.FilterVisits(filters, visits) {
+		l, _ := location(value.Location)
+		v = append(v, ShortVisit{
+			value.Mark,
+			value.Visited,
+			l.Place,
+		})
+	}
+	sort.Sort(ByVisited(v))
+
+	return v, nil
+}
+
+// LocationAvg returns average mark of location visits matching filters
+func (d Database) LocationAvg(id uint32, args *fasthttp.Args) (float64, error) {
+	sum, count, err := d.LocationSum(id, args)
+	if err != nil {
+		return 0, err
+	}
+
+	return AvgMark(sum, count), nil
+}
+
+// LocationSum returns sum and number of marks of location visits matching
+// filters, so that averages of several shards can be merged. Visits are
+// taken as they were at asOf argument when history is kept
+func (d Database) LocationSum(id uint32, args *fasthttp.Args) (sum int, count int, err error) {
+	visits, err := d.visitsOf(false, id, args)
+	if err != nil {
+		return 0, 0, err
+	}
+	filters, err := d.ParseFilters(args)
+	if err != nil {
+		return 0, 0, ErrInvalid
+	}
+
+	for _, rec := range d.FilterVisits(filters, visits) {
+		sum += rec.Mark
+		count++
+	}
+
+	return sum, count, nil
+}
+
+// UpsertUser updates user id with fields present in JSON body,
+// id "new" creates user
+func (d Database) UpsertUser(id string, body []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	uid, err := strconv.Atoi(id)
+	if id != "new" && err != nil {
+		return ErrNotFound
+	}
+
+	var u User
+	var str string
+	t := RawUser{}
+
+	if err := t.UnmarshalJSON(body); err != nil {
+		return ErrInvalid
+	}
+
+	if string(t.ID) == "null" || string(t.Gender) == "null" || string(t.Birthday) == "null" || string(t.FirstName) == "null" || string(t.LastName) == "null" || string(t.Email) == "null" {
+		return ErrInvalid
+	}
+
+	if id != "new" {
+		var ok bool
+		if u, ok = d.Users.Get(uint32(uid)); !ok {
+			return ErrNotFound
+		}
+	}
+	email := u.Email
+	if len(t.ID) > 0 {
+		tId, err := strconv.Atoi(string(t.ID))
+		if err != nil {
+			return ErrInvalid
+		}
+		u.ID = uint32(tId)
+	}
+	if id != "new" && u.ID != uint32(uid) {
+		return ErrInvalid
+	}
+
+	if len(t.FirstName) > 0 {
+		str, _ = strconv.Unquote(string(t.FirstName))
+		u.FirstName = strings.Trim(str, "\"")
+	}
+	if utf8.RuneCountInString(u.FirstName) > 50 {
+		return ErrInvalid
+	}
+
+	if len(t.LastName) > 0 {
+		str, _ = strconv.Unquote(string(t.LastName))
+		u.LastName = strings.Trim(str, "\"")
+	}
+	if utf8.RuneCountInString(u.LastName) > 50 {
+		return ErrInvalid
+	}
+
+	if len(t.Gender) > 0 {
+		str, _ = strconv.Unquote(string(t.Gender))
+		u.Gender = strings.Trim(str, "\"")
+	}
+	if u.Gender != "f" && u.Gender != "m" {
+		return ErrInvalid
+	}
+
+	if len(t.Birthday) > 0 {
+		u.Birthday, err = strconv.ParseInt(string(t.Birthday), 10, 64)
+		if err != nil {
+			return ErrInvalid
+		}
+	}
+
+	if u.Birthday < -1262304000 || u.Birthday > 915235199 {
+		return ErrInvalid
+	}
+
+	if len(t.Email) > 0 {
+		str, _ = strconv.Unquote(string(t.Email))
+		u.Email = strings.Trim(str, "\"")
+	}
+	if utf8.RuneCountInString(u.Email) > 100 {
+		return ErrInvalid
+	}
+	// loaded data may hold duplicates, only changed emails are checked
+	if config.UniqueEmail && (id == "new" || emailKey(u.Email) != emailKey(email)) && !d.Emails.Claim(u.Email, u.ID) {
+		return ErrConflict
+	}
+	d.setUser(u)
+
+	return nil
+}
+
+// UpsertVisit updates visit id with fields present in JSON body,
+// id "new" creates visit
+func (d Database) UpsertVisit(id string, body []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	vid, err := strconv.Atoi(id)
+	if id != "new" && err != nil {
+		return ErrNotFound
+	}
+
+	var v Visit
+	t := RawVisit{}
+
+	if err = t.UnmarshalJSON(body); err != nil {
+		return ErrInvalid
+	}
+
+	if string(t.ID) == "null" || string(t.User) == "null" || string(t.Location) == "null" || string(t.Visited) == "null" || string(t.Mark) == "null" {
+		return ErrInvalid
+	}
+
+	var ok bool
+
+	if id != "new" {
+		if v, ok = d.Visits.Get(uint32(vid)); !ok {
+			return ErrNotFound
+		}
+	}
+	if len(t.ID) > 0 {
+		tId, err := strconv.Atoi(string(t.ID))
+		if err != nil {
+			return ErrInvalid
+		}
+		v.ID = uint32(tId)
+	}
+	if id != "new" && v.ID != uint32(vid) {
+		return ErrInvalid
+	}
+	if len(t.User) > 0 {
+		tId, err := strconv.Atoi(string(t.User))
+		if err != nil {
+			return ErrInvalid
+		}
+		v.User = uint32(tId)
+	}
+
+	if _, ok = d.Users.Get(v.User); !ok {
+		return ErrInvalid
+	}
+
+	if len(t.Location) > 0 {
+		tId, err := strconv.Atoi(string(t.Location))
+		if err != nil {
+			return ErrInvalid
+		}
+		v.Location = uint32(tId)
+	}
+	if _, ok = d.Locations.Get(v.Location); !ok {
+		return ErrInvalid
+	}
+
+	if len(t.Visited) > 0 {
+		v.Visited, err = strconv.Atoi(string(t.Visited))
+		if err != nil {
+			return ErrInvalid
+		}
+	}
+	if v.Visited < 946684800 || v.Visited > 1420156799 {
+		return ErrInvalid
+	}
+
+	if len(t.Mark) > 0 {
+		v.Mark, err = strconv.Atoi(string(t.Mark))
+		if err != nil {
+			return ErrInvalid
+		}
+	}
+	if v.Mark < 0 || v.Mark > 5 {
+		return ErrInvalid
+	}
+
+	d.setVisit(v)
+
+	return nil
+}
+
+// UpsertLocation updates location id with fields present in JSON body,
+// id "new" creates location
+func (d Database) UpsertLocation(id string, body []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	lid, err := strconv.Atoi(id)
+	if id != "new" && err != nil {
+		return ErrNotFound
+	}
+
+	var l Location
+	t := RawLocation{}
+	var u string
+	if err = t.UnmarshalJSON(body); err != nil {
+		return ErrInvalid
+	}
+	if string(t.ID) == "null" || string(t.Distance) == "null" || string(t.Country) == "null" || string(t.City) == "null" || string(t.Place) == "null" {
+		return ErrInvalid
+	}
+	// coordinates are optional, null drops them
+	if (string(t.Lat) == "null") != (string(t.Lon) == "null") {
+		return ErrInvalid
+	}
+
+	if id != "new" {
+		var ok bool
+		if l, ok = d.Locations.Get(uint32(lid)); !ok {
+			return ErrNotFound
+		}
+	}
+	if len(t.ID) > 0 {
+		tId, err := strconv.Atoi(string(t.ID))
+		if err != nil {
+			return ErrInvalid
+		}
+		l.ID = uint32(tId)
+	}
+
+	if id != "new" && l.ID != uint32(lid) {
+		return ErrInvalid
+	}
+
+	if len(t.Country) > 0 {
+		u, _ = strconv.Unquote(string(t.Country))
+		l.Country = strings.Trim(u, "\"")
+	}
+	if utf8.RuneCountInString(l.Country) > 50 {
+		return ErrInvalid
+	}
+
+	if len(t.City) > 0 {
+		u, _ = strconv.Unquote(string(t.City))
+		l.City = strings.Trim(u, "\"")
+	}
+	if utf8.RuneCountInString(l.City) > 50 {
+		return ErrInvalid
+	}
+
+	if len(t.Place) > 0 {
+		u, _ = strconv.Unquote(string(t.Place))
+		l.Place = strings.Trim(u, "\"")
+	}
+
+	if len(t.Distance) > 0 {
+		l.Distance, err = strconv.Atoi(string(t.Distance))
+		if err != nil {
+			return ErrInvalid
+		}
+	}
+
+	if string(t.Lat) == "null" {
+		l.Lat, l.Lon = nil, nil
+	}
+	if len(t.Lat) > 0 && string(t.Lat) != "null" {
+		lat, err := strconv.ParseFloat(string(t.Lat), 64)
+		if err != nil {
+			return ErrInvalid
+		}
+		l.Lat = &lat
+	}
+	if len(t.Lon) > 0 && string(t.Lon) != "null" {
+		lon, err := strconv.ParseFloat(string(t.Lon), 64)
+		if err != nil {
+			return ErrInvalid
+		}
+		l.Lon = &lon
+	}
+	if (l.Lat == nil) != (l.Lon == nil) || (l.Lat != nil && !ValidCoords(*l.Lat, *l.Lon)) {
+		return ErrInvalid
+	}
+
+	d.setLocation(l)
+
+	return nil
+}
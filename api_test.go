@@ -0,0 +1,58 @@
+package main
+
+import "testing"
+
+// newTestDatabase returns empty database over storage kind
+func newTestDatabase(t testing.TB, kind string) Database {
+	var d Database
+	if err := d.InitStorage(kind); err != nil {
+		t.Fatal(err)
+	}
+	d.Emails = NewEmailIndex()
+	d.Search = NewSearchIndex()
+	d.Geo = NewGeoIndex()
+	ages, err := NewAgeClock(ClockFrozen, 1500000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Ages = ages
+
+	return d
+}
+
+func TestUpsertUserEmail(t *testing.T) {
+	d := newTestDatabase(t, StorageMap)
+	// loaded data may already hold duplicates
+	d.SetUser(User{ID: 1, Email: "dup@example.com", FirstName: "A", LastName: "B", Gender: "m"})
+	d.SetUser(User{ID: 2, Email: "dup@example.com", FirstName: "C", LastName: "D", Gender: "f"})
+	d.SetUser(User{ID: 3, Email: "own@example.com", FirstName: "E", LastName: "F", Gender: "f"})
+
+	tests := []struct {
+		name string
+		id   string
+		body string
+		err  error
+	}{
+		{"unchanged duplicate", "1", `{"first_name":"X"}`, nil},
+		{"same email other case", "2", `{"email":"DUP@example.com"}`, nil},
+		{"taken email", "3", `{"email":"dup@example.com"}`, ErrConflict},
+		{"duplicate moves away", "2", `{"email":"two@example.com"}`, nil},
+		// user 1 still holds it
+		{"email of other duplicate", "new", `{"id":5,"email":"dup@example.com","first_name":"G","last_name":"H","gender":"m","birth_date":0}`, ErrConflict},
+		{"free email", "3", `{"email":"new@example.com"}`, nil},
+		{"released email", "1", `{"email":"own@example.com"}`, nil},
+		{"new with taken email", "new", `{"id":4,"email":"new@example.com","first_name":"G","last_name":"H","gender":"m","birth_date":0}`, ErrConflict},
+		{"new with free email", "new", `{"id":4,"email":"four@example.com","first_name":"G","last_name":"H","gender":"m","birth_date":0}`, nil},
+		{"missing", "5", `{"email":"five@example.com"}`, ErrNotFound},
+		{"null field", "1", `{"email":null}`, ErrInvalid},
+	}
+	for _, tt := range tests {
+		if err := d.UpsertUser(tt.id, []byte(tt.body)); err != tt.err {
+			t.Errorf("%s: UpsertUser(%s, %s) = %v, want %v", tt.name, tt.id, tt.body, err, tt.err)
+		}
+	}
+
+	if id, _ := d.Emails.Get("new@example.com"); id != 3 {
+		t.Errorf("new@example.com belongs to %d, want 3", id)
+	}
+}
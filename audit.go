@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+)
+
+// user value holding authenticated client name
+const principalKey = "principal"
+
+// FieldChange is old and new value of entity field, null when absent
+type FieldChange struct {
+	Field string          `json:"field"`
+	Old   json.RawMessage `json:"old"`
+	New   json.RawMessage `json:"new"`
+}
+
+// AuditEntry records accepted write
+type AuditEntry struct {
+	Seq     uint64        `json:"seq"`
+	Time    int64         `json:"time"`
+	Client  string        `json:"client"`
+	Type    string        `json:"type"`
+	ID      uint32        `json:"id"`
+	Created bool          `json:"created,omitempty"`
+	Fields  []FieldChange `json:"fields"`
+}
+
+// number of locks of audited entities
+const auditStripes = 256
+
+// Audit keeps last writes in ring buffer and appends every one of them
+// to JSON lines log when it is given
+type Audit struct {
+	mu   sync.Mutex
+	ring []AuditEntry
+	seq  uint64
+	out  io.Writer
+	// IPs of nodes and proxies whose X-Forwarded-For is believed
+	trusted map[string]bool
+
+	// held over write of entities of stripe, so that entity read before
+	// and after it is not changed by another one
+	writeMu [auditStripes]sync.Mutex
+}
+
+// NewAudit keeps size last entries, out may be nil
+func NewAudit(size int, out io.Writer, trusted map[string]bool) *Audit {
+	return &Audit{ring: make([]AuditEntry, size), out: out, trusted: trusted}
+}
+
+// clientIdentity names client by authenticated principal, credentials of
+// Authorization header (unverified, so hashed) or address. Addresses of
+// X-Forwarded-For are followed back only while they were added by trusted
+// nodes, clients can put anything before them
+func (a *Audit) clientIdentity(c *fasthttp.RequestCtx) string {
+	if p, ok := c.UserValue(principalKey).(string); ok && p != "" {
+		return p
+	}
+
+	if auth := c.Request.Header.Peek("Authorization"); len(auth) > 0 {
+		sum := sha256.Sum256(auth)
+		return "token:" + hex.EncodeToString(sum[:8])
+	}
+
+	ip := c.RemoteIP().String()
+	hops := strings.Split(string(c.Request.Header.Peek("X-Forwarded-For")), ",")
+	for i := len(hops) - 1; i >= 0 && a.trusted[ip]; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			break
+		}
+		ip = hop
+	}
+	return "ip:" + ip
+}
+
+// diffFields compares top level fields of JSON objects
+func diffFields(before, after []byte) []FieldChange {
+	var old, cur map[string]json.RawMessage
+	json.Unmarshal(before, &old)
+	json.Unmarshal(after, &cur)
+
+	names := make([]string, 0, len(cur))
+	for k := range cur {
+		names = append(names, k)
+	}
+	for k := range old {
+		if _, ok := cur[k]; !ok {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+
+	fields := make([]FieldChange, 0)
+	for _, k := range names {
+		if !bytes.Equal(old[k], cur[k]) {
+			fields = append(fields, FieldChange{k, old[k], cur[k]})
+		}
+	}
+
+	return fields
+}
+
+// Record logs write of entity by client, before is nil for created entity
+func (a *Audit) Record(client string, typ string, id uint32, before []byte, after []byte) {
+	e := AuditEntry{
+		Time:    time.Now().Unix(),
+		Client:  client,
+		Type:    typ,
+		ID:      id,
+		Created: before == nil,
+		Fields:  diffFields(before, after),
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.seq++
+	e.Seq = a.seq
+	a.ring[a.seq%uint64(len(a.ring))] = e
+	if a.out != nil {
+		line, _ := json.Marshal(e)
+		if _, err := a.out.Write(append(line, '\n')); err != nil {
+			log.Printf("audit: %s", err)
+		}
+	}
+}
+
+// entityMu returns lock of entity, writes of other entities mostly go on
+// in parallel
+func (a *Audit) entityMu(typ string, id uint32) *sync.Mutex {
+	h := id
+	for i := 0; i < len(typ); i++ {
+		h = h*31 + uint32(typ[i])
+	}
+
+	return &a.writeMu[h*2654435761>>24%auditStripes]
+}
+
+// writeID reads id of written entity from path, for new ones from body
+func writeID(c *fasthttp.RequestCtx) (uint32, bool) {
+	id := c.UserValue("id").(string)
+	if id == "new" {
+		var t struct {
+			ID json.RawMessage `json:"id"`
+		}
+		if json.Unmarshal(c.PostBody(), &t) != nil {
+			return 0, false
+		}
+		id = string(t.ID)
+	}
+	n, err := strconv.ParseUint(id, 10, 32)
+
+	return uint32(n), err == nil
+}
+
+// Wrap records writes accepted by h, entity is read with current before
+// and after them
+func (a *Audit) Wrap(typ string, current func(id uint32) ([]byte, bool), h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	if a == nil {
+		return h
+	}
+
+	return func(c *fasthttp.RequestCtx) {
+		id, ok := writeID(c)
+		if !ok {
+			h(c)
+			return
+		}
+
+		mu := a.entityMu(typ, id)
+		mu.Lock()
+		defer mu.Unlock()
+		before, _ := current(id)
+		h(c)
+		if c.Response.StatusCode() != fasthttp.StatusOK {
+			return
+		}
+		after, _ := current(id)
+		a.Record(a.clientIdentity(c), typ, id, before, after)
+	}
+}
+
+// auditFilter selects entries by query arguments of admin endpoint
+type auditFilter struct {
+	typ    string
+	id     string
+	client string
+	since  int64
+	until  int64
+}
+
+func (f *auditFilter) match(e *AuditEntry) bool {
+	return e.Seq > 0 &&
+		(f.typ == "" || e.Type == f.typ) &&
+		(f.id == "" || strconv.FormatUint(uint64(e.ID), 10) == f.id) &&
+		(f.client == "" || e.Client == f.client) &&
+		(f.since == 0 || e.Time >= f.since) &&
+		(f.until == 0 || e.Time < f.until)
+}
+
+// entries returns kept entries matching filter, oldest first, at most
+// limit last of them when limit is positive
+func (a *Audit) entries(f auditFilter, limit int) []AuditEntry {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	size := uint64(len(a.ring))
+	from := uint64(1)
+	if a.seq > size {
+		from = a.seq - size + 1
+	}
+
+	entries := make([]AuditEntry, 0)
+	for s := from; s <= a.seq; s++ {
+		if e := &a.ring[s%size]; f.match(e) {
+			entries = append(entries, *e)
+		}
+	}
+	if limit > 0 && len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+
+	return entries
+}
+
+// AdminHandler lists entries filtered by type, id, client and since/until
+// unix time arguments, format=jsonl exports them as JSON lines
+func (a *Audit) AdminHandler() http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		f := auditFilter{typ: q.Get("type"), id: q.Get("id"), client: q.Get("client")}
+		var err error
+		if v := q.Get("since"); v != "" {
+			if f.since, err = strconv.ParseInt(v, 10, 64); err != nil {
+				http.Error(rw, "bad since", http.StatusBadRequest)
+				return
+			}
+		}
+		if v := q.Get("until"); v != "" {
+			if f.until, err = strconv.ParseInt(v, 10, 64); err != nil {
+				http.Error(rw, "bad until", http.StatusBadRequest)
+				return
+			}
+		}
+		limit := 0
+		if v := q.Get("limit"); v != "" {
+			if limit, err = strconv.Atoi(v); err != nil || limit < 0 {
+				http.Error(rw, "bad limit", http.StatusBadRequest)
+				return
+			}
+		}
+
+		entries := a.entries(f, limit)
+		if q.Get("format") == "jsonl" {
+			rw.Header().Set("Content-Type", "application/x-ndjson")
+			rw.Header().Set("Content-Disposition", `attachment; filename="audit.jsonl"`)
+			enc := json.NewEncoder(rw)
+			for i := range entries {
+				enc.Encode(&entries[i])
+			}
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(map[string][]AuditEntry{"entries": entries})
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestClientIdentity(t *testing.T) {
+	a := NewAudit(1, nil, map[string]bool{"10.0.0.1": true, "10.0.0.2": true})
+
+	tests := []struct {
+		name      string
+		remote    string
+		principal string
+		headers   map[string]string
+		want      string
+	}{
+		{"principal", "1.2.3.4", "apikey:svc", map[string]string{"Authorization": "Bearer x"}, "apikey:svc"},
+		// unverified basic username is not taken
+		{"basic", "1.2.3.4", "", map[string]string{"Authorization": "Basic YWRtaW46eA=="}, "token:"},
+		{"address", "1.2.3.4", "", nil, "ip:1.2.3.4"},
+		{"untrusted forwarded", "1.2.3.4", "", map[string]string{"X-Forwarded-For": "5.6.7.8"}, "ip:1.2.3.4"},
+		{"trusted forwarded", "10.0.0.1", "", map[string]string{"X-Forwarded-For": "5.6.7.8"}, "ip:5.6.7.8"},
+		{"trusted chain", "10.0.0.1", "", map[string]string{"X-Forwarded-For": "5.6.7.8, 10.0.0.2"}, "ip:5.6.7.8"},
+		{"spoofed before client", "10.0.0.1", "", map[string]string{"X-Forwarded-For": "9.9.9.9, 5.6.7.8"}, "ip:5.6.7.8"},
+		{"trusted without header", "10.0.0.1", "", nil, "ip:10.0.0.1"},
+	}
+	for _, tt := range tests {
+		var req fasthttp.Request
+		for k, v := range tt.headers {
+			req.Header.Set(k, v)
+		}
+		var c fasthttp.RequestCtx
+		c.Init(&req, &net.TCPAddr{IP: net.ParseIP(tt.remote)}, nil)
+		if tt.principal != "" {
+			c.SetUserValue(principalKey, tt.principal)
+		}
+		if got := a.clientIdentity(&c); !strings.HasPrefix(got, tt.want) {
+			t.Errorf("%s: %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDiffFields(t *testing.T) {
+	tests := []struct {
+		before, after string
+		want          string
+	}{
+		{`{"id":1,"a":1}`, `{"id":1,"a":2}`, `[{"field":"a","old":1,"new":2}]`},
+		{``, `{"id":1}`, `[{"field":"id","old":null,"new":1}]`},
+		{`{"id":1,"b":"x"}`, `{"id":1}`, `[{"field":"b","old":"x","new":null}]`},
+		{`{"id":1}`, `{"id":1}`, `[]`},
+	}
+	for _, tt := range tests {
+		got, _ := json.Marshal(diffFields([]byte(tt.before), []byte(tt.after)))
+		if string(got) != tt.want {
+			t.Errorf("diffFields(%s, %s) = %s, want %s", tt.before, tt.after, got, tt.want)
+		}
+	}
+}
+
+func TestAuditWrap(t *testing.T) {
+	d := newTestDatabase(t, StorageMap)
+	d.SetUser(User{ID: 1, Email: "a@example.com", FirstName: "A", LastName: "B", Gender: "m"})
+	var out bytes.Buffer
+	a := NewAudit(1000, &out, nil)
+	h := a.Wrap(ChangeUser, d.Users.JSON, func(c *fasthttp.RequestCtx) {
+		if err := d.UpsertUser(c.UserValue("id").(string), c.PostBody()); err != nil {
+			ErrorResponse(c, errorStatus(err), true)
+			return
+		}
+		OkResponse(c, []byte(`{}`), true)
+	})
+	post := func(id, body string) int {
+		var c fasthttp.RequestCtx
+		c.Request.Header.SetMethod("POST")
+		c.Request.SetBody([]byte(body))
+		c.SetUserValue("id", id)
+		h(&c)
+		return c.Response.StatusCode()
+	}
+
+	// concurrent writes of the same user chain their diffs
+	const writers = 50
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			post("1", `{"first_name":"N`+strconv.Itoa(i)+`"}`)
+		}(i)
+	}
+	wg.Wait()
+	post("new", `{"id":2,"email":"b@example.com","first_name":"C","last_name":"D","gender":"f","birth_date":0}`)
+	post("9", `{"first_name":"X"}`)
+
+	entries := a.entries(auditFilter{}, 0)
+	if len(entries) != writers+1 {
+		t.Fatalf("%d entries, want %d", len(entries), writers+1)
+	}
+	prev := json.RawMessage(`"A"`)
+	for _, e := range entries[:writers] {
+		if len(e.Fields) != 1 || string(e.Fields[0].Old) != string(prev) {
+			t.Fatalf("entry %d %+v does not follow %s", e.Seq, e.Fields, prev)
+		}
+		prev = e.Fields[0].New
+	}
+	if e := entries[writers]; !e.Created || e.ID != 2 {
+		t.Errorf("created entry %+v", e)
+	}
+	if n := strings.Count(out.String(), "\n"); n != writers+1 {
+		t.Errorf("%d log lines, want %d", n, writers+1)
+	}
+}
+
+func TestAuditWrapParallel(t *testing.T) {
+	a := NewAudit(10, nil, nil)
+	current := func(id uint32) ([]byte, bool) { return []byte(`{}`), true }
+	// write of user 1 waits for write of user 2 to start
+	started := make(chan struct{})
+	h := a.Wrap(ChangeUser, current, func(c *fasthttp.RequestCtx) {
+		if c.UserValue("id") == "2" {
+			close(started)
+		} else {
+			<-started
+		}
+	})
+	post := func(id string) {
+		var c fasthttp.RequestCtx
+		c.Request.Header.SetMethod("POST")
+		c.SetUserValue("id", id)
+		h(&c)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		post("1")
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	post("2")
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("write of another entity blocked")
+	}
+}
+
+func TestAuditAdminHandler(t *testing.T) {
+	a := NewAudit(3, nil, nil)
+	for i := 1; i <= 4; i++ {
+		a.Record("apikey:"+strconv.Itoa(i%2), ChangeUser, uint32(i), nil, []byte(`{}`))
+	}
+	a.Record("apikey:1", ChangeVisit, 1, []byte(`{}`), []byte(`{"mark":1}`))
+
+	tests := []struct {
+		uri  string
+		code int
+		// sequences of entries
+		want string
+	}{
+		{"/admin/audit", 200, "3 4 5"},
+		{"/admin/audit?type=user", 200, "3 4"},
+		{"/admin/audit?client=apikey:1", 200, "3 5"},
+		{"/admin/audit?id=1", 200, "5"},
+		{"/admin/audit?limit=1", 200, "5"},
+		{"/admin/audit?until=1", 200, ""},
+		{"/admin/audit?since=x", 400, ""},
+		{"/admin/audit?limit=-1", 400, ""},
+	}
+	for _, tt := range tests {
+		rw := httptest.NewRecorder()
+		a.AdminHandler()(rw, httptest.NewRequest("GET", tt.uri, nil))
+		if rw.Code != tt.code {
+			t.Errorf("%s: %d, want %d", tt.uri, rw.Code, tt.code)
+			continue
+		}
+		if rw.Code != 200 {
+			continue
+		}
+		var r struct {
+			Entries []AuditEntry `json:"entries"`
+		}
+		json.Unmarshal(rw.Body.Bytes(), &r)
+		var seqs []string
+		for _, e := range r.Entries {
+			seqs = append(seqs, strconv.FormatUint(e.Seq, 10))
+		}
+		if got := strings.Join(seqs, " "); got != tt.want {
+			t.Errorf("%s: %s, want %s", tt.uri, got, tt.want)
+		}
+	}
+
+	rw := httptest.NewRecorder()
+	a.AdminHandler()(rw, httptest.NewRequest("GET", "/admin/audit?format=jsonl", nil))
+	if n := strings.Count(rw.Body.String(), "\n"); n != 3 || rw.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Errorf("jsonl export: %d lines, %s", n, rw.Header().Get("Content-Type"))
+	}
+}
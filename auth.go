@@ -0,0 +1,552 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Access is level of access to routes, every level includes lower ones
+type Access int
+
+const (
+	AccessNone Access = iota
+	AccessRead
+	AccessWrite
+	AccessAdmin
+)
+
+var accessNames = []string{"none", "read", "write", "admin"}
+
+func (a Access) String() string {
+	return accessNames[a]
+}
+
+func parseAccess(s string) (Access, error) {
+	for a, name := range accessNames {
+		if s == name {
+			return Access(a), nil
+		}
+	}
+
+	return AccessNone, fmt.Errorf("bad access %q, want none, read, write or admin", s)
+}
+
+// longest clock difference of HMAC-signed request and server
+const hmacSkew = 5 * time.Minute
+
+// headers carrying credentials, left out of requests between nodes
+var credentialHeaders = []string{"Authorization", "X-Api-Key", "X-Hlcup-Date"}
+
+var errNoCredentials = errors.New("no credentials")
+
+// Principal is authenticated client, name is prefixed with its scheme
+type Principal struct {
+	Name   string
+	Access Access
+}
+
+// Credentials is request as seen by authenticators
+type Credentials struct {
+	Header func(name string) string
+	Method string
+	// path with query as sent by client
+	URI  string
+	Body []byte
+	// body is not available, so signatures cannot be checked
+	Unsigned bool
+}
+
+// Authenticator checks one kind of credentials
+type Authenticator interface {
+	// Scheme is name of Authorization header scheme
+	Scheme() string
+	// Authenticate returns errNoCredentials when request has none of its
+	// credentials, so the next authenticator is tried
+	Authenticate(cr *Credentials) (Principal, error)
+}
+
+// readKeyFile calls fn with whitespace separated fields of non-empty lines,
+// lines starting with # are comments
+func readKeyFile(file string, fields int, fn func(f []string) error) error {
+	r, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		f := strings.Fields(line)
+		if len(f) != fields {
+			return fmt.Errorf("%s:%d: want %d fields, got %d", file, n, fields, len(f))
+		}
+		if err := fn(f); err != nil {
+			return fmt.Errorf("%s:%d: %s", file, n, err)
+		}
+	}
+
+	return s.Err()
+}
+
+// APIKeys authenticates X-Api-Key header. Keys are looked up by hash, so
+// lookup time tells nothing about them
+type APIKeys map[[sha256.Size]byte]Principal
+
+// LoadAPIKeys reads "key name access" lines
+func LoadAPIKeys(file string) (APIKeys, error) {
+	keys := make(APIKeys)
+	err := readKeyFile(file, 3, func(f []string) error {
+		access, err := parseAccess(f[2])
+		keys[sha256.Sum256([]byte(f[0]))] = Principal{"apikey:" + f[1], access}
+		return err
+	})
+
+	return keys, err
+}
+
+func (keys APIKeys) Scheme() string {
+	return "ApiKey"
+}
+
+func (keys APIKeys) Authenticate(cr *Credentials) (Principal, error) {
+	key := cr.Header("X-Api-Key")
+	if key == "" {
+		return Principal{}, errNoCredentials
+	}
+	p, ok := keys[sha256.Sum256([]byte(key))]
+	if !ok {
+		return p, errors.New("unknown api key")
+	}
+
+	return p, nil
+}
+
+type hmacKey struct {
+	secret    []byte
+	principal Principal
+}
+
+// HMACAuth authenticates requests signed with shared secret of key id:
+//
+//	Authorization: HMAC <id>:<hex HMAC-SHA256>
+//	X-Hlcup-Date: <unix time>
+//
+// Signed string is method, URI, date and body joined with newlines
+type HMACAuth map[string]hmacKey
+
+// LoadHMACKeys reads "id secret name access" lines
+func LoadHMACKeys(file string) (HMACAuth, error) {
+	keys := make(HMACAuth)
+	err := readKeyFile(file, 4, func(f []string) error {
+		access, err := parseAccess(f[3])
+		keys[f[0]] = hmacKey{[]byte(f[1]), Principal{"hmac:" + f[2], access}}
+		return err
+	})
+
+	return keys, err
+}
+
+// SignRequest returns signature of request for HMAC Authorization header
+func SignRequest(secret []byte, method, uri, date string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(method + "\n" + uri + "\n" + date + "\n"))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (keys HMACAuth) Scheme() string {
+	return "HMAC"
+}
+
+func (keys HMACAuth) Authenticate(cr *Credentials) (Principal, error) {
+	auth := cr.Header("Authorization")
+	if !strings.HasPrefix(auth, "HMAC ") {
+		return Principal{}, errNoCredentials
+	}
+	if cr.Unsigned {
+		return Principal{}, errors.New("signed requests are not supported here")
+	}
+
+	id := strings.SplitN(auth[len("HMAC "):], ":", 2)
+	key, ok := keys[id[0]]
+	if len(id) != 2 || !ok {
+		return Principal{}, errors.New("unknown hmac key")
+	}
+	date := cr.Header("X-Hlcup-Date")
+	at, err := strconv.ParseInt(date, 10, 64)
+	if err != nil {
+		return Principal{}, errors.New("bad X-Hlcup-Date")
+	}
+	if skew := time.Since(time.Unix(at, 0)); skew > hmacSkew || skew < -hmacSkew {
+		return Principal{}, errors.New("request date out of range")
+	}
+
+	sig, err := hex.DecodeString(id[1])
+	want, _ := hex.DecodeString(SignRequest(key.secret, cr.Method, cr.URI, date, cr.Body))
+	if err != nil || !hmac.Equal(sig, want) {
+		return Principal{}, errors.New("bad signature")
+	}
+
+	return key.principal, nil
+}
+
+// JWTAuth authenticates bearer JWT signed with HS256 secret, RS256 or ES256
+// key. Subject claim names client and role claim gives its access
+type JWTAuth struct {
+	alg    string
+	secret []byte
+	rsa    *rsa.PublicKey
+	ecdsa  *ecdsa.PublicKey
+}
+
+// LoadJWTKey reads PEM public key, RSA or P-256, anything else is taken
+// for HS256 secret
+func LoadJWTKey(file string) (*JWTAuth, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		secret := bytes.TrimSpace(data)
+		if len(secret) == 0 {
+			return nil, fmt.Errorf("%s: empty secret", file)
+		}
+		return &JWTAuth{alg: "HS256", secret: secret}, nil
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return &JWTAuth{alg: "RS256", rsa: k}, nil
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("%s: only P-256 curve is supported", file)
+		}
+		return &JWTAuth{alg: "ES256", ecdsa: k}, nil
+	}
+
+	return nil, fmt.Errorf("%s: unsupported key type %T", file, key)
+}
+
+func (j *JWTAuth) Scheme() string {
+	return "Bearer"
+}
+
+func (j *JWTAuth) verify(signed string, sig []byte) bool {
+	switch j.alg {
+	case "HS256":
+		mac := hmac.New(sha256.New, j.secret)
+		mac.Write([]byte(signed))
+		return hmac.Equal(sig, mac.Sum(nil))
+	case "RS256":
+		sum := sha256.Sum256([]byte(signed))
+		return rsa.VerifyPKCS1v15(j.rsa, crypto.SHA256, sum[:], sig) == nil
+	case "ES256":
+		if len(sig) != 64 {
+			return false
+		}
+		sum := sha256.Sum256([]byte(signed))
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(j.ecdsa, sum[:], r, s)
+	}
+
+	return false
+}
+
+func (j *JWTAuth) Authenticate(cr *Credentials) (Principal, error) {
+	auth := cr.Header("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return Principal{}, errNoCredentials
+	}
+
+	parts := strings.Split(auth[len("Bearer "):], ".")
+	if len(parts) != 3 {
+		return Principal{}, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	var claims struct {
+		Sub  string `json:"sub"`
+		Role string `json:"role"`
+		Exp  int64  `json:"exp"`
+		Nbf  int64  `json:"nbf"`
+	}
+	h, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(h, &header) != nil {
+		return Principal{}, errors.New("malformed token header")
+	}
+	// algorithm is fixed by key, so tokens cannot pick a weaker one
+	if header.Alg != j.alg {
+		return Principal{}, fmt.Errorf("token algorithm %q, want %s", header.Alg, j.alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !j.verify(parts[0]+"."+parts[1], sig) {
+		return Principal{}, errors.New("bad token signature")
+	}
+	c, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(c, &claims) != nil {
+		return Principal{}, errors.New("malformed token claims")
+	}
+
+	now := time.Now().Unix()
+	if claims.Exp != 0 && now >= claims.Exp {
+		return Principal{}, errors.New("token expired")
+	}
+	if claims.Nbf != 0 && now < claims.Nbf {
+		return Principal{}, errors.New("token not valid yet")
+	}
+	if claims.Sub == "" {
+		return Principal{}, errors.New("token has no subject")
+	}
+	access, err := parseAccess(claims.Role)
+	if err != nil {
+		return Principal{}, err
+	}
+
+	return Principal{"jwt:" + claims.Sub, access}, nil
+}
+
+// Auth authenticates requests with the first authenticator recognizing
+// their credentials and checks access route requires. Requests without
+// credentials get anonymous access
+type Auth struct {
+	schemes   []Authenticator
+	anonymous Access
+	// access required by "METHOD /path" instead of default one
+	routes map[string]Access
+}
+
+// LoadAuth makes Auth of key files given in config, it is nil when none
+// is given and all routes are open
+func LoadAuth() (*Auth, error) {
+	a := &Auth{routes: make(map[string]Access)}
+	if config.AuthAPIKeys != "" {
+		keys, err := LoadAPIKeys(config.AuthAPIKeys)
+		if err != nil {
+			return nil, err
+		}
+		a.schemes = append(a.schemes, keys)
+	}
+	if config.AuthHMACKeys != "" {
+		keys, err := LoadHMACKeys(config.AuthHMACKeys)
+		if err != nil {
+			return nil, err
+		}
+		a.schemes = append(a.schemes, keys)
+	}
+	if config.AuthJWTKey != "" {
+		j, err := LoadJWTKey(config.AuthJWTKey)
+		if err != nil {
+			return nil, err
+		}
+		a.schemes = append(a.schemes, j)
+	}
+	if len(a.schemes) == 0 {
+		return nil, nil
+	}
+
+	var err error
+	if a.anonymous, err = parseAccess(config.AuthAnonymous); err != nil {
+		return nil, err
+	}
+	for _, r := range strings.Split(config.AuthRoutes, ",") {
+		if strings.TrimSpace(r) == "" {
+			continue
+		}
+		i := strings.LastIndex(r, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("bad auth route %q, want METHOD /path=access", r)
+		}
+		access, err := parseAccess(strings.TrimSpace(r[i+1:]))
+		if err != nil {
+			return nil, err
+		}
+		a.routes[strings.Join(strings.Fields(r[:i]), " ")] = access
+	}
+
+	return a, nil
+}
+
+// Trust accepts requests nodes authenticated ahead of client credentials,
+// Auth may be nil
+func (a *Auth) Trust(nodes Authenticator) {
+	if a != nil {
+		a.schemes = append([]Authenticator{nodes}, a.schemes...)
+	}
+}
+
+// access returns access required by route, def unless it is overridden
+func (a *Auth) access(method, route string, def Access) Access {
+	if access, ok := a.routes[method+" "+route]; ok {
+		return access
+	}
+
+	return def
+}
+
+// authorize returns principal of request and status denying it, 0 when
+// request is allowed
+func (a *Auth) authorize(cr *Credentials, need Access) (Principal, int) {
+	p := Principal{Access: a.anonymous}
+	for _, s := range a.schemes {
+		cp, err := s.Authenticate(cr)
+		if err == errNoCredentials {
+			continue
+		}
+		if err != nil {
+			return cp, http.StatusUnauthorized
+		}
+		p = cp
+		break
+	}
+
+	switch {
+	case p.Access >= need:
+		return p, 0
+	case p.Name == "":
+		return p, http.StatusUnauthorized
+	}
+	return p, http.StatusForbidden
+}
+
+func (a *Auth) challenge() string {
+	schemes := make([]string, 0, len(a.schemes))
+	for _, s := range a.schemes {
+		// nodes are not challenged
+		if s.Scheme() != "" {
+			schemes = append(schemes, s.Scheme())
+		}
+	}
+
+	return strings.Join(schemes, ", ")
+}
+
+// Guard serves route with h when client has access it requires, need
+// unless overridden. Auth is nil when authentication is off
+func (a *Auth) Guard(method, route string, need Access, h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	if a == nil {
+		return h
+	}
+	need = a.access(method, route, need)
+
+	return func(c *fasthttp.RequestCtx) {
+		cr := &Credentials{
+			Header: func(name string) string {
+				return string(c.Request.Header.Peek(name))
+			},
+			Method: string(c.Method()),
+			URI:    string(c.RequestURI()),
+			Body:   ClientBody(c),
+		}
+		p, status := a.authorize(cr, need)
+		if status != 0 {
+			if status == http.StatusUnauthorized {
+				c.Response.Header.Set("WWW-Authenticate", a.challenge())
+			}
+			ErrorResponse(c, status, c.IsPost())
+			return
+		}
+		c.SetUserValue(principalKey, p.Name)
+		h(c)
+	}
+}
+
+// Admin serves admin requests with h when client has admin access, unless
+// route is overridden
+func (a *Auth) Admin(h http.Handler) http.Handler {
+	if a == nil {
+		return h
+	}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		cr := &Credentials{Header: r.Header.Get, Method: r.Method, URI: r.URL.RequestURI(), Body: body}
+		if _, status := a.authorize(cr, a.access(r.Method, r.URL.Path, AccessAdmin)); status != 0 {
+			if status == http.StatusUnauthorized {
+				rw.Header().Set("WWW-Authenticate", a.challenge())
+			}
+			http.Error(rw, http.StatusText(status), status)
+			return
+		}
+		h.ServeHTTP(rw, r)
+	})
+}
+
+// context key of principal authenticated by UnaryInterceptor
+type principalContextKey struct{}
+
+// UnaryInterceptor checks credentials of gRPC metadata, upserts need write
+// access and other calls read. Messages are decoded by then, so signed
+// requests are not accepted
+func (a *Auth) UnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	cr := &Credentials{
+		Header: func(name string) string {
+			if v := md.Get(name); len(v) > 0 {
+				return v[0]
+			}
+			return ""
+		},
+		Method:   "GRPC",
+		URI:      info.FullMethod,
+		Unsigned: true,
+	}
+
+	need := AccessRead
+	if strings.HasPrefix(path.Base(info.FullMethod), "Upsert") {
+		need = AccessWrite
+	}
+	p, s := a.authorize(cr, a.access("GRPC", info.FullMethod, need))
+	switch s {
+	case http.StatusUnauthorized:
+		return nil, status.Error(codes.Unauthenticated, "authentication required")
+	case http.StatusForbidden:
+		return nil, status.Error(codes.PermissionDenied, "access denied")
+	}
+
+	return handler(context.WithValue(ctx, principalContextKey{}, p.Name), req)
+}
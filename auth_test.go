@@ -0,0 +1,397 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ugorji/go/codec"
+	"github.com/valyala/fasthttp"
+)
+
+func TestParseAccess(t *testing.T) {
+	for a, name := range accessNames {
+		got, err := parseAccess(name)
+		if err != nil || got != Access(a) || got.String() != name {
+			t.Errorf("parseAccess(%q) = %s, %v", name, got, err)
+		}
+	}
+	if _, err := parseAccess("root"); err == nil {
+		t.Error("parseAccess(root) accepted")
+	}
+}
+
+func TestLoadAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keys := filepath.Join(dir, "keys")
+	ioutil.WriteFile(keys, []byte("# key name access\n\nk1 svc write\n"), 0600)
+	bad := filepath.Join(dir, "bad")
+	ioutil.WriteFile(bad, []byte("k1 svc\n"), 0600)
+
+	saved := config
+	defer func() { config = saved }()
+
+	config = Config{AuthAnonymous: "none"}
+	if a, err := LoadAuth(); a != nil || err != nil {
+		t.Errorf("no key files: %v, %v, want nil auth", a, err)
+	}
+
+	config = Config{AuthAPIKeys: keys, AuthAnonymous: "read", AuthRoutes: "GET /changes=admin, GET  /metrics = none"}
+	a, err := LoadAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.anonymous != AccessRead || a.routes["GET /changes"] != AccessAdmin || a.routes["GET /metrics"] != AccessNone {
+		t.Errorf("anonymous %s, routes %v", a.anonymous, a.routes)
+	}
+	p, err := a.schemes[0].Authenticate(&Credentials{Header: headers{"X-Api-Key": "k1"}.get})
+	if err != nil || p != (Principal{"apikey:svc", AccessWrite}) {
+		t.Errorf("api key: %+v, %v", p, err)
+	}
+
+	for _, c := range []Config{
+		{AuthAPIKeys: bad, AuthAnonymous: "none"},
+		{AuthAPIKeys: filepath.Join(dir, "missing"), AuthAnonymous: "none"},
+		{AuthAPIKeys: keys, AuthAnonymous: "all"},
+		{AuthAPIKeys: keys, AuthAnonymous: "none", AuthRoutes: "GET /changes"},
+		{AuthAPIKeys: keys, AuthAnonymous: "none", AuthRoutes: "GET /changes=root"},
+	} {
+		config = c
+		if _, err := LoadAuth(); err == nil {
+			t.Errorf("%+v accepted", c)
+		}
+	}
+}
+
+// headers is credentials header lookup of tests
+type headers map[string]string
+
+func (h headers) get(name string) string {
+	return h[name]
+}
+
+func TestHMACAuth(t *testing.T) {
+	keys := HMACAuth{"k1": {[]byte("secret"), Principal{"hmac:svc", AccessWrite}}}
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	old := strconv.FormatInt(time.Now().Add(-2*hmacSkew).Unix(), 10)
+	body := []byte(`{"id":1}`)
+	sign := func(secret, date string) string {
+		return "HMAC k1:" + SignRequest([]byte(secret), "POST", "/users/new", date, body)
+	}
+
+	tests := []struct {
+		name     string
+		h        headers
+		body     []byte
+		unsigned bool
+		err      string
+	}{
+		{"signed", headers{"Authorization": sign("secret", now), "X-Hlcup-Date": now}, body, false, ""},
+		{"none", headers{"Authorization": "Bearer x"}, body, false, errNoCredentials.Error()},
+		{"other secret", headers{"Authorization": sign("guess", now), "X-Hlcup-Date": now}, body, false, "bad signature"},
+		{"changed body", headers{"Authorization": sign("secret", now), "X-Hlcup-Date": now}, []byte(`{"id":2}`), false, "bad signature"},
+		{"unknown key", headers{"Authorization": "HMAC k2:00", "X-Hlcup-Date": now}, body, false, "unknown hmac key"},
+		{"no signature", headers{"Authorization": "HMAC k1", "X-Hlcup-Date": now}, body, false, "unknown hmac key"},
+		{"not hex", headers{"Authorization": "HMAC k1:zz", "X-Hlcup-Date": now}, body, false, "bad signature"},
+		{"no date", headers{"Authorization": sign("secret", now)}, body, false, "bad X-Hlcup-Date"},
+		{"old date", headers{"Authorization": sign("secret", old), "X-Hlcup-Date": old}, body, false, "request date out of range"},
+		{"unsigned", headers{"Authorization": sign("secret", now), "X-Hlcup-Date": now}, nil, true, "signed requests are not supported here"},
+	}
+	for _, tt := range tests {
+		cr := &Credentials{Header: tt.h.get, Method: "POST", URI: "/users/new", Body: tt.body, Unsigned: tt.unsigned}
+		p, err := keys.Authenticate(cr)
+		switch {
+		case tt.err == "" && (err != nil || p.Name != "hmac:svc"):
+			t.Errorf("%s: %+v, %v", tt.name, p, err)
+		case tt.err != "" && (err == nil || err.Error() != tt.err):
+			t.Errorf("%s: %v, want %s", tt.name, err, tt.err)
+		}
+	}
+}
+
+// signJWT makes token of header and claims signed by sign
+func signJWT(header, claims interface{}, sign func(signed string) []byte) string {
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign(signed))
+}
+
+func hs256(secret []byte) func(string) []byte {
+	return func(signed string) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(signed))
+		return mac.Sum(nil)
+	}
+}
+
+// writeJWTKey writes PEM public key and loads it like -auth-jwt-key does
+func writeJWTKey(t *testing.T, dir string, pub interface{}) (*JWTAuth, []byte) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	file := filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(file, data, 0600)
+	j, err := LoadJWTKey(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return j, data
+}
+
+func TestJWTAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jwt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	secretFile := filepath.Join(dir, "secret")
+	ioutil.WriteFile(secretFile, []byte("s3cret\n"), 0600)
+	hs, err := LoadJWTKey(secretFile)
+	if err != nil || hs.alg != "HS256" {
+		t.Fatalf("HS256 key: %+v, %v", hs, err)
+	}
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	rs, rsPEM := writeJWTKey(t, dir, &rsaKey.PublicKey)
+	rs256 := func(signed string) []byte {
+		sum := sha256.Sum256([]byte(signed))
+		sig, _ := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, sum[:])
+		return sig
+	}
+
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	es, _ := writeJWTKey(t, dir, &ecKey.PublicKey)
+	es256 := func(signed string) []byte {
+		sum := sha256.Sum256([]byte(signed))
+		r, s, _ := ecdsa.Sign(rand.Reader, ecKey, sum[:])
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		return sig
+	}
+
+	now := time.Now().Unix()
+	valid := map[string]interface{}{"sub": "alice", "role": "write", "exp": now + 60}
+	tests := []struct {
+		name  string
+		j     *JWTAuth
+		token string
+		err   string
+	}{
+		{"HS256", hs, signJWT(map[string]string{"alg": "HS256"}, valid, hs256([]byte("s3cret"))), ""},
+		{"RS256", rs, signJWT(map[string]string{"alg": "RS256"}, valid, rs256), ""},
+		{"ES256", es, signJWT(map[string]string{"alg": "ES256"}, valid, es256), ""},
+		{"HS256 other secret", hs, signJWT(map[string]string{"alg": "HS256"}, valid, hs256([]byte("guess"))), "bad token signature"},
+		// public key taken for HS256 secret
+		{"alg confusion", rs, signJWT(map[string]string{"alg": "HS256"}, valid, hs256(rsPEM)), `token algorithm "HS256", want RS256`},
+		{"alg none", hs, signJWT(map[string]string{"alg": "none"}, valid, func(string) []byte { return nil }), `token algorithm "none", want HS256`},
+		{"ES256 short signature", es, signJWT(map[string]string{"alg": "ES256"}, valid, func(string) []byte { return []byte("x") }), "bad token signature"},
+		{"expired", hs, signJWT(map[string]string{"alg": "HS256"}, map[string]interface{}{"sub": "alice", "role": "write", "exp": now - 1}, hs256([]byte("s3cret"))), "token expired"},
+		{"not valid yet", hs, signJWT(map[string]string{"alg": "HS256"}, map[string]interface{}{"sub": "alice", "role": "write", "nbf": now + 60}, hs256([]byte("s3cret"))), "token not valid yet"},
+		{"no subject", hs, signJWT(map[string]string{"alg": "HS256"}, map[string]interface{}{"role": "write"}, hs256([]byte("s3cret"))), "token has no subject"},
+		{"bad role", hs, signJWT(map[string]string{"alg": "HS256"}, map[string]interface{}{"sub": "alice", "role": "root"}, hs256([]byte("s3cret"))), `bad access "root", want none, read, write or admin`},
+		{"malformed", hs, "a.b", "malformed token"},
+		{"malformed header", hs, "!.b.c", "malformed token header"},
+	}
+	for _, tt := range tests {
+		p, err := tt.j.Authenticate(&Credentials{Header: headers{"Authorization": "Bearer " + tt.token}.get})
+		switch {
+		case tt.err == "" && (err != nil || p != (Principal{"jwt:alice", AccessWrite})):
+			t.Errorf("%s: %+v, %v", tt.name, p, err)
+		case tt.err != "" && (err == nil || err.Error() != tt.err):
+			t.Errorf("%s: %v, want %s", tt.name, err, tt.err)
+		}
+	}
+
+	if _, err := hs.Authenticate(&Credentials{Header: headers{"X-Api-Key": "k"}.get}); err != errNoCredentials {
+		t.Errorf("no bearer: %v, want errNoCredentials", err)
+	}
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	der, _ := x509.MarshalPKIXPublicKey(&p384.PublicKey)
+	ioutil.WriteFile(secretFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600)
+	if _, err := LoadJWTKey(secretFile); err == nil {
+		t.Error("P-384 key accepted")
+	}
+}
+
+func newTestAuth() *Auth {
+	return &Auth{
+		schemes: []Authenticator{
+			APIKeys{
+				sha256.Sum256([]byte("reader")): {"apikey:reader", AccessRead},
+				sha256.Sum256([]byte("admin")):  {"apikey:admin", AccessAdmin},
+			},
+			HMACAuth{"k1": {[]byte("secret"), Principal{"hmac:svc", AccessWrite}}},
+		},
+		anonymous: AccessNone,
+		routes:    map[string]Access{"GET /open": AccessNone},
+	}
+}
+
+func TestGuard(t *testing.T) {
+	a := newTestAuth()
+	var principal string
+	ok := func(c *fasthttp.RequestCtx) {
+		principal, _ = c.UserValue(principalKey).(string)
+		OkResponse(c, []byte(`{}`), false)
+	}
+	read := a.Guard("GET", "/users", AccessRead, ok)
+	open := a.Guard("GET", "/open", AccessAdmin, ok)
+	write := Formats(a.Guard("POST", "/users/:id", AccessWrite, ok))
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	var msgpack []byte
+	codec.NewEncoderBytes(&msgpack, &msgpackHandle).Encode(map[string]interface{}{"first_name": "A"})
+	signed := func(body []byte) headers {
+		return headers{
+			"Authorization": "HMAC k1:" + SignRequest([]byte("secret"), "POST", "/users/1", now, body),
+			"X-Hlcup-Date":  now,
+		}
+	}
+
+	tests := []struct {
+		name        string
+		h           fasthttp.RequestHandler
+		headers     headers
+		contentType string
+		body        []byte
+		status      int
+		principal   string
+	}{
+		{"anonymous", read, nil, "", nil, 401, ""},
+		{"unknown key", read, headers{"X-Api-Key": "guess"}, "", nil, 401, ""},
+		{"reader", read, headers{"X-Api-Key": "reader"}, "", nil, 200, "apikey:reader"},
+		{"reader writes", write, headers{"X-Api-Key": "reader"}, "", []byte(`{}`), 403, ""},
+		{"admin writes", write, headers{"X-Api-Key": "admin"}, "", []byte(`{}`), 200, "apikey:admin"},
+		{"route override", open, nil, "", nil, 200, ""},
+		{"signed JSON", write, signed([]byte(`{"first_name":"A"}`)), "application/json", []byte(`{"first_name":"A"}`), 200, "hmac:svc"},
+		// signature is made over MessagePack body client sent, not over
+		// JSON it is transcoded into
+		{"signed msgpack", write, signed(msgpack), "application/msgpack", msgpack, 200, "hmac:svc"},
+		{"signed other body", write, signed([]byte(`{}`)), "application/msgpack", msgpack, 401, ""},
+	}
+	for _, tt := range tests {
+		var c fasthttp.RequestCtx
+		c.Request.Header.SetMethod("GET")
+		c.Request.SetRequestURI("/users")
+		if tt.body != nil {
+			c.Request.Header.SetMethod("POST")
+			c.Request.SetRequestURI("/users/1")
+			c.Request.Header.SetContentType(tt.contentType)
+			c.Request.SetBody(tt.body)
+		}
+		for k, v := range tt.headers {
+			c.Request.Header.Set(k, v)
+		}
+		principal = ""
+		tt.h(&c)
+
+		if c.Response.StatusCode() != tt.status || principal != tt.principal {
+			t.Errorf("%s: status %d principal %q, want %d %q", tt.name, c.Response.StatusCode(), principal, tt.status, tt.principal)
+		}
+		challenge := string(c.Response.Header.Peek("WWW-Authenticate"))
+		if (tt.status == 401) != (challenge == "ApiKey, HMAC") {
+			t.Errorf("%s: WWW-Authenticate %q", tt.name, challenge)
+		}
+	}
+
+	if h := (*Auth)(nil).Guard("GET", "/users", AccessAdmin, ok); h == nil {
+		t.Error("nil auth guard")
+	}
+}
+
+func TestAuthAdmin(t *testing.T) {
+	a := newTestAuth()
+	a.routes["GET /metrics"] = AccessRead
+	h := a.Admin(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		rw.Write(body)
+	}))
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	tests := []struct {
+		method, path string
+		headers      headers
+		body         string
+		status       int
+	}{
+		{"GET", "/status", nil, "", 401},
+		{"GET", "/status", headers{"X-Api-Key": "reader"}, "", 403},
+		{"GET", "/metrics", headers{"X-Api-Key": "reader"}, "", 200},
+		{"GET", "/status", headers{"X-Api-Key": "admin"}, "", 200},
+		// body read for signature is still there for handler
+		{"POST", "/webhooks", headers{"X-Api-Key": "admin"}, `{"url":"x"}`, 200},
+		{"POST", "/webhooks", headers{
+			"Authorization": "HMAC k1:" + SignRequest([]byte("secret"), "POST", "/webhooks", now, []byte(`{}`)),
+			"X-Hlcup-Date":  now,
+		}, `{}`, 403},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		for k, v := range tt.headers {
+			r.Header.Set(k, v)
+		}
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, r)
+
+		if rw.Code != tt.status {
+			t.Errorf("%s %s %v: status %d, want %d", tt.method, tt.path, tt.headers, rw.Code, tt.status)
+		}
+		if rw.Code == 200 && rw.Body.String() != tt.body {
+			t.Errorf("%s %s: body %q, want %q", tt.method, tt.path, rw.Body, tt.body)
+		}
+		if (rw.Code == 401) != (rw.Header().Get("WWW-Authenticate") != "") {
+			t.Errorf("%s %s: WWW-Authenticate %q", tt.method, tt.path, rw.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
+
+func TestRestoreBody(t *testing.T) {
+	var msgpack []byte
+	codec.NewEncoderBytes(&msgpack, &msgpackHandle).Encode(map[string]interface{}{"id": 1})
+
+	var c fasthttp.RequestCtx
+	c.Request.Header.SetMethod("POST")
+	c.Request.Header.SetContentType("application/msgpack")
+	c.Request.SetBody(msgpack)
+	if err := decodeBody(&c); err != nil {
+		t.Fatal(err)
+	}
+	if string(c.PostBody()) != `{"id":1}` || string(ClientBody(&c)) != string(msgpack) {
+		t.Errorf("post body %s, client body %x", c.PostBody(), ClientBody(&c))
+	}
+
+	var req fasthttp.Request
+	c.Request.CopyTo(&req)
+	restoreBody(&c, &req)
+	if string(req.Body()) != string(msgpack) || string(req.Header.ContentType()) != "application/msgpack" {
+		t.Errorf("relayed body %x of %s", req.Body(), req.Header.ContentType())
+	}
+}
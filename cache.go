@@ -0,0 +1,216 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/valyala/fasthttp"
+)
+
+// kinds of cached responses
+const (
+	CacheUserVisits = iota
+	CacheUserTimeline
+	CacheLocationAvg
+	CacheLocationTimeline
+	cacheKinds
+)
+
+var cacheNames = [cacheKinds]string{"user_visits", "user_timeline", "location_avg", "location_timeline"}
+
+// number of invalidation generation counters
+const cacheStripes = 4096
+
+// responses of one route for one entity
+type cacheKey struct {
+	kind int
+	id   uint32
+}
+
+func (k cacheKey) stripe() int {
+	return int((uint32(k.kind)*2654435761 ^ k.id) % cacheStripes)
+}
+
+// ResponseCache keeps bodies of GET responses keyed by route, entity id and
+// normalized query, writes drop everything computed from entities they touch
+type ResponseCache struct {
+	mu     sync.RWMutex
+	groups map[cacheKey]map[string][]byte
+	// bumped on invalidation, so responses computed before a write are not stored
+	gens  [cacheStripes]uint64
+	size  int
+	limit int
+
+	hits   [cacheKinds]uint64
+	misses [cacheKinds]uint64
+}
+
+func NewResponseCache(limit int) *ResponseCache {
+	return &ResponseCache{
+		groups: make(map[cacheKey]map[string][]byte),
+		limit:  limit,
+	}
+}
+
+// Get returns cached body and generation to pass to Put on miss
+func (rc *ResponseCache) Get(k cacheKey, args string) ([]byte, uint64, bool) {
+	rc.mu.RLock()
+	body, ok := rc.groups[k][args]
+	gen := rc.gens[k.stripe()]
+	rc.mu.RUnlock()
+
+	if ok {
+		atomic.AddUint64(&rc.hits[k.kind], 1)
+	} else {
+		atomic.AddUint64(&rc.misses[k.kind], 1)
+	}
+
+	return body, gen, ok
+}
+
+// Put stores body unless entity was invalidated since gen
+func (rc *ResponseCache) Put(k cacheKey, args string, body []byte, gen uint64) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if rc.gens[k.stripe()] != gen {
+		return
+	}
+	// evict arbitrary groups when full
+	for g := range rc.groups {
+		if rc.size < rc.limit {
+			break
+		}
+		rc.size -= len(rc.groups[g])
+		delete(rc.groups, g)
+	}
+
+	if _, ok := rc.groups[k]; !ok {
+		rc.groups[k] = make(map[string][]byte)
+	}
+	if _, ok := rc.groups[k][args]; !ok {
+		rc.size++
+	}
+	rc.groups[k][args] = body
+}
+
+// Invalidate drops responses of kind for entity id
+func (rc *ResponseCache) Invalidate(kind int, id uint32) {
+	if rc == nil {
+		return
+	}
+
+	k := cacheKey{kind, id}
+	rc.mu.Lock()
+	rc.size -= len(rc.groups[k])
+	delete(rc.groups, k)
+	rc.gens[k.stripe()]++
+	rc.mu.Unlock()
+}
+
+// Len returns number of cached responses
+func (rc *ResponseCache) Len() int {
+	rc.mu.RLock()
+	defer rc.mu.RUnlock()
+
+	return rc.size
+}
+
+// Stats returns hits and misses of kind
+func (rc *ResponseCache) Stats(kind int) (uint64, uint64) {
+	return atomic.LoadUint64(&rc.hits[kind]), atomic.LoadUint64(&rc.misses[kind])
+}
+
+// cacheArgs normalizes query so that argument order does not matter
+func cacheArgs(args *fasthttp.Args) string {
+	if args.Len() == 0 {
+		return ""
+	}
+
+	kv := make([]string, 0, args.Len())
+	args.VisitAll(func(k, v []byte) {
+		kv = append(kv, string(k)+"="+string(v))
+	})
+	sort.Strings(kv)
+
+	return strings.Join(kv, "&")
+}
+
+// Cached serves h responses of kind from cache, entity id is taken
+// from "id" path parameter. Single entities are not cached here as
+// database keeps them marshalled
+func (d Database) Cached(kind int, h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	if d.Cache == nil {
+		return h
+	}
+
+	return func(c *fasthttp.RequestCtx) {
+		id, err := strconv.ParseUint(c.UserValue("id").(string), 10, 32)
+		if err != nil {
+			h(c)
+			return
+		}
+
+		qa := c.QueryArgs()
+		// past state changes as history sweep drops old versions
+		if d.History != nil && qa.Has("asOf") {
+			h(c)
+			return
+		}
+		args := cacheArgs(qa)
+		// ages counted against wall clock change with date
+		if (qa.Has("fromAge") || qa.Has("toAge")) && !qa.Has("asOf") && d.Ages.Mode == ClockWall {
+			args += "&@day=" + strconv.FormatInt(dayStart(d.Ages.Now()), 10)
+		}
+
+		k := cacheKey{kind, uint32(id)}
+		body, gen, ok := d.Cache.Get(k, args)
+		if ok {
+			OkResponse(c, body, false)
+			return
+		}
+
+		h(c)
+		if c.Response.StatusCode() == fasthttp.StatusOK {
+			d.Cache.Put(k, args, append([]byte(nil), c.Response.Body()...), gen)
+		}
+	}
+}
+
+// invalidateUser drops responses depending on user fields, visits of
+// user and locations avg and timeline are filtered by gender and age
+func (d Database) invalidateUser(old, u User) {
+	if old.Gender == u.Gender && old.Birthday == u.Birthday {
+		return
+	}
+	d.Cache.Invalidate(CacheUserVisits, u.ID)
+	d.Cache.Invalidate(CacheUserTimeline, u.ID)
+	for _, vID := range d.UserVisit.Get(u.ID) {
+		v, _ := d.Visits.Get(vID)
+		d.Cache.Invalidate(CacheLocationAvg, v.Location)
+		d.Cache.Invalidate(CacheLocationTimeline, v.Location)
+	}
+}
+
+// invalidateLocation drops responses depending on location fields,
+// user visits show place and are filtered by country, distance and coordinates
+func (d Database) invalidateLocation(l Location) {
+	d.Cache.Invalidate(CacheLocationAvg, l.ID)
+	d.Cache.Invalidate(CacheLocationTimeline, l.ID)
+	for _, vID := range d.LocationVisits.Get(l.ID) {
+		v, _ := d.Visits.Get(vID)
+		d.Cache.Invalidate(CacheUserVisits, v.User)
+		d.Cache.Invalidate(CacheUserTimeline, v.User)
+	}
+}
+
+// invalidateVisit drops responses of visit, its user and location
+func (d Database) invalidateVisit(v Visit) {
+	d.Cache.Invalidate(CacheUserVisits, v.User)
+	d.Cache.Invalidate(CacheUserTimeline, v.User)
+	d.Cache.Invalidate(CacheLocationAvg, v.Location)
+	d.Cache.Invalidate(CacheLocationTimeline, v.Location)
+}
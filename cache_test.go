@@ -0,0 +1,152 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestCacheArgs(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"", ""},
+		{"toDate=5&fromDate=1", "fromDate=1&toDate=5"},
+		{"fromDate=1&toDate=5", "fromDate=1&toDate=5"},
+		{"country=%D0%A0%D0%A4", "country=РФ"},
+	}
+	for _, tt := range tests {
+		var args fasthttp.Args
+		args.Parse(tt.query)
+		if got := cacheArgs(&args); got != tt.want {
+			t.Errorf("cacheArgs(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestResponseCacheGeneration(t *testing.T) {
+	rc := NewResponseCache(10)
+	k := cacheKey{CacheUserVisits, 1}
+
+	_, gen, ok := rc.Get(k, "")
+	if ok {
+		t.Fatal("hit on empty cache")
+	}
+	// response computed before write is not stored
+	rc.Invalidate(CacheUserVisits, 1)
+	rc.Put(k, "", []byte("stale"), gen)
+	if _, _, ok := rc.Get(k, ""); ok {
+		t.Error("stale response stored")
+	}
+
+	_, gen, _ = rc.Get(k, "")
+	rc.Put(k, "", []byte("fresh"), gen)
+	if body, _, ok := rc.Get(k, ""); !ok || string(body) != "fresh" {
+		t.Errorf("Get = %q, %v", body, ok)
+	}
+	if hits, misses := rc.Stats(CacheUserVisits); hits != 1 || misses != 3 {
+		t.Errorf("hits %d, misses %d", hits, misses)
+	}
+
+	// limit bounds number of responses
+	for i := uint32(2); i < 30; i++ {
+		k := cacheKey{CacheLocationAvg, i}
+		_, gen, _ := rc.Get(k, "")
+		rc.Put(k, "", []byte("{}"), gen)
+	}
+	if rc.Len() > 10 {
+		t.Errorf("Len() = %d over limit", rc.Len())
+	}
+}
+
+func TestCachedInvalidation(t *testing.T) {
+	d := newTestDatabase(t, StorageMap)
+	d.Cache = NewResponseCache(100)
+	d.SetUser(User{ID: 1, Gender: "m"})
+	d.SetUser(User{ID: 2, Gender: "f"})
+	d.SetLocation(Location{ID: 1, Country: "Россия"})
+	d.SetLocation(Location{ID: 2, Country: "Франция"})
+	d.SetVisit(Visit{ID: 1, User: 1, Location: 1, Mark: 5})
+
+	calls := map[cacheKey]int{}
+	handler := func(kind int) fasthttp.RequestHandler {
+		return d.Cached(kind, func(c *fasthttp.RequestCtx) {
+			id, _ := strconv.Atoi(c.UserValue("id").(string))
+			calls[cacheKey{kind, uint32(id)}]++
+			OkResponse(c, []byte(`{}`), false)
+		})
+	}
+	get := func(kind int, id uint32) {
+		var c fasthttp.RequestCtx
+		c.SetUserValue("id", strconv.Itoa(int(id)))
+		handler(kind)(&c)
+	}
+
+	tests := []struct {
+		name  string
+		write func()
+		kind  int
+		id    uint32
+		calls int
+	}{
+		{"first", func() {}, CacheUserVisits, 1, 1},
+		{"cached", func() {}, CacheUserVisits, 1, 1},
+		{"visit moved to user 2", func() { d.SetVisit(Visit{ID: 1, User: 2, Location: 1, Mark: 5}) }, CacheUserVisits, 1, 2},
+		{"location avg", func() {}, CacheLocationAvg, 1, 1},
+		{"user gender changed", func() { d.SetUser(User{ID: 2, Gender: "m"}) }, CacheLocationAvg, 1, 2},
+		{"user name changed", func() { d.SetUser(User{ID: 2, Gender: "m", FirstName: "X"}) }, CacheLocationAvg, 1, 2},
+		{"user visits", func() {}, CacheUserVisits, 2, 1},
+		{"location country changed", func() { d.SetLocation(Location{ID: 1, Country: "Италия"}) }, CacheUserVisits, 2, 2},
+		{"other location", func() { d.SetLocation(Location{ID: 2, Country: "Испания"}) }, CacheUserVisits, 2, 2},
+		{"user timeline", func() {}, CacheUserTimeline, 2, 1},
+		// own visits are filtered by user age and gender
+		{"user birth date changed", func() { d.SetUser(User{ID: 2, Gender: "m", FirstName: "X", Birthday: 900000000}) }, CacheUserVisits, 2, 3},
+		{"user timeline after birth date", func() {}, CacheUserTimeline, 2, 2},
+		{"user gender changed back", func() { d.SetUser(User{ID: 2, Gender: "f", FirstName: "X", Birthday: 900000000}) }, CacheUserVisits, 2, 4},
+	}
+	for _, tt := range tests {
+		tt.write()
+		get(tt.kind, tt.id)
+		if n := calls[cacheKey{tt.kind, tt.id}]; n != tt.calls {
+			t.Errorf("%s: handler called %d times, want %d", tt.name, n, tt.calls)
+		}
+	}
+}
+
+func TestCachedAsOf(t *testing.T) {
+	d := newTestDatabase(t, StorageMap)
+	d.Cache = NewResponseCache(100)
+	calls := 0
+	h := d.Cached(CacheUserVisits, func(c *fasthttp.RequestCtx) {
+		calls++
+		OkResponse(c, []byte(`{}`), false)
+	})
+	get := func() {
+		var c fasthttp.RequestCtx
+		c.Request.SetRequestURI("/users/1/visits?asOf=1000")
+		c.SetUserValue("id", "1")
+		h(&c)
+	}
+
+	// without history asOf only moves age reference
+	get()
+	get()
+	if calls != 1 {
+		t.Errorf("handler called %d times without history, want 1", calls)
+	}
+
+	d.History = NewHistory(time.Hour)
+	defer d.History.Close()
+	h = d.Cached(CacheUserVisits, func(c *fasthttp.RequestCtx) {
+		calls++
+		OkResponse(c, []byte(`{}`), false)
+	})
+	get()
+	get()
+	if calls != 3 {
+		t.Errorf("handler called %d times with history, want 3", calls)
+	}
+}
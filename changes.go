@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mailru/easyjson"
+	"github.com/valyala/fasthttp"
+)
+
+// entity types of changes
+const (
+	ChangeUser     = "user"
+	ChangeLocation = "location"
+	ChangeVisit    = "visit"
+)
+
+// max changes per response or event batch, longest long-poll and
+// heartbeat period of event stream
+const (
+	changesBatch     = 1000
+	changesMaxWait   = time.Minute
+	changesHeartbeat = 15 * time.Second
+)
+
+//easyjson:json
+type Change struct {
+	Seq    uint64              `json:"seq"`
+	Type   string              `json:"type"`
+	ID     uint32              `json:"id"`
+	Before easyjson.RawMessage `json:"before"`
+	After  easyjson.RawMessage `json:"after"`
+}
+
+//easyjson:json
+type Changes struct {
+	Changes []Change `json:"changes"`
+	// sequence to resume from
+	Last uint64 `json:"last"`
+}
+
+// ChangeFeed keeps ordered log of last entity mutations in ring buffer
+type ChangeFeed struct {
+	mu   sync.Mutex
+	ring []Change
+	// sequence of last change, first change is 1
+	seq uint64
+	// closed and replaced on every append to wake up waiters
+	notify chan struct{}
+}
+
+func NewChangeFeed(size int) *ChangeFeed {
+	return &ChangeFeed{ring: make([]Change, size), notify: make(chan struct{})}
+}
+
+// Append logs mutation of entity, before is nil for created entities
+func (f *ChangeFeed) Append(typ string, id uint32, before []byte, after []byte) {
+	if f == nil {
+		return
+	}
+
+	f.mu.Lock()
+	f.seq++
+	f.ring[f.seq%uint64(len(f.ring))] = Change{f.seq, typ, id, before, after}
+	close(f.notify)
+	f.notify = make(chan struct{})
+	f.mu.Unlock()
+}
+
+// Since returns up to max changes after seq and channel closed on next
+// append. ok is false when changes after seq were already overwritten
+func (f *ChangeFeed) Since(seq uint64, max int) (changes []Change, notify <-chan struct{}, ok bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if seq > f.seq {
+		seq = f.seq
+	}
+	if f.seq-seq > uint64(len(f.ring)) {
+		return nil, f.notify, false
+	}
+
+	changes = make([]Change, 0)
+	for s := seq + 1; s <= f.seq && len(changes) < max; s++ {
+		changes = append(changes, f.ring[s%uint64(len(f.ring))])
+	}
+
+	return changes, f.notify, true
+}
+
+// Last returns sequence of last change
+func (f *ChangeFeed) Last() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.seq
+}
+
+// Oldest returns sequence to resume from to get every kept change
+func (f *ChangeFeed) Oldest() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.seq > uint64(len(f.ring)) {
+		return f.seq - uint64(len(f.ring))
+	}
+	return 0
+}
+
+// changesSince reads resume point from since argument or Last-Event-ID,
+// clients giving neither start from the oldest kept change
+func (f *ChangeFeed) changesSince(c *fasthttp.RequestCtx) (uint64, error) {
+	since := c.QueryArgs().Peek("since")
+	if len(since) == 0 {
+		since = c.Request.Header.Peek("Last-Event-ID")
+	}
+	if len(since) == 0 {
+		return f.Oldest(), nil
+	}
+
+	return strconv.ParseUint(string(since), 10, 64)
+}
+
+// Handler serves changes after since argument, all kept ones without it,
+// as JSON long-poll, waiting up to wait seconds for the first one, or as
+// server-sent events when client accepts text/event-stream. 410 Gone means
+// client lags too far behind and has to reload entities
+func (f *ChangeFeed) Handler(limit int, streamFor time.Duration) fasthttp.RequestHandler {
+	return func(c *fasthttp.RequestCtx) {
+		since, err := f.changesSince(c)
+		if err != nil {
+			ErrorResponse(c, fasthttp.StatusBadRequest, false)
+			return
+		}
+		if _, _, ok := f.Since(since, 0); !ok {
+			ErrorResponse(c, fasthttp.StatusGone, false)
+			return
+		}
+
+		if bytes.Contains(c.Request.Header.Peek("Accept"), []byte("text/event-stream")) {
+			f.stream(c, since, limit, streamFor)
+			return
+		}
+
+		wait := time.Duration(0)
+		if c.QueryArgs().Has("wait") {
+			sec, err := strconv.Atoi(string(c.QueryArgs().Peek("wait")))
+			if err != nil || sec < 0 {
+				ErrorResponse(c, fasthttp.StatusBadRequest, false)
+				return
+			}
+			wait = time.Duration(sec) * time.Second
+			if wait > changesMaxWait {
+				wait = changesMaxWait
+			}
+		}
+
+		deadline := time.After(wait)
+		for {
+			changes, notify, ok := f.Since(since, limit)
+			if !ok {
+				ErrorResponse(c, fasthttp.StatusGone, false)
+				return
+			}
+			if len(changes) > 0 || wait == 0 {
+				r := Changes{changes, since}
+				if len(changes) > 0 {
+					r.Last = changes[len(changes)-1].Seq
+				}
+				response, _ := r.MarshalJSON()
+				OkResponse(c, response, false)
+				return
+			}
+
+			select {
+			case <-notify:
+			case <-deadline:
+				wait = 0
+			}
+		}
+	}
+}
+
+// stream writes changes as server-sent events for streamFor, so that
+// response fits into server write timeout, clients reconnect with
+// Last-Event-ID
+func (f *ChangeFeed) stream(c *fasthttp.RequestCtx, since uint64, limit int, streamFor time.Duration) {
+	c.Response.Header.Set("Content-Type", "text/event-stream")
+	c.Response.Header.Set("Cache-Control", "no-cache")
+	c.SetBodyStreamWriter(func(w *bufio.Writer) {
+		end := time.After(streamFor)
+		heartbeat := time.NewTicker(changesHeartbeat)
+		defer heartbeat.Stop()
+
+		for {
+			changes, notify, ok := f.Since(since, limit)
+			if !ok {
+				w.WriteString("event: gone\ndata: {}\n\n")
+				w.Flush()
+				return
+			}
+			for _, ch := range changes {
+				data, _ := ch.MarshalJSON()
+				w.WriteString("id: " + strconv.FormatUint(ch.Seq, 10) + "\nevent: " + ch.Type + "\ndata: ")
+				w.Write(data)
+				w.WriteString("\n\n")
+				since = ch.Seq
+			}
+			if len(changes) > 0 {
+				if err := w.Flush(); err != nil {
+					return
+				}
+				continue
+			}
+
+			select {
+			case <-notify:
+			case <-heartbeat.C:
+				w.WriteString(": ping\n\n")
+				if err := w.Flush(); err != nil {
+					return
+				}
+			case <-end:
+				return
+			}
+		}
+	})
+}
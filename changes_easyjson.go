@@ -0,0 +1,218 @@
+// Code generated by easyjson for marshaling/unmarshaling. DO NOT EDIT.
+
+package main
+
+import (
+	json "encoding/json"
+	easyjson "github.com/mailru/easyjson"
+	jlexer "github.com/mailru/easyjson/jlexer"
+	jwriter "github.com/mailru/easyjson/jwriter"
+)
+
+// suppress unused package warning
+var (
+	_ *json.RawMessage
+	_ *jlexer.Lexer
+	_ *jwriter.Writer
+	_ easyjson.Marshaler
+)
+
+func easyjson4ce3cd59DecodeBitbucketOrgPdedkovHlcup(in *jlexer.Lexer, out *Changes) {
+	isTopLevel := in.IsStart()
+	if in.IsNull() {
+		if isTopLevel {
+			in.Consumed()
+		}
+		in.Skip()
+		return
+	}
+	in.Delim('{')
+	for !in.IsDelim('}') {
+		key := in.UnsafeFieldName(false)
+		in.WantColon()
+		if in.IsNull() {
+			in.Skip()
+			in.WantComma()
+			continue
+		}
+		switch key {
+		case "changes":
+			if in.IsNull() {
+				in.Skip()
+				out.Changes = nil
+			} else {
+				in.Delim('[')
+				if out.Changes == nil {
+					if !in.IsDelim(']') {
+						out.Changes = make([]Change, 0, 0)
+					} else {
+						out.Changes = []Change{}
+					}
+				} else {
+					out.Changes = (out.Changes)[:0]
+				}
+				for !in.IsDelim(']') {
+					var v1 Change
+					(v1).UnmarshalEasyJSON(in)
+					out.Changes = append(out.Changes, v1)
+					in.WantComma()
+				}
+				in.Delim(']')
+			}
+		case "last":
+			out.Last = uint64(in.Uint64())
+		default:
+			in.SkipRecursive()
+		}
+		in.WantComma()
+	}
+	in.Delim('}')
+	if isTopLevel {
+		in.Consumed()
+	}
+}
+func easyjson4ce3cd59EncodeBitbucketOrgPdedkovHlcup(out *jwriter.Writer, in Changes) {
+	out.RawByte('{')
+	first := true
+	_ = first
+	{
+		const prefix string = ",\"changes\":"
+		out.RawString(prefix[1:])
+		if in.Changes == nil && (out.Flags&jwriter.NilSliceAsEmpty) == 0 {
+			out.RawString("null")
+		} else {
+			out.RawByte('[')
+			for v2, v3 := range in.Changes {
+				if v2 > 0 {
+					out.RawByte(',')
+				}
+				(v3).MarshalEasyJSON(out)
+			}
+			out.RawByte(']')
+		}
+	}
+	{
+		const prefix string = ",\"last\":"
+		out.RawString(prefix)
+		out.Uint64(uint64(in.Last))
+	}
+	out.RawByte('}')
+}
+
+// MarshalJSON supports json.Marshaler interface
+func (v Changes) MarshalJSON() ([]byte, error) {
+	w := jwriter.Writer{}
+	easyjson4ce3cd59EncodeBitbucketOrgPdedkovHlcup(&w, v)
+	return w.Buffer.BuildBytes(), w.Error
+}
+
+// MarshalEasyJSON supports easyjson.Marshaler interface
+func (v Changes) MarshalEasyJSON(w *jwriter.Writer) {
+	easyjson4ce3cd59EncodeBitbucketOrgPdedkovHlcup(w, v)
+}
+
+// UnmarshalJSON supports json.Unmarshaler interface
+func (v *Changes) UnmarshalJSON(data []byte) error {
+	r := jlexer.Lexer{Data: data}
+	easyjson4ce3cd59DecodeBitbucketOrgPdedkovHlcup(&r, v)
+	return r.Error()
+}
+
+// UnmarshalEasyJSON supports easyjson.Unmarshaler interface
+func (v *Changes) UnmarshalEasyJSON(l *jlexer.Lexer) {
+	easyjson4ce3cd59DecodeBitbucketOrgPdedkovHlcup(l, v)
+}
+func easyjson4ce3cd59DecodeBitbucketOrgPdedkovHlcup1(in *jlexer.Lexer, out *Change) {
+	isTopLevel := in.IsStart()
+	if in.IsNull() {
+		if isTopLevel {
+			in.Consumed()
+		}
+		in.Skip()
+		return
+	}
+	in.Delim('{')
+	for !in.IsDelim('}') {
+		key := in.UnsafeFieldName(false)
+		in.WantColon()
+		if in.IsNull() {
+			in.Skip()
+			in.WantComma()
+			continue
+		}
+		switch key {
+		case "seq":
+			out.Seq = uint64(in.Uint64())
+		case "type":
+			out.Type = string(in.String())
+		case "id":
+			out.ID = uint32(in.Uint32())
+		case "before":
+			(out.Before).UnmarshalEasyJSON(in)
+		case "after":
+			(out.After).UnmarshalEasyJSON(in)
+		default:
+			in.SkipRecursive()
+		}
+		in.WantComma()
+	}
+	in.Delim('}')
+	if isTopLevel {
+		in.Consumed()
+	}
+}
+func easyjson4ce3cd59EncodeBitbucketOrgPdedkovHlcup1(out *jwriter.Writer, in Change) {
+	out.RawByte('{')
+	first := true
+	_ = first
+	{
+		const prefix string = ",\"seq\":"
+		out.RawString(prefix[1:])
+		out.Uint64(uint64(in.Seq))
+	}
+	{
+		const prefix string = ",\"type\":"
+		out.RawString(prefix)
+		out.String(string(in.Type))
+	}
+	{
+		const prefix string = ",\"id\":"
+		out.RawString(prefix)
+		out.Uint32(uint32(in.ID))
+	}
+	{
+		const prefix string = ",\"before\":"
+		out.RawString(prefix)
+		(in.Before).MarshalEasyJSON(out)
+	}
+	{
+		const prefix string = ",\"after\":"
+		out.RawString(prefix)
+		(in.After).MarshalEasyJSON(out)
+	}
+	out.RawByte('}')
+}
+
+// MarshalJSON supports json.Marshaler interface
+func (v Change) MarshalJSON() ([]byte, error) {
+	w := jwriter.Writer{}
+	easyjson4ce3cd59EncodeBitbucketOrgPdedkovHlcup1(&w, v)
+	return w.Buffer.BuildBytes(), w.Error
+}
+
+// MarshalEasyJSON supports easyjson.Marshaler interface
+func (v Change) MarshalEasyJSON(w *jwriter.Writer) {
+	easyjson4ce3cd59EncodeBitbucketOrgPdedkovHlcup1(w, v)
+}
+
+// UnmarshalJSON supports json.Unmarshaler interface
+func (v *Change) UnmarshalJSON(data []byte) error {
+	r := jlexer.Lexer{Data: data}
+	easyjson4ce3cd59DecodeBitbucketOrgPdedkovHlcup1(&r, v)
+	return r.Error()
+}
+
+// UnmarshalEasyJSON supports easyjson.Unmarshaler interface
+func (v *Change) UnmarshalEasyJSON(l *jlexer.Lexer) {
+	easyjson4ce3cd59DecodeBitbucketOrgPdedkovHlcup1(l, v)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+func TestChangeFeedSince(t *testing.T) {
+	f := NewChangeFeed(3)
+	if f.Oldest() != 0 || f.Last() != 0 {
+		t.Errorf("empty feed oldest %d last %d", f.Oldest(), f.Last())
+	}
+	for i := 1; i <= 5; i++ {
+		f.Append(ChangeUser, uint32(i), nil, []byte(`{}`))
+	}
+
+	tests := []struct {
+		seq  uint64
+		max  int
+		want string
+		ok   bool
+	}{
+		{0, 10, "[]", false},
+		{1, 10, "[]", false},
+		{2, 10, "[3 4 5]", true},
+		{3, 1, "[4]", true},
+		{5, 10, "[]", true},
+		// clients ahead of feed wait for next change
+		{9, 10, "[]", true},
+	}
+	for _, tt := range tests {
+		changes, _, ok := f.Since(tt.seq, tt.max)
+		seqs := make([]uint64, 0)
+		for _, ch := range changes {
+			seqs = append(seqs, ch.Seq)
+		}
+		if ok != tt.ok || fmt.Sprint(seqs) != tt.want {
+			t.Errorf("Since(%d, %d) = %v, %v, want %s, %v", tt.seq, tt.max, seqs, ok, tt.want, tt.ok)
+		}
+	}
+	if f.Oldest() != 2 || f.Last() != 5 {
+		t.Errorf("oldest %d last %d, want 2 5", f.Oldest(), f.Last())
+	}
+
+	var none *ChangeFeed
+	none.Append(ChangeUser, 1, nil, nil)
+}
+
+func TestChangesHandler(t *testing.T) {
+	f := NewChangeFeed(3)
+	h := f.Handler(2, time.Second)
+	get := func(uri, lastEventID string) (int, string) {
+		var c fasthttp.RequestCtx
+		c.Request.SetRequestURI(uri)
+		if lastEventID != "" {
+			c.Request.Header.Set("Last-Event-ID", lastEventID)
+		}
+		h(&c)
+		return c.Response.StatusCode(), string(c.Response.Body())
+	}
+
+	if code, body := get("/changes", ""); code != 200 || body != `{"changes":[],"last":0}` {
+		t.Errorf("empty feed: %d %s", code, body)
+	}
+	for i := 1; i <= 5; i++ {
+		f.Append(ChangeVisit, uint32(i), nil, []byte(`{"id":1}`))
+	}
+
+	tests := []struct {
+		uri         string
+		lastEventID string
+		code        int
+		// sequences of changes and resume point
+		want string
+	}{
+		// buffer overflowed, clients without resume point get kept changes
+		{"/changes", "", 200, "[3 4] 4"},
+		{"/changes?since=4", "", 200, "[5] 5"},
+		{"/changes", "4", 200, "[5] 5"},
+		{"/changes?since=3", "1", 200, "[4 5] 5"},
+		{"/changes?since=5", "", 200, "[] 5"},
+		{"/changes?since=1", "", 410, ""},
+		{"/changes?since=x", "", 400, ""},
+		{"/changes?since=5&wait=-1", "", 400, ""},
+	}
+	for _, tt := range tests {
+		code, body := get(tt.uri, tt.lastEventID)
+		if code != tt.code {
+			t.Errorf("%s (%s): %d %s, want %d", tt.uri, tt.lastEventID, code, body, tt.code)
+			continue
+		}
+		if code != 200 {
+			continue
+		}
+		var r Changes
+		if err := r.UnmarshalJSON([]byte(body)); err != nil {
+			t.Fatalf("%s: %s", body, err)
+		}
+		seqs := make([]uint64, 0)
+		for _, ch := range r.Changes {
+			seqs = append(seqs, ch.Seq)
+		}
+		if got := fmt.Sprint(seqs, " ", r.Last); got != tt.want {
+			t.Errorf("%s (%s): %s, want %s", tt.uri, tt.lastEventID, got, tt.want)
+		}
+	}
+}
+
+func TestChangesLongPoll(t *testing.T) {
+	f := NewChangeFeed(10)
+	h := f.Handler(10, time.Second)
+
+	done := make(chan string)
+	go func() {
+		var c fasthttp.RequestCtx
+		c.Request.SetRequestURI("/changes?since=0&wait=5")
+		h(&c)
+		done <- string(c.Response.Body())
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	f.Append(ChangeUser, 7, nil, []byte(`{"id":7}`))
+	select {
+	case body := <-done:
+		if !strings.Contains(body, `"id":7`) || !strings.HasSuffix(body, `"last":1}`) {
+			t.Errorf("long-poll got %s", body)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("long-poll not woken by append")
+	}
+}
+
+func TestChangesStream(t *testing.T) {
+	f := NewChangeFeed(10)
+	f.Append(ChangeUser, 1, nil, []byte(`{"id":1}`))
+	f.Append(ChangeLocation, 2, nil, []byte(`{"id":2}`))
+
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+	go fasthttp.Serve(ln, f.Handler(10, 200*time.Millisecond))
+
+	conn, err := ln.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET /changes HTTP/1.1\r\nHost: x\r\nAccept: text/event-stream\r\nLast-Event-ID: 1\r\n\r\n"))
+
+	// appended while streaming
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		f.Append(ChangeVisit, 3, nil, []byte(`{"id":3}`))
+	}()
+
+	var resp fasthttp.Response
+	if err := resp.Read(bufio.NewReader(conn)); err != nil {
+		t.Fatal(err)
+	}
+	if ct := string(resp.Header.ContentType()); ct != "text/event-stream" {
+		t.Errorf("content type %s", ct)
+	}
+	body := string(resp.Body())
+	if strings.Contains(body, "id: 1\n") || !strings.Contains(body, "id: 2\nevent: location\n") || !strings.Contains(body, "id: 3\nevent: visit\n") {
+		t.Errorf("stream %q", body)
+	}
+}
@@ -0,0 +1,706 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mailru/easyjson"
+	log "github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+)
+
+// headers of requests between nodes: index of sending shard, its clock,
+// principal it authenticated and signature of request with cluster secret.
+// Signed requests are served locally, anyone else's are routed
+const (
+	clusterHeader          = "X-Hlcup-Shard"
+	clusterDateHeader      = "X-Hlcup-Shard-Date"
+	clusterPrincipalHeader = "X-Hlcup-Shard-Principal"
+	clusterAuthHeader      = "X-Hlcup-Shard-Auth"
+)
+
+// headers covered by signature besides method, URI and body
+var clusterSigned = []string{clusterHeader, clusterDateHeader, clusterPrincipalHeader}
+
+const (
+	// longest clock difference of nodes
+	clusterSkew = 30 * time.Second
+	// longest wait for answer of node to write sent in background
+	clusterTimeout = 5 * time.Second
+	// location writes queued for every peer, longest wait for peers to
+	// apply write before client is answered and longest pause between
+	// attempts to deliver it
+	clusterQueue    = 10000
+	clusterSyncWait = time.Second
+	clusterRetryMax = 5 * time.Second
+)
+
+// user value caching whether request is signed by other node
+const clusterInternalKey = "clusterInternal"
+
+//easyjson:json
+type MarkSum struct {
+	Sum   int `json:"sum"`
+	Count int `json:"count"`
+}
+
+// Cluster partitions users and their visits by user id between nodes,
+// locations are kept on every node. Requests are routed to shard owning
+// entity, location averages are merged from all of them. Nodes sign their
+// requests to each other with shared secret
+type Cluster struct {
+	self   int
+	nodes  []*fasthttp.HostClient
+	secret []byte
+	// IPs of nodes, trusted for X-Forwarded-For
+	peers map[string]bool
+
+	// location writes of this node waiting for delivery to each peer,
+	// writeMu keeps their order the one they were applied in
+	writeMu sync.Mutex
+	queues  []chan *clusterWrite
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// clusterWrite is location write sent to peer in background, done is
+// closed once peer has taken it
+type clusterWrite struct {
+	req  *fasthttp.Request
+	done chan struct{}
+}
+
+// NewCluster makes self one of nodes given by API addresses, all nodes
+// have to be started with the same list and secret
+func NewCluster(addrs []string, self int, secret string) (*Cluster, error) {
+	if self < 0 || self >= len(addrs) {
+		return nil, fmt.Errorf("shard %d out of %d nodes", self, len(addrs))
+	}
+	if secret == "" {
+		return nil, errors.New("cluster needs secret")
+	}
+
+	peers, err := resolveHosts(addrs)
+	if err != nil {
+		return nil, err
+	}
+	cl := &Cluster{self: self, secret: []byte(secret), peers: peers, stop: make(chan struct{})}
+	for _, addr := range addrs {
+		if _, _, err := net.SplitHostPort(strings.TrimSpace(addr)); err != nil {
+			return nil, err
+		}
+		cl.nodes = append(cl.nodes, &fasthttp.HostClient{
+			Addr:         strings.TrimSpace(addr),
+			ReadTimeout:  config.ReadTimeout,
+			WriteTimeout: config.WriteTimeout,
+		})
+	}
+	cl.queues = make([]chan *clusterWrite, len(cl.nodes))
+	for node := range cl.nodes {
+		if node == self {
+			continue
+		}
+		cl.queues[node] = make(chan *clusterWrite, clusterQueue)
+		cl.wg.Add(1)
+		go cl.deliver(node)
+	}
+
+	return cl, nil
+}
+
+// resolveHosts returns IPs of hosts of addresses, ports are optional
+func resolveHosts(addrs []string) (map[string]bool, error) {
+	ips := make(map[string]bool)
+	for _, addr := range addrs {
+		host := strings.TrimSpace(addr)
+		if host == "" {
+			continue
+		}
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		resolved, err := net.LookupIP(host)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range resolved {
+			ips[ip.String()] = true
+		}
+	}
+
+	return ips, nil
+}
+
+// Peers returns IPs of cluster nodes, none outside of cluster mode
+func (cl *Cluster) Peers() map[string]bool {
+	if cl == nil {
+		return nil
+	}
+
+	return cl.peers
+}
+
+// Shard returns node owning user and their visits, for location id it
+// returns node its writes go through
+func (cl *Cluster) Shard(id uint32) int {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], id)
+	h := fnv.New32a()
+	h.Write(b[:])
+
+	return int(h.Sum32() % uint32(len(cl.nodes)))
+}
+
+// Owns tells whether user and their visits belong to this node, outside
+// of cluster mode node owns everything
+func (cl *Cluster) Owns(user uint32) bool {
+	return cl == nil || cl.Shard(user) == cl.self
+}
+
+// signature returns signature of request between nodes, header gives
+// values of signed headers
+func (cl *Cluster) signature(method, uri string, header func(name string) string, body []byte) []byte {
+	mac := hmac.New(sha256.New, cl.secret)
+	mac.Write([]byte(method + "\n" + uri + "\n"))
+	for _, name := range clusterSigned {
+		mac.Write([]byte(header(name) + "\n"))
+	}
+	mac.Write(body)
+
+	return mac.Sum(nil)
+}
+
+// sign makes req request of this node
+func (cl *Cluster) sign(req *fasthttp.Request) {
+	req.Header.Set(clusterHeader, strconv.Itoa(cl.self))
+	req.Header.Set(clusterDateHeader, strconv.FormatInt(time.Now().Unix(), 10))
+	header := func(name string) string {
+		return string(req.Header.Peek(name))
+	}
+	sig := cl.signature(string(req.Header.Method()), string(req.URI().RequestURI()), header, req.Body())
+	req.Header.Set(clusterAuthHeader, hex.EncodeToString(sig))
+}
+
+// verify checks signature of request from other node
+func (cl *Cluster) verify(method, uri string, header func(name string) string, body []byte) error {
+	shard, err := strconv.Atoi(header(clusterHeader))
+	if err != nil || shard < 0 || shard >= len(cl.nodes) || shard == cl.self {
+		return errors.New("bad shard")
+	}
+	at, err := strconv.ParseInt(header(clusterDateHeader), 10, 64)
+	if err != nil {
+		return errors.New("bad shard date")
+	}
+	if skew := time.Since(time.Unix(at, 0)); skew > clusterSkew || skew < -clusterSkew {
+		return errors.New("shard date out of range")
+	}
+	sig, err := hex.DecodeString(header(clusterAuthHeader))
+	if err != nil || !hmac.Equal(sig, cl.signature(method, uri, header, body)) {
+		return errors.New("bad shard signature")
+	}
+
+	return nil
+}
+
+// internal tells whether request comes from other node, requests not
+// signed with cluster secret are routed, so clients cannot skip routing
+func (cl *Cluster) internal(c *fasthttp.RequestCtx) bool {
+	if ok, seen := c.UserValue(clusterInternalKey).(bool); seen {
+		return ok
+	}
+	if len(c.Request.Header.Peek(clusterHeader)) == 0 {
+		c.SetUserValue(clusterInternalKey, false)
+		return false
+	}
+
+	header := func(name string) string {
+		return string(c.Request.Header.Peek(name))
+	}
+	err := cl.verify(string(c.Method()), string(c.RequestURI()), header, ClientBody(c))
+	if err != nil {
+		log.Printf("cluster: request of %s: %s", c.RemoteIP(), err)
+	}
+	c.SetUserValue(clusterInternalKey, err == nil)
+
+	return err == nil
+}
+
+func (cl *Cluster) Scheme() string {
+	return ""
+}
+
+// Authenticate accepts requests signed by other nodes with access of
+// principal node authenticated, node has checked it for the route
+func (cl *Cluster) Authenticate(cr *Credentials) (Principal, error) {
+	if cr.Header(clusterHeader) == "" {
+		return Principal{}, errNoCredentials
+	}
+	if cr.Unsigned {
+		return Principal{}, errors.New("signed requests are not supported here")
+	}
+	if err := cl.verify(cr.Method, cr.URI, cr.Header, cr.Body); err != nil {
+		return Principal{}, err
+	}
+
+	return Principal{cr.Header(clusterPrincipalHeader), AccessAdmin}, nil
+}
+
+// relayed returns copy of request to send to other node, answer comes as
+// plain JSON to be encoded and compressed locally
+func relayed(c *fasthttp.RequestCtx) *fasthttp.Request {
+	req := fasthttp.AcquireRequest()
+	c.Request.CopyTo(req)
+	restoreBody(c, req)
+	req.Header.Del("Accept")
+	req.Header.Del("Accept-Encoding")
+
+	return req
+}
+
+// request returns copy of request to send to other node. Credentials of
+// client are left out, node vouches for principal it authenticated instead
+func (cl *Cluster) request(c *fasthttp.RequestCtx) *fasthttp.Request {
+	req := relayed(c)
+	for _, name := range credentialHeaders {
+		req.Header.Del(name)
+	}
+	req.Header.Del(clusterPrincipalHeader)
+	if p, ok := c.UserValue(principalKey).(string); ok && p != "" {
+		req.Header.Set(clusterPrincipalHeader, p)
+	}
+
+	return req
+}
+
+// relay sends copy of request to client and writes its answer to response
+func relay(client *fasthttp.HostClient, c *fasthttp.RequestCtx) error {
+	req := relayed(c)
+	defer fasthttp.ReleaseRequest(req)
+
+	return client.Do(req, &c.Response)
+}
+
+// forwardedFor appends address of client to X-Forwarded-For of request
+// relayed to other node
+func forwardedFor(c *fasthttp.RequestCtx) {
+	xff := c.Request.Header.Peek("X-Forwarded-For")
+	if len(xff) > 0 {
+		xff = append(append(append([]byte(nil), xff...), ", "...), c.RemoteIP().String()...)
+	} else {
+		xff = []byte(c.RemoteIP().String())
+	}
+	c.Request.Header.SetBytesV("X-Forwarded-For", xff)
+}
+
+// proxy serves request with node
+func (cl *Cluster) proxy(c *fasthttp.RequestCtx, node int) {
+	forwardedFor(c)
+	req := cl.request(c)
+	defer fasthttp.ReleaseRequest(req)
+	cl.sign(req)
+	if err := cl.nodes[node].Do(req, &c.Response); err != nil {
+		log.Printf("cluster: shard %s: %s", cl.nodes[node].Addr, err)
+		ErrorResponse(c, fasthttp.StatusBadGateway, false)
+	}
+}
+
+// pathID reads entity id of request from path, for new entities from id
+// field of body, raw returns it
+func pathID(c *fasthttp.RequestCtx, raw func(body []byte) ([]byte, error)) (uint32, bool) {
+	id := c.UserValue("id").(string)
+	if id == "new" && c.IsPost() {
+		b, err := raw(c.PostBody())
+		if err != nil {
+			return 0, false
+		}
+		id = string(b)
+	}
+	uid, err := strconv.ParseUint(id, 10, 32)
+
+	return uint32(uid), err == nil
+}
+
+// pathUser reads user id of request from path, for new users from body
+func pathUser(c *fasthttp.RequestCtx) (uint32, bool) {
+	return pathID(c, func(body []byte) ([]byte, error) {
+		var t RawUser
+		err := t.UnmarshalJSON(body)
+		return t.ID, err
+	})
+}
+
+// pathLocation reads location id of request from path, for new locations
+// from body
+func pathLocation(c *fasthttp.RequestCtx) (uint32, bool) {
+	return pathID(c, func(body []byte) ([]byte, error) {
+		var t RawLocation
+		err := t.UnmarshalJSON(body)
+		return t.ID, err
+	})
+}
+
+// ByUser routes requests of user given by id argument to owning shard
+func (cl *Cluster) ByUser(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	if cl == nil {
+		return h
+	}
+
+	return func(c *fasthttp.RequestCtx) {
+		// invalid ids are answered locally
+		if id, ok := pathUser(c); ok && !cl.internal(c) && !cl.Owns(id) {
+			cl.proxy(c, cl.Shard(id))
+			return
+		}
+		h(c)
+	}
+}
+
+// Any serves request locally and, when entity is not found, asks other
+// shards for it
+func (cl *Cluster) Any(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	if cl == nil {
+		return h
+	}
+
+	return func(c *fasthttp.RequestCtx) {
+		h(c)
+		if cl.internal(c) || c.Response.StatusCode() != fasthttp.StatusNotFound {
+			return
+		}
+
+		for node := range cl.nodes {
+			if node == cl.self {
+				continue
+			}
+			cl.proxy(c, node)
+			if c.Response.StatusCode() != fasthttp.StatusNotFound {
+				return
+			}
+		}
+	}
+}
+
+// VisitWrite routes new visits to shard of their user and updates to
+// shard holding visit. Update moving visit to user of another shard
+// creates it there and deletes it here
+func (cl *Cluster) VisitWrite(d *Database, h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	if cl == nil {
+		return h
+	}
+
+	return func(c *fasthttp.RequestCtx) {
+		var t RawVisit
+		if t.UnmarshalJSON(c.PostBody()) != nil {
+			h(c)
+			return
+		}
+		user, err := strconv.ParseUint(string(t.User), 10, 32)
+		moves := err == nil && !cl.Owns(uint32(user))
+
+		id := c.UserValue("id").(string)
+		vid, err := strconv.ParseUint(id, 10, 32)
+		_, local := d.Visits.Get(uint32(vid))
+		switch {
+		case id == "new" && moves && !cl.internal(c):
+			cl.proxy(c, cl.Shard(uint32(user)))
+		case id == "new" || err != nil:
+			h(c)
+		case local && moves:
+			cl.move(c, d, uint32(vid), cl.Shard(uint32(user)))
+		case local || cl.internal(c):
+			h(c)
+		default:
+			// ids are global, so at most one shard has the visit
+			for node := range cl.nodes {
+				if node == cl.self {
+					continue
+				}
+				cl.proxy(c, node)
+				if c.Response.StatusCode() != fasthttp.StatusNotFound {
+					return
+				}
+			}
+		}
+	}
+}
+
+// move creates visit id updated with request body on node as new one and
+// deletes it here once node has it, node audits it as created
+func (cl *Cluster) move(c *fasthttp.RequestCtx, d *Database, id uint32, node int) {
+	before, _ := d.Visits.JSON(id)
+	body, err := movedVisit(before, c.PostBody())
+	if err != nil {
+		ErrorResponse(c, fasthttp.StatusBadRequest, true)
+		return
+	}
+
+	forwardedFor(c)
+	req := cl.request(c)
+	defer fasthttp.ReleaseRequest(req)
+	req.SetRequestURI("/visits/new")
+	req.Header.SetContentType("application/json")
+	req.SetBody(body)
+	cl.sign(req)
+	if err := cl.nodes[node].Do(req, &c.Response); err != nil {
+		log.Printf("cluster: shard %s: %s", cl.nodes[node].Addr, err)
+		ErrorResponse(c, fasthttp.StatusBadGateway, true)
+		return
+	}
+	if c.Response.StatusCode() == fasthttp.StatusOK {
+		d.DeleteVisit(id)
+	}
+}
+
+// movedVisit returns body creating visit stored as before with fields of
+// update body, update cannot change visit id
+func movedVisit(before, body []byte) ([]byte, error) {
+	var v, t RawVisit
+	if err := v.UnmarshalJSON(before); err != nil {
+		return nil, err
+	}
+	if err := t.UnmarshalJSON(body); err != nil {
+		return nil, err
+	}
+	if len(t.ID) > 0 && string(t.ID) != string(v.ID) {
+		return nil, ErrInvalid
+	}
+	for _, f := range []struct{ to, from *easyjson.RawMessage }{
+		{&v.User, &t.User},
+		{&v.Location, &t.Location},
+		{&v.Visited, &t.Visited},
+		{&v.Mark, &t.Mark},
+	} {
+		if len(*f.from) > 0 {
+			*f.to = *f.from
+		}
+	}
+
+	return v.MarshalJSON()
+}
+
+// Broadcast routes location writes to node owning location, which applies
+// them and queues them for every other node. Queues keep the order writes
+// were applied in and retry until peers take them, client is answered once
+// peers have write or clusterSyncWait passed, then they get it later
+func (cl *Cluster) Broadcast(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	if cl == nil {
+		return h
+	}
+
+	return func(c *fasthttp.RequestCtx) {
+		// invalid ids are answered locally, writes owner delivers are
+		// applied only
+		if id, ok := pathLocation(c); ok && cl.Shard(id) != cl.self {
+			if cl.internal(c) {
+				h(c)
+			} else {
+				cl.proxy(c, cl.Shard(id))
+			}
+			return
+		}
+
+		forwardedFor(c)
+		var pending []*clusterWrite
+		cl.writeMu.Lock()
+		h(c)
+		if c.Response.StatusCode() == fasthttp.StatusOK {
+			for node, q := range cl.queues {
+				if node == cl.self {
+					continue
+				}
+				w := &clusterWrite{cl.request(c), make(chan struct{})}
+				q <- w
+				pending = append(pending, w)
+			}
+		}
+		cl.writeMu.Unlock()
+
+		wait := time.NewTimer(clusterSyncWait)
+		defer wait.Stop()
+		for _, w := range pending {
+			select {
+			case <-w.done:
+			case <-wait.C:
+				log.Printf("cluster: %s queued for peers", c.Path())
+				return
+			}
+		}
+	}
+}
+
+// deliver sends location writes queued for node in order, retrying them
+// until node answers. Writes node refuses are logged, it diverges then
+func (cl *Cluster) deliver(node int) {
+	defer cl.wg.Done()
+
+	for {
+		var w *clusterWrite
+		select {
+		case w = <-cl.queues[node]:
+		case <-cl.stop:
+			return
+		}
+
+		for pause := 100 * time.Millisecond; ; pause *= 2 {
+			code, err := cl.send(node, w.req)
+			if err == nil && code < fasthttp.StatusInternalServerError {
+				if code != fasthttp.StatusOK {
+					log.Printf("cluster: %s refused by %s: %d, shards diverged", w.req.URI().Path(), cl.nodes[node].Addr, code)
+				}
+				break
+			}
+			log.Printf("cluster: %s not applied on %s, retrying: %d %v", w.req.URI().Path(), cl.nodes[node].Addr, code, err)
+
+			if pause > clusterRetryMax {
+				pause = clusterRetryMax
+			}
+			select {
+			case <-time.After(pause):
+			case <-cl.stop:
+				return
+			}
+		}
+		close(w.done)
+		fasthttp.ReleaseRequest(w.req)
+	}
+}
+
+// send signs copy of req now and sends it to node
+func (cl *Cluster) send(node int, req *fasthttp.Request) (int, error) {
+	r := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(r)
+	defer fasthttp.ReleaseResponse(resp)
+	req.CopyTo(r)
+	cl.sign(r)
+	if err := cl.nodes[node].DoTimeout(r, resp, clusterTimeout); err != nil {
+		return 0, err
+	}
+
+	return resp.StatusCode(), nil
+}
+
+// Close stops delivering location writes, ones not delivered by then are
+// logged, peers miss them
+func (cl *Cluster) Close() error {
+	if cl == nil {
+		return nil
+	}
+
+	close(cl.stop)
+	cl.wg.Wait()
+	for node, q := range cl.queues {
+		if n := len(q); n > 0 {
+			log.Printf("cluster: %d location writes not delivered to %s", n, cl.nodes[node].Addr)
+		}
+	}
+
+	return nil
+}
+
+// Unsupported answers requests needing data of every shard that cluster
+// cannot merge
+func (cl *Cluster) Unsupported(c *fasthttp.RequestCtx) {
+	ErrorResponse(c, fasthttp.StatusNotImplemented, c.IsPost())
+}
+
+// LocationAvg merges sums of location visit marks of all shards. Merged
+// average changes with writes to any shard, so it is not cached
+func (cl *Cluster) LocationAvg(d *Database) fasthttp.RequestHandler {
+	return func(c *fasthttp.RequestCtx) {
+		id, err := strconv.ParseUint(c.UserValue("id").(string), 10, 32)
+		if err != nil {
+			ErrorResponse(c, fasthttp.StatusNotFound, false)
+			return
+		}
+		sum, count, err := d.LocationSum(uint32(id), c.QueryArgs())
+		if err != nil {
+			ErrorResponse(c, errorStatus(err), false)
+			return
+		}
+
+		sums := make([]MarkSum, len(cl.nodes))
+		errs := make([]error, len(cl.nodes))
+		uri := "/locations/" + strconv.FormatUint(id, 10) + "/sum?" + c.QueryArgs().String()
+		var wg sync.WaitGroup
+		for node := range cl.nodes {
+			if node == cl.self {
+				continue
+			}
+			wg.Add(1)
+			go func(node int) {
+				defer wg.Done()
+				sums[node], errs[node] = cl.sum(node, uri)
+			}(node)
+		}
+		wg.Wait()
+
+		for node := range cl.nodes {
+			if errs[node] != nil {
+				log.Printf("cluster: shard %s: %s", cl.nodes[node].Addr, errs[node])
+				ErrorResponse(c, fasthttp.StatusBadGateway, false)
+				return
+			}
+			sum += sums[node].Sum
+			count += sums[node].Count
+		}
+
+		A := Avg{AvgMark(sum, count)}
+		response, _ := A.MarshalJSON()
+		OkResponse(c, response, false)
+	}
+}
+
+// sum asks node for its sum
+func (cl *Cluster) sum(node int, uri string) (MarkSum, error) {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+	req.SetRequestURI(uri)
+	req.SetHost(cl.nodes[node].Addr)
+	cl.sign(req)
+
+	var s MarkSum
+	if err := cl.nodes[node].Do(req, resp); err != nil {
+		return s, err
+	}
+	if resp.StatusCode() != fasthttp.StatusOK {
+		return s, fmt.Errorf("sum status %d", resp.StatusCode())
+	}
+
+	return s, s.UnmarshalJSON(resp.Body())
+}
+
+// SumHandler answers shards with local sum of location visit marks
+func (cl *Cluster) SumHandler(d *Database) fasthttp.RequestHandler {
+	return func(c *fasthttp.RequestCtx) {
+		if !cl.internal(c) {
+			ErrorResponse(c, fasthttp.StatusNotFound, false)
+			return
+		}
+		id, err := strconv.ParseUint(c.UserValue("id").(string), 10, 32)
+		if err != nil {
+			ErrorResponse(c, fasthttp.StatusNotFound, false)
+			return
+		}
+
+		sum, count, err := d.LocationSum(uint32(id), c.QueryArgs())
+		if err != nil {
+			ErrorResponse(c, errorStatus(err), false)
+			return
+		}
+		response, _ := MarkSum{sum, count}.MarshalJSON()
+		OkResponse(c, response, false)
+	}
+}
@@ -0,0 +1,92 @@
+// Code generated by easyjson for marshaling/unmarshaling. DO NOT EDIT.
+
+package main
+
+import (
+	json "encoding/json"
+	easyjson "github.com/mailru/easyjson"
+	jlexer "github.com/mailru/easyjson/jlexer"
+	jwriter "github.com/mailru/easyjson/jwriter"
+)
+
+// suppress unused package warning
+var (
+	_ *json.RawMessage
+	_ *jlexer.Lexer
+	_ *jwriter.Writer
+	_ easyjson.Marshaler
+)
+
+func easyjsonEc0cdf38DecodeBitbucketOrgPdedkovHlcup(in *jlexer.Lexer, out *MarkSum) {
+	isTopLevel := in.IsStart()
+	if in.IsNull() {
+		if isTopLevel {
+			in.Consumed()
+		}
+		in.Skip()
+		return
+	}
+	in.Delim('{')
+	for !in.IsDelim('}') {
+		key := in.UnsafeFieldName(false)
+		in.WantColon()
+		if in.IsNull() {
+			in.Skip()
+			in.WantComma()
+			continue
+		}
+		switch key {
+		case "sum":
+			out.Sum = int(in.Int())
+		case "count":
+			out.Count = int(in.Int())
+		default:
+			in.SkipRecursive()
+		}
+		in.WantComma()
+	}
+	in.Delim('}')
+	if isTopLevel {
+		in.Consumed()
+	}
+}
+func easyjsonEc0cdf38EncodeBitbucketOrgPdedkovHlcup(out *jwriter.Writer, in MarkSum) {
+	out.RawByte('{')
+	first := true
+	_ = first
+	{
+		const prefix string = ",\"sum\":"
+		out.RawString(prefix[1:])
+		out.Int(int(in.Sum))
+	}
+	{
+		const prefix string = ",\"count\":"
+		out.RawString(prefix)
+		out.Int(int(in.Count))
+	}
+	out.RawByte('}')
+}
+
+// MarshalJSON supports json.Marshaler interface
+func (v MarkSum) MarshalJSON() ([]byte, error) {
+	w := jwriter.Writer{}
+	easyjsonEc0cdf38EncodeBitbucketOrgPdedkovHlcup(&w, v)
+	return w.Buffer.BuildBytes(), w.Error
+}
+
+// MarshalEasyJSON supports easyjson.Marshaler interface
+func (v MarkSum) MarshalEasyJSON(w *jwriter.Writer) {
+	easyjsonEc0cdf38EncodeBitbucketOrgPdedkovHlcup(w, v)
+}
+
+// UnmarshalJSON supports json.Unmarshaler interface
+func (v *MarkSum) UnmarshalJSON(data []byte) error {
+	r := jlexer.Lexer{Data: data}
+	easyjsonEc0cdf38DecodeBitbucketOrgPdedkovHlcup(&r, v)
+	return r.Error()
+}
+
+// UnmarshalEasyJSON supports easyjson.Unmarshaler interface
+func (v *MarkSum) UnmarshalEasyJSON(l *jlexer.Lexer) {
+	easyjsonEc0cdf38DecodeBitbucketOrgPdedkovHlcup(l, v)
+}
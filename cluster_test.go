@@ -0,0 +1,342 @@
+package main
+
+import (
+	"crypto/sha256"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const testClusterSecret = "s3cret"
+
+// clusterNode serves API subset of router over its shard of database
+func clusterNode(cl *Cluster, d *Database) fasthttp.RequestHandler {
+	upsert := func(f func(id string, body []byte) error) fasthttp.RequestHandler {
+		return func(c *fasthttp.RequestCtx) {
+			if err := f(c.UserValue("id").(string), c.PostBody()); err != nil {
+				ErrorResponse(c, errorStatus(err), true)
+				return
+			}
+			OkResponse(c, []byte(`{}`), true)
+		}
+	}
+	get := func(json func(id uint32) ([]byte, bool)) fasthttp.RequestHandler {
+		return func(c *fasthttp.RequestCtx) {
+			id, _ := strconv.Atoi(c.UserValue("id").(string))
+			body, ok := json(uint32(id))
+			if !ok {
+				ErrorResponse(c, fasthttp.StatusNotFound, false)
+				return
+			}
+			OkResponse(c, body, false)
+		}
+	}
+	routes := map[string]fasthttp.RequestHandler{
+		"GET users":      cl.ByUser(get(d.Users.JSON)),
+		"GET visits":     cl.Any(get(d.Visits.JSON)),
+		"POST users":     cl.ByUser(upsert(d.UpsertUser)),
+		"POST locations": cl.Broadcast(upsert(d.UpsertLocation)),
+		"POST visits":    cl.VisitWrite(d, upsert(d.UpsertVisit)),
+		"GET avg":        cl.LocationAvg(d),
+		"GET sum":        cl.SumHandler(d),
+	}
+
+	return func(c *fasthttp.RequestCtx) {
+		// /<kind>/<id>[/avg|/sum]
+		parts := strings.Split(strings.Trim(string(c.Path()), "/"), "/")
+		c.SetUserValue("id", parts[1])
+		route := string(c.Method()) + " " + parts[len(parts)-1]
+		if len(parts) == 2 {
+			route = string(c.Method()) + " " + parts[0]
+		}
+		routes[route](c)
+	}
+}
+
+// startCluster runs nodes on local ports, extra addresses join the cluster
+// without being served
+func startCluster(t *testing.T, nodes int, extra ...string) ([]*Database, []string) {
+	var lns []net.Listener
+	var addrs []string
+	for i := 0; i < nodes; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ln.Close() })
+		lns = append(lns, ln)
+		addrs = append(addrs, ln.Addr().String())
+	}
+
+	var dbs []*Database
+	for i, ln := range lns {
+		cl, err := NewCluster(append(append([]string(nil), addrs...), extra...), i, testClusterSecret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { cl.Close() })
+		d := newTestDatabase(t, StorageMap)
+		dbs = append(dbs, &d)
+		go fasthttp.Serve(ln, clusterNode(cl, &d))
+	}
+
+	return dbs, addrs
+}
+
+func clusterDo(t *testing.T, method, addr, path, body string) (int, string) {
+	req, resp := fasthttp.AcquireRequest(), fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+	req.Header.SetMethod(method)
+	req.SetRequestURI("http://" + addr + path)
+	req.SetBodyString(body)
+	if err := fasthttp.Do(req, resp); err != nil {
+		t.Fatal(err)
+	}
+
+	return resp.StatusCode(), string(resp.Body())
+}
+
+func TestCluster(t *testing.T) {
+	dbs, addrs := startCluster(t, 3)
+	cl, _ := NewCluster(addrs, 0, testClusterSecret)
+	defer cl.Close()
+
+	// every write goes through the first node, locations are applied by
+	// their owner, which may be another node
+	for id := 1; id <= 3; id++ {
+		if code, _ := clusterDo(t, "POST", addrs[0], "/locations/new", `{"id":`+strconv.Itoa(id)+`,"place":"Музей","country":"Россия","city":"Москва","distance":10}`); code != 200 {
+			t.Fatalf("location %d: %d", id, code)
+		}
+	}
+	sum := 0
+	for id := 1; id <= 12; id++ {
+		u := strconv.Itoa(id)
+		if code, body := clusterDo(t, "POST", addrs[0], "/users/new", `{"id":`+u+`,"email":"`+u+`@example.com","first_name":"A","last_name":"B","gender":"m","birth_date":0}`); code != 200 {
+			t.Fatalf("user %d: %d %s", id, code, body)
+		}
+		if code, body := clusterDo(t, "POST", addrs[0], "/visits/new", `{"id":`+u+`,"user":`+u+`,"location":1,"visited_at":1000000000,"mark":`+strconv.Itoa(id%6)+`}`); code != 200 {
+			t.Fatalf("visit %d: %d %s", id, code, body)
+		}
+		sum += id % 6
+	}
+
+	for node, d := range dbs {
+		for id := uint32(1); id <= 3; id++ {
+			if _, ok := d.Locations.Get(id); !ok {
+				t.Errorf("location %d not broadcast to node %d", id, node)
+			}
+		}
+		for id := uint32(1); id <= 12; id++ {
+			_, hasUser := d.Users.Get(id)
+			_, hasVisit := d.Visits.Get(id)
+			if owns := cl.Shard(id) == node; hasUser != owns || hasVisit != owns {
+				t.Errorf("node %d: user %d %v, visit %v, owner %d", node, id, hasUser, hasVisit, cl.Shard(id))
+			}
+		}
+	}
+
+	tests := []struct {
+		method, addr, path, body string
+		code                     int
+		want                     string
+	}{
+		{"GET", addrs[2], "/users/7", "", 200, `"email":"7@example.com"`},
+		{"GET", addrs[1], "/users/99", "", 404, ""},
+		{"POST", addrs[2], "/users/5", `{"first_name":"C"}`, 200, ""},
+		{"GET", addrs[0], "/users/5", "", 200, `"first_name":"C"`},
+		// visit moves to shard of its new user
+		{"POST", addrs[0], "/visits/1", `{"user":` + strconv.Itoa(movedUser(cl, 1)) + `,"visited_at":1000000001}`, 200, ""},
+		{"GET", addrs[0], "/visits/1", "", 200, `"user":` + strconv.Itoa(movedUser(cl, 1)) + `,"location":1,"visited_at":1000000001,"mark":1`},
+		{"POST", addrs[1], "/visits/2", `{"id":3,"user":` + strconv.Itoa(movedUser(cl, 2)) + `}`, 400, ""},
+		{"GET", addrs[1], "/locations/1/avg", "", 200, `{"avg":` + strconv.FormatFloat(AvgMark(sum, 12), 'f', -1, 64) + `}`},
+		// sums answer other nodes only
+		{"GET", addrs[1], "/locations/1/sum", "", 404, ""},
+	}
+	for _, tt := range tests {
+		code, body := clusterDo(t, tt.method, tt.addr, tt.path, tt.body)
+		if code != tt.code || !strings.Contains(body, tt.want) {
+			t.Errorf("%s %s: %d %s, want %d %s", tt.method, tt.path, code, body, tt.code, tt.want)
+		}
+	}
+	for node, d := range dbs {
+		if _, ok := d.Visits.Get(1); ok != (node == cl.Shard(uint32(movedUser(cl, 1)))) {
+			t.Errorf("moved visit on node %d: %v", node, ok)
+		}
+		if _, ok := d.Visits.Get(2); ok != (node == cl.Shard(2)) {
+			t.Errorf("visit of refused move on node %d: %v", node, ok)
+		}
+	}
+}
+
+// movedUser returns user of shard other than the one of user
+func movedUser(cl *Cluster, user uint32) int {
+	for id := uint32(1); ; id++ {
+		if cl.Shard(id) != cl.Shard(user) {
+			return int(id)
+		}
+	}
+}
+
+func TestClusterBroadcastRepair(t *testing.T) {
+	// peer fails until it is up, then checks writes are signed
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	dbs, addrs := startCluster(t, 1, ln.Addr().String())
+	peer, _ := NewCluster(append(addrs, ln.Addr().String()), 1, testClusterSecret)
+	defer peer.Close()
+	var up, applied int32
+	go fasthttp.Serve(ln, func(c *fasthttp.RequestCtx) {
+		if atomic.LoadInt32(&up) == 0 {
+			ErrorResponse(c, fasthttp.StatusServiceUnavailable, true)
+			return
+		}
+		if peer.internal(c) && string(c.Path()) == "/locations/new" {
+			atomic.AddInt32(&applied, 1)
+		}
+		OkResponse(c, []byte(`{}`), true)
+	})
+
+	// location of other owner would be routed to the peer
+	id := 1
+	for peer.Shard(uint32(id)) != 0 {
+		id++
+	}
+	code, _ := clusterDo(t, "POST", addrs[0], "/locations/new", `{"id":`+strconv.Itoa(id)+`,"place":"Музей","country":"Россия","city":"Москва","distance":10}`)
+	if code != 200 {
+		t.Errorf("write with peer down: %d, want 200", code)
+	}
+	if _, ok := dbs[0].Locations.Get(uint32(id)); !ok {
+		t.Error("location not applied by owner")
+	}
+
+	atomic.StoreInt32(&up, 1)
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt32(&applied) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("write not delivered to peer once it is up")
+		}
+	}
+}
+
+func TestClusterInternal(t *testing.T) {
+	cl, err := NewCluster([]string{"127.0.0.1:8080", "10.0.0.2:8080"}, 0, testClusterSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	peer, _ := NewCluster([]string{"127.0.0.1:8080", "10.0.0.2:8080"}, 1, testClusterSecret)
+	defer peer.Close()
+	guess, _ := NewCluster([]string{"127.0.0.1:8080", "10.0.0.2:8080"}, 1, "guess")
+	defer guess.Close()
+
+	tests := []struct {
+		name string
+		sign func(req *fasthttp.Request)
+		want bool
+	}{
+		{"signed by peer", peer.sign, true},
+		{"unsigned", func(req *fasthttp.Request) {}, false},
+		// clients cannot skip routing
+		{"header only", func(req *fasthttp.Request) { req.Header.Set(clusterHeader, "1") }, false},
+		{"other secret", guess.sign, false},
+		{"own shard", cl.sign, false},
+		{"stale", func(req *fasthttp.Request) {
+			peer.sign(req)
+			req.Header.Set(clusterDateHeader, strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10))
+		}, false},
+		{"body changed", func(req *fasthttp.Request) {
+			peer.sign(req)
+			req.SetBodyString(`{"id":2}`)
+		}, false},
+		{"principal changed", func(req *fasthttp.Request) {
+			peer.sign(req)
+			req.Header.Set(clusterPrincipalHeader, "apikey:admin")
+		}, false},
+	}
+	for _, tt := range tests {
+		var req fasthttp.Request
+		req.Header.SetMethod("POST")
+		req.SetRequestURI("/users/new")
+		req.SetBodyString(`{"id":1}`)
+		tt.sign(&req)
+		var c fasthttp.RequestCtx
+		c.Init(&req, &net.TCPAddr{IP: net.ParseIP("10.0.0.2")}, nil)
+		if got := cl.internal(&c); got != tt.want {
+			t.Errorf("%s: internal = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := NewCluster([]string{"no-port"}, 0, testClusterSecret); err == nil {
+		t.Error("address without port accepted")
+	}
+	if _, err := NewCluster([]string{"127.0.0.1:8080"}, 0, ""); err == nil {
+		t.Error("cluster without secret accepted")
+	}
+}
+
+func TestClusterAuth(t *testing.T) {
+	addrs := []string{"127.0.0.1:8080", "10.0.0.2:8080"}
+	cl, _ := NewCluster(addrs, 0, testClusterSecret)
+	defer cl.Close()
+	peer, _ := NewCluster(addrs, 1, testClusterSecret)
+	defer peer.Close()
+	guard := func(cl *Cluster, h fasthttp.RequestHandler) fasthttp.RequestHandler {
+		a := &Auth{schemes: []Authenticator{APIKeys{sha256.Sum256([]byte("k1")): {"apikey:svc", AccessWrite}}}}
+		a.Trust(cl)
+		return a.Guard("POST", "/users/:id", AccessWrite, h)
+	}
+	serve := func(h fasthttp.RequestHandler, req *fasthttp.Request) *fasthttp.RequestCtx {
+		var c fasthttp.RequestCtx
+		c.Init(req, &net.TCPAddr{IP: net.ParseIP("10.0.0.2")}, nil)
+		h(&c)
+		return &c
+	}
+
+	// peer passes on principal it authenticated instead of client key
+	var forwarded *fasthttp.Request
+	var req fasthttp.Request
+	req.Header.SetMethod("POST")
+	req.SetRequestURI("/users/new")
+	req.Header.Set("X-Api-Key", "k1")
+	req.SetBodyString(`{"id":1}`)
+	serve(guard(peer, func(c *fasthttp.RequestCtx) {
+		forwarded = peer.request(c)
+		peer.sign(forwarded)
+	}), &req)
+	if forwarded == nil {
+		t.Fatal("client key refused")
+	}
+	defer fasthttp.ReleaseRequest(forwarded)
+	if v := forwarded.Header.Peek("X-Api-Key"); len(v) > 0 {
+		t.Errorf("client key %s passed on", v)
+	}
+
+	var principal interface{}
+	h := guard(cl, func(c *fasthttp.RequestCtx) {
+		principal = c.UserValue(principalKey)
+	})
+	serve(h, forwarded)
+	if principal != "apikey:svc" {
+		t.Errorf("principal %v, want apikey:svc", principal)
+	}
+
+	// principal header of client is not believed
+	principal = nil
+	req.Header.Del("X-Api-Key")
+	req.Header.Set(clusterPrincipalHeader, "apikey:svc")
+	c := serve(h, &req)
+	if principal != nil || c.Response.StatusCode() != fasthttp.StatusUnauthorized {
+		t.Errorf("unsigned principal: %d, %v", c.Response.StatusCode(), principal)
+	}
+	if got := string(c.Response.Header.Peek("WWW-Authenticate")); got != "ApiKey" {
+		t.Errorf("challenge %q, want ApiKey", got)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/valyala/fasthttp"
+)
+
+// kinds of pre-serialized entities with reusable compressed bytes
+const (
+	EntityUser = iota
+	EntityLocation
+	EntityVisit
+)
+
+// compressed body of entity together with bytes it was made from
+type compressedEntity struct {
+	src []byte
+	out []byte
+}
+
+type compressedKey struct {
+	kind int
+	id   uint32
+	enc  int
+}
+
+// Compressor negotiates Content-Encoding and compresses response bodies
+type Compressor struct {
+	// supported encodings in server preference order
+	encodings []string
+	min       int
+	level     int
+
+	mu       sync.RWMutex
+	entities map[compressedKey]compressedEntity
+	limit    int
+}
+
+// NewCompressor takes comma separated encodings out of br, gzip and deflate,
+// bodies shorter than min are sent as is. limit bounds number of kept
+// compressed entities, 0 compresses them on every request
+func NewCompressor(encodings string, min int, level int, limit int) (*Compressor, error) {
+	z := &Compressor{
+		min:      min,
+		level:    level,
+		entities: make(map[compressedKey]compressedEntity),
+		limit:    limit,
+	}
+	for _, enc := range strings.Split(encodings, ",") {
+		enc = strings.TrimSpace(enc)
+		switch enc {
+		case "br", "gzip", "deflate":
+			z.encodings = append(z.encodings, enc)
+		default:
+			return nil, fmt.Errorf("unknown encoding %q", enc)
+		}
+	}
+	if level < 1 || level > 9 {
+		return nil, fmt.Errorf("compression level %d out of 1..9", level)
+	}
+
+	return z, nil
+}
+
+// parseAcceptHeader returns weights of values listed in Accept or
+// Accept-Encoding header
+func parseAcceptHeader(header []byte) map[string]float64 {
+	weights := make(map[string]float64)
+	for _, part := range strings.Split(string(header), ",") {
+		params := strings.Split(part, ";")
+		name, q := strings.ToLower(strings.TrimSpace(params[0])), 1.0
+		for _, param := range params[1:] {
+			if param = strings.TrimSpace(param); strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if name != "" {
+			weights[name] = q
+		}
+	}
+
+	return weights
+}
+
+// addVary appends field to Vary header of response
+func addVary(c *fasthttp.RequestCtx, field string) {
+	vary := string(c.Response.Header.Peek("Vary"))
+	switch {
+	case vary == "":
+		c.Response.Header.Set("Vary", field)
+	case !strings.Contains(vary, field):
+		c.Response.Header.Set("Vary", vary+", "+field)
+	}
+}
+
+// negotiate returns index of encoding to use for request or -1 for identity
+func (z *Compressor) negotiate(c *fasthttp.RequestCtx) int {
+	header := c.Request.Header.Peek("Accept-Encoding")
+	if len(header) == 0 {
+		return -1
+	}
+	weights := parseAcceptHeader(header)
+
+	best, bestQ := -1, 0.0
+	for i, enc := range z.encodings {
+		q, ok := weights[enc]
+		if !ok {
+			q = weights["*"]
+		}
+		if q > bestQ {
+			best, bestQ = i, q
+		}
+	}
+
+	return best
+}
+
+func (z *Compressor) compress(enc int, body []byte) []byte {
+	switch z.encodings[enc] {
+	case "br":
+		return fasthttp.AppendBrotliBytesLevel(nil, body, z.level)
+	case "gzip":
+		return fasthttp.AppendGzipBytesLevel(nil, body, z.level)
+	default:
+		return fasthttp.AppendDeflateBytesLevel(nil, body, z.level)
+	}
+}
+
+// Wrap compresses bodies of successful responses produced by h, responses
+// already carrying Content-Encoding are left alone
+func (z *Compressor) Wrap(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	if z == nil {
+		return h
+	}
+
+	return func(c *fasthttp.RequestCtx) {
+		h(c)
+		if c.Response.IsBodyStream() {
+			return
+		}
+
+		body := c.Response.Body()
+		if c.Response.StatusCode() != fasthttp.StatusOK || len(body) < z.min || len(c.Response.Header.Peek("Content-Encoding")) > 0 {
+			return
+		}
+		addVary(c, "Accept-Encoding")
+		enc := z.negotiate(c)
+		if enc < 0 {
+			return
+		}
+
+		c.Response.SetBody(z.compress(enc, body))
+		c.Response.Header.Set("Content-Encoding", z.encodings[enc])
+	}
+}
+
+// Entity responds with marshalled entity of kind, compressed bytes are
+// reused until database replaces marshalled entity. Entities served in
+// other formats than JSON are left to Wrap
+func (z *Compressor) Entity(c *fasthttp.RequestCtx, kind int, id uint32, body []byte) {
+	if z == nil || len(body) < z.min || c.UserValue(formatKey) != nil {
+		OkResponse(c, body, false)
+		return
+	}
+	addVary(c, "Accept-Encoding")
+	enc := z.negotiate(c)
+	if enc < 0 {
+		OkResponse(c, body, false)
+		return
+	}
+
+	k := compressedKey{kind, id, enc}
+	z.mu.RLock()
+	e, ok := z.entities[k]
+	z.mu.RUnlock()
+	if !ok || !sameBytes(e.src, body) {
+		e = compressedEntity{body, z.compress(enc, body)}
+		if z.limit > 0 {
+			z.mu.Lock()
+			// evict arbitrary entities when full
+			for old := range z.entities {
+				if len(z.entities) < z.limit {
+					break
+				}
+				delete(z.entities, old)
+			}
+			z.entities[k] = e
+			z.mu.Unlock()
+		}
+	}
+
+	c.Response.Header.Set("Content-Encoding", z.encodings[enc])
+	OkResponse(c, e.out, false)
+}
+
+// sameBytes tells whether a and b are the same slice, database marshals
+// entity into new slice on every write
+func sameBytes(a []byte, b []byte) bool {
+	return len(a) == len(b) && (len(a) == 0 || &a[0] == &b[0])
+}
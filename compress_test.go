@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestCompressorNegotiate(t *testing.T) {
+	z, err := NewCompressor("br,gzip,deflate", 10, 6, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"gzip, br", "br"},
+		{"gzip;q=1, br;q=0.5", "gzip"},
+		{"br;q=0, deflate", "deflate"},
+		{"*", "br"},
+		{"*;q=0.1, gzip;q=0", "br"},
+		{"identity", ""},
+	}
+	for _, tt := range tests {
+		var c fasthttp.RequestCtx
+		c.Request.Header.Set("Accept-Encoding", tt.accept)
+		got := ""
+		if enc := z.negotiate(&c); enc >= 0 {
+			got = z.encodings[enc]
+		}
+		if got != tt.want {
+			t.Errorf("negotiate(%q) = %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+
+	for _, bad := range []struct {
+		encodings string
+		level     int
+	}{{"zstd", 6}, {"gzip", 0}, {"gzip", 10}} {
+		if _, err := NewCompressor(bad.encodings, 10, bad.level, 0); err == nil {
+			t.Errorf("NewCompressor(%q, level %d) accepted", bad.encodings, bad.level)
+		}
+	}
+}
+
+func decompress(t *testing.T, enc string, body []byte) []byte {
+	var out []byte
+	var err error
+	switch enc {
+	case "br":
+		out, err = fasthttp.AppendUnbrotliBytes(nil, body)
+	case "gzip":
+		out, err = fasthttp.AppendGunzipBytes(nil, body)
+	case "deflate":
+		out, err = fasthttp.AppendInflateBytes(nil, body)
+	default:
+		out = body
+	}
+	if err != nil {
+		t.Fatalf("%s: %s", enc, err)
+	}
+	return out
+}
+
+func TestCompressorWrap(t *testing.T) {
+	z, err := NewCompressor("br,gzip,deflate", 64, 6, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	long := `{"visits":[` + strings.Repeat(`{"mark":5,"visited_at":1000000000,"place":"Музей"},`, 20) + `{}]}`
+
+	tests := []struct {
+		accept string
+		body   string
+		code   int
+		enc    string
+	}{
+		{"gzip", long, 200, "gzip"},
+		{"br", long, 200, "br"},
+		{"deflate", long, 200, "deflate"},
+		{"", long, 200, ""},
+		// short bodies and errors are sent as is
+		{"gzip", `{}`, 200, ""},
+		{"gzip", long, 404, ""},
+	}
+	for _, tt := range tests {
+		h := z.Wrap(func(c *fasthttp.RequestCtx) {
+			c.SetStatusCode(tt.code)
+			c.SetBodyString(tt.body)
+		})
+		var c fasthttp.RequestCtx
+		c.Request.Header.Set("Accept-Encoding", tt.accept)
+		h(&c)
+
+		if enc := string(c.Response.Header.Peek("Content-Encoding")); enc != tt.enc {
+			t.Errorf("%q, %d bytes, status %d: encoding %q, want %q", tt.accept, len(tt.body), tt.code, enc, tt.enc)
+			continue
+		}
+		if body := decompress(t, tt.enc, c.Response.Body()); string(body) != tt.body {
+			t.Errorf("%q: body %q", tt.accept, body)
+		}
+	}
+}
+
+func TestCompressorEntity(t *testing.T) {
+	z, err := NewCompressor("gzip", 8, 6, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := []byte(`{"id":1,"first_name":"Иван","last_name":"Петров"}`)
+
+	serve := func(body []byte) []byte {
+		var c fasthttp.RequestCtx
+		c.Request.Header.Set("Accept-Encoding", "gzip")
+		z.Entity(&c, EntityUser, 1, body)
+		if got := decompress(t, "gzip", c.Response.Body()); !bytes.Equal(got, body) {
+			t.Errorf("Entity body %q, want %q", got, body)
+		}
+		return append([]byte(nil), c.Response.Body()...)
+	}
+
+	first := serve(body)
+	if k := (compressedKey{EntityUser, 1, 0}); !sameBytes(z.entities[k].src, body) {
+		t.Error("compressed entity not kept")
+	}
+	if again := serve(body); !bytes.Equal(first, again) {
+		t.Error("kept bytes not reused")
+	}
+	// entity marshalled again replaces kept bytes
+	updated := []byte(`{"id":1,"first_name":"Анна","last_name":"Петрова"}`)
+	serve(updated)
+	if k := (compressedKey{EntityUser, 1, 0}); !sameBytes(z.entities[k].src, updated) {
+		t.Error("compressed entity not replaced")
+	}
+}
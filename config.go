@@ -0,0 +1,149 @@
+package main
+
+import (
+	"flag"
+	"time"
+)
+
+// Config holds runtime settings, filled from command line flags
+type Config struct {
+	// api listen address
+	Listen string
+	// SO_REUSEPORT on api socket
+	ReusePort bool
+	// max number of concurrent connections, 0 is fasthttp default
+	Concurrency int
+	// timeouts of reading request and writing response
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// how long keep-alive connection may wait for the next request
+	IdleTimeout time.Duration
+	// max size of POST body
+	MaxBodySize int
+	// keep connections alive between requests
+	KeepAlive bool
+	// close connection after POST, clients of the cup reopen them anyway
+	CloseOnWrite bool
+	// reject user writes reusing another user's email with 409, in cluster
+	// mode only users of the same shard are checked
+	UniqueEmail bool
+	// reference time of age filters: frozen or wall
+	Clock string
+	// frozen time override, options.txt is used when zero
+	Now int64
+	// listen address of admin server with /metrics, empty disables it
+	AdminAddr string
+	// share of requests written to access log, 0 disables it
+	AccessLogRate float64
+	// access log records queued before dropping
+	AccessLogBuffer int
+	// time given to in-flight requests on shutdown
+	ShutdownTimeout time.Duration
+	// directory of final snapshot written on shutdown and loaded at startup,
+	// empty disables it
+	SnapshotDir string
+	// max number of cached GET responses, 0 disables cache
+	CacheSize int
+	// record storage layout: dense (slices indexed by id) or map
+	Storage string
+	// response encodings in preference order, empty disables compression
+	Compress string
+	// smallest response body worth compressing, bytes
+	CompressMin int
+	// compression level, 1 (fastest) - 9 (best)
+	CompressLevel int
+	// gRPC API address, empty disables it
+	GRPCAddr string
+	// max estimated cost of GraphQL query
+	GraphQLMaxCost int
+	// changes kept for change feed, 0 disables it
+	ChangesBuffer int
+	// webhook delivery retries and backoff before the first one
+	WebhookRetries int
+	WebhookBackoff time.Duration
+	// JSON log of undelivered webhooks, empty writes to stderr
+	WebhookDeadLetter string
+	// replication role: standalone, leader or follower
+	Role string
+	// leader replication listen address
+	ReplicationAddr string
+	// secret followers sign hello with, empty leaves replication open
+	ReplicationSecret string
+	// follower: leader replication and API addresses
+	Leader    string
+	LeaderAPI string
+	// API addresses of cluster nodes and index of this one, empty list
+	// disables sharding
+	Shards string
+	Shard  int
+	// secret nodes sign requests to each other with
+	ClusterSecret string
+	// how long entity versions are kept, 0 disables history
+	HistoryRetention time.Duration
+	// audit entries kept for admin queries, 0 disables audit trail
+	AuditBuffer int
+	// JSON lines file every audit entry is appended to, empty disables it
+	AuditLog string
+	// addresses of followers and proxies whose X-Forwarded-For names
+	// client in audit, cluster nodes are trusted too
+	TrustedProxies string
+	// key files of authentication schemes, none given leaves routes open
+	AuthAPIKeys  string
+	AuthHMACKeys string
+	AuthJWTKey   string
+	// access of requests without credentials
+	AuthAnonymous string
+	// access required by routes instead of defaults: read for GET, write
+	// for entity POST and admin for admin server
+	AuthRoutes string
+}
+
+var config Config
+
+func init() {
+	flag.StringVar(&config.Listen, "listen", port, "api listen address")
+	flag.BoolVar(&config.ReusePort, "reuseport", false, "listen api socket with SO_REUSEPORT")
+	flag.IntVar(&config.Concurrency, "concurrency", 0, "max concurrent connections (0 - fasthttp default)")
+	flag.DurationVar(&config.ReadTimeout, "read-timeout", 10*time.Second, "request read timeout")
+	flag.DurationVar(&config.WriteTimeout, "write-timeout", 10*time.Second, "response write timeout")
+	flag.DurationVar(&config.IdleTimeout, "idle-timeout", time.Minute, "keep-alive idle timeout")
+	flag.IntVar(&config.MaxBodySize, "max-body-size", 1<<20, "max request body size, bytes")
+	flag.BoolVar(&config.KeepAlive, "keepalive", true, "keep connections alive between requests")
+	flag.BoolVar(&config.CloseOnWrite, "close-on-write", true, "close connection after POST requests")
+	flag.BoolVar(&config.UniqueEmail, "unique-email", true, "reject users with duplicate email (409 Conflict), checked per shard in cluster mode")
+	flag.StringVar(&config.Clock, "clock", ClockFrozen, "age reference time: frozen (options.txt) or wall")
+	flag.Int64Var(&config.Now, "now", 0, "frozen reference timestamp, overrides options.txt")
+	flag.StringVar(&config.AdminAddr, "admin", "", "admin server address (metrics, status), e.g. :8081, disabled by default")
+	flag.Float64Var(&config.AccessLogRate, "access-log", 0, "share of requests to write to JSON access log (0..1), 5xx are always logged when enabled")
+	flag.IntVar(&config.AccessLogBuffer, "access-log-buffer", 4096, "access log records queued before dropping")
+	flag.DurationVar(&config.ShutdownTimeout, "shutdown-timeout", 10*time.Second, "time to drain in-flight requests on SIGTERM")
+	flag.StringVar(&config.SnapshotDir, "snapshot", "", "directory to write final snapshot to on shutdown and load it from at startup instead of data.zip")
+	flag.IntVar(&config.CacheSize, "cache-size", 0, "max cached GET responses, e.g. 100000, disabled by default")
+	flag.StringVar(&config.Storage, "storage", StorageDense, "record storage: dense (slices indexed by id) or map")
+	flag.StringVar(&config.Compress, "compress", "", "response encodings by preference, e.g. br,gzip,deflate, disabled by default")
+	flag.IntVar(&config.CompressMin, "compress-min", 1024, "min response body size to compress, bytes")
+	flag.IntVar(&config.CompressLevel, "compress-level", 6, "compression level 1..9")
+	flag.StringVar(&config.GRPCAddr, "grpc", "", "gRPC API address, empty to disable")
+	flag.IntVar(&config.GraphQLMaxCost, "graphql-max-cost", 5000, "max GraphQL query cost, fields under visits lists count limit times")
+	flag.IntVar(&config.ChangesBuffer, "changes-buffer", 0, "entity changes kept for /changes feed, webhooks and replication, e.g. 100000, disabled by default")
+	flag.IntVar(&config.WebhookRetries, "webhook-retries", 5, "webhook delivery retries before dead letter")
+	flag.DurationVar(&config.WebhookBackoff, "webhook-backoff", time.Second, "delay before first webhook retry, doubled on every next one")
+	flag.StringVar(&config.WebhookDeadLetter, "webhook-dead-letter", "", "file to append undelivered webhooks to as JSON lines, empty for stderr")
+	flag.StringVar(&config.Role, "role", RoleStandalone, "replication role: standalone, leader or follower")
+	flag.StringVar(&config.ReplicationAddr, "replication", ":8082", "leader address to stream changes to followers on")
+	flag.StringVar(&config.ReplicationSecret, "replication-secret", "", "shared secret of leader and followers, required by leader when authentication is on")
+	flag.StringVar(&config.Leader, "leader", "", "follower: leader replication address")
+	flag.StringVar(&config.LeaderAPI, "leader-api", "", "follower: leader API address to forward writes to")
+	flag.StringVar(&config.Shards, "shards", "", "comma separated API addresses of cluster nodes, users and visits are sharded by user id")
+	flag.IntVar(&config.Shard, "shard", 0, "index of this node in -shards")
+	flag.StringVar(&config.ClusterSecret, "cluster-secret", "", "shared secret of cluster nodes, required with -shards")
+	flag.DurationVar(&config.HistoryRetention, "history-retention", 0, "how long entity versions are kept for asOf queries, e.g. 168h (0 - disabled)")
+	flag.IntVar(&config.AuditBuffer, "audit-buffer", 0, "accepted writes kept for /admin/audit, e.g. 100000 (0 - disabled)")
+	flag.StringVar(&config.AuditLog, "audit-log", "", "file to append audit trail to as JSON lines, empty to keep it in memory only")
+	flag.StringVar(&config.TrustedProxies, "trusted-proxies", "", "comma separated addresses of followers and proxies whose X-Forwarded-For is taken for client address in audit")
+	flag.StringVar(&config.AuthAPIKeys, "auth-api-keys", "", "file of \"key name access\" lines for X-Api-Key authentication")
+	flag.StringVar(&config.AuthHMACKeys, "auth-hmac-keys", "", "file of \"id secret name access\" lines for HMAC-signed requests")
+	flag.StringVar(&config.AuthJWTKey, "auth-jwt-key", "", "PEM public key (RS256, ES256) or HS256 secret file for bearer JWT")
+	flag.StringVar(&config.AuthAnonymous, "auth-anonymous", "none", "access of requests without credentials: none, read, write or admin")
+	flag.StringVar(&config.AuthRoutes, "auth-routes", "", "comma separated route access overrides, e.g. \"GET /changes=admin,GET /metrics=none\"")
+}
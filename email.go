@@ -0,0 +1,107 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+// EmailIndex maps case-folded emails to ids of users owning them. Loaded
+// data may give one email to several users, each of them keeps it until
+// they change it, so email is not free while any of them holds it
+type EmailIndex struct {
+	mu  sync.RWMutex
+	ids map[string][]uint32
+}
+
+func NewEmailIndex() *EmailIndex {
+	return &EmailIndex{ids: make(map[string][]uint32)}
+}
+
+func emailKey(email string) string {
+	return strings.ToLower(email)
+}
+
+// Get returns id of user owning email, the first one of shared email
+func (e *EmailIndex) Get(email string) (uint32, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	owners := e.ids[emailKey(email)]
+	if len(owners) == 0 {
+		return 0, false
+	}
+
+	return owners[0], true
+}
+
+// Claim reserves email for user id unless another user owns it,
+// check and reservation happen under one lock
+func (e *EmailIndex) Claim(email string, id uint32) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	owners := e.ids[emailKey(email)]
+	for _, owner := range owners {
+		if owner != id {
+			return false
+		}
+	}
+	if len(owners) == 0 {
+		e.ids[emailKey(email)] = []uint32{id}
+	}
+
+	return true
+}
+
+// Set moves user id from old email to new one
+func (e *EmailIndex) Set(old string, email string, id uint32) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.remove(emailKey(old), id)
+	key := emailKey(email)
+	for _, owner := range e.ids[key] {
+		if owner == id {
+			return
+		}
+	}
+	e.ids[key] = append(e.ids[key], id)
+}
+
+func (e *EmailIndex) remove(key string, id uint32) {
+	owners := e.ids[key]
+	for i, owner := range owners {
+		if owner != id {
+			continue
+		}
+		if len(owners) == 1 {
+			delete(e.ids, key)
+			return
+		}
+		e.ids[key] = append(owners[:i:i], owners[i+1:]...)
+		return
+	}
+}
+
+// Shared returns emails owned by more than one user with their owners
+func (e *EmailIndex) Shared() map[string][]uint32 {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	shared := make(map[string][]uint32)
+	for key, owners := range e.ids {
+		if len(owners) > 1 {
+			shared[key] = append([]uint32(nil), owners...)
+		}
+	}
+
+	return shared
+}
+
+// Len returns number of indexed emails
+func (e *EmailIndex) Len() int {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return len(e.ids)
+}
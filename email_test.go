@@ -0,0 +1,80 @@
+package main
+
+import "testing"
+
+func TestEmailIndexClaim(t *testing.T) {
+	e := NewEmailIndex()
+	e.Set("", "a@example.com", 1)
+
+	tests := []struct {
+		email string
+		id    uint32
+		ok    bool
+	}{
+		{"a@example.com", 1, true},
+		{"A@Example.com", 1, true},
+		{"a@example.com", 2, false},
+		{"A@EXAMPLE.COM", 2, false},
+		{"b@example.com", 2, true},
+		{"b@example.com", 3, false},
+	}
+	for _, tt := range tests {
+		if ok := e.Claim(tt.email, tt.id); ok != tt.ok {
+			t.Errorf("Claim(%q, %d) = %v, want %v", tt.email, tt.id, ok, tt.ok)
+		}
+	}
+}
+
+func TestEmailIndexClaimConcurrent(t *testing.T) {
+	e := NewEmailIndex()
+	won := make(chan uint32, 16)
+	for id := uint32(1); id <= 16; id++ {
+		go func(id uint32) {
+			if e.Claim("x@example.com", id) {
+				won <- id
+			} else {
+				won <- 0
+			}
+		}(id)
+	}
+
+	winners := 0
+	for i := 0; i < 16; i++ {
+		if <-won != 0 {
+			winners++
+		}
+	}
+	if winners != 1 {
+		t.Errorf("%d claims won, want 1", winners)
+	}
+}
+
+func TestEmailIndexShared(t *testing.T) {
+	e := NewEmailIndex()
+	// loaded data gives one email to users 1 and 2
+	e.Set("", "a@example.com", 1)
+	e.Set("", "A@example.com", 2)
+	if shared := e.Shared(); len(shared["a@example.com"]) != 2 {
+		t.Fatalf("shared %v, want a@example.com of 1 and 2", shared)
+	}
+
+	// user 2 moves away, user 1 still holds email
+	e.Set("A@example.com", "b@example.com", 2)
+	if e.Claim("a@example.com", 3) {
+		t.Error("email of user 1 claimed by user 3")
+	}
+	if id, ok := e.Get("a@example.com"); !ok || id != 1 {
+		t.Errorf("Get = %d, %v, want 1", id, ok)
+	}
+	if !e.Claim("a@example.com", 1) {
+		t.Error("user 1 cannot keep own email")
+	}
+
+	e.Set("a@example.com", "c@example.com", 1)
+	if !e.Claim("a@example.com", 3) {
+		t.Error("released email not claimed")
+	}
+	if len(e.Shared()) != 0 || e.Len() != 3 {
+		t.Errorf("shared %v, %d emails, want none shared of 3", e.Shared(), e.Len())
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/ugorji/go/codec"
+	"github.com/valyala/fasthttp"
+)
+
+// response formats negotiated by Accept, JSON is preferred on ties
+const (
+	FormatJSON = iota
+	FormatMsgpack
+	FormatCBOR
+	FormatCSV
+	formatsCount
+)
+
+var formatTypes = [formatsCount][]string{
+	{"application/json"},
+	{"application/msgpack", "application/x-msgpack"},
+	{"application/cbor"},
+	{"text/csv"},
+}
+
+// user value holding negotiated format of non-JSON responses
+const formatKey = "format"
+
+// user value holding POST body as client sent it before transcoding
+const clientBodyKey = "clientBody"
+
+type clientBody struct {
+	body        []byte
+	contentType []byte
+}
+
+var (
+	msgpackHandle codec.MsgpackHandle
+	cborHandle    codec.CborHandle
+)
+
+func init() {
+	msgpackHandle.WriteExt = true
+	msgpackHandle.RawToString = true
+	msgpackHandle.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	cborHandle.MapType = reflect.TypeOf(map[string]interface{}(nil))
+}
+
+// jsonObject keeps object fields in order as key, value pairs,
+// codec encodes it as map
+type jsonObject []interface{}
+
+func (jsonObject) MapBySlice() {}
+
+// negotiateFormat picks response format out of Accept header
+func negotiateFormat(header []byte) int {
+	weights := parseAcceptHeader(header)
+
+	best, bestQ := FormatJSON, 0.0
+	for f, types := range formatTypes {
+		q, ok := 0.0, false
+		for _, t := range types {
+			if w, found := weights[t]; found && (!ok || w > q) {
+				q, ok = w, true
+			}
+		}
+		if !ok {
+			major := types[0][:strings.IndexByte(types[0], '/')]
+			if q, ok = weights[major+"/*"]; !ok {
+				q = weights["*/*"]
+			}
+		}
+		if q > bestQ {
+			best, bestQ = f, q
+		}
+	}
+
+	return best
+}
+
+// decodeJSON reads next value keeping order of object fields,
+// integral numbers become int64
+func decodeJSON(dec *json.Decoder) (interface{}, error) {
+	t, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch t := t.(type) {
+	case json.Delim:
+		if t == '{' {
+			obj := jsonObject{}
+			for dec.More() {
+				k, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				v, err := decodeJSON(dec)
+				if err != nil {
+					return nil, err
+				}
+				obj = append(obj, k, v)
+			}
+			_, err = dec.Token()
+			return obj, err
+		}
+
+		arr := []interface{}{}
+		for dec.More() {
+			v, err := decodeJSON(dec)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		_, err = dec.Token()
+		return arr, err
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i, nil
+		}
+		return t.Float64()
+	}
+
+	return t, nil
+}
+
+// encodeBody converts JSON response body into format
+func encodeBody(format int, body []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	v, err := decodeJSON(dec)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []byte
+	switch format {
+	case FormatMsgpack:
+		err = codec.NewEncoderBytes(&out, &msgpackHandle).Encode(v)
+	case FormatCBOR:
+		err = codec.NewEncoderBytes(&out, &cborHandle).Encode(v)
+	default:
+		out, err = encodeCSV(v)
+	}
+
+	return out, err
+}
+
+// encodeCSV writes list responses like {"visits":[...]} one row per element
+// under header of element fields, other objects become single row
+func encodeCSV(v interface{}) ([]byte, error) {
+	obj, ok := v.(jsonObject)
+	if !ok {
+		return nil, fmt.Errorf("csv: object expected")
+	}
+	rows := []interface{}{obj}
+	if len(obj) == 2 {
+		if list, ok := obj[1].([]interface{}); ok {
+			rows = list
+		}
+	}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	for i, r := range rows {
+		row, ok := r.(jsonObject)
+		if !ok {
+			return nil, fmt.Errorf("csv: row %d is not object", i)
+		}
+		if i == 0 {
+			header := make([]string, 0, len(row)/2)
+			for j := 0; j < len(row); j += 2 {
+				header = append(header, row[j].(string))
+			}
+			w.Write(header)
+		}
+
+		record := make([]string, 0, len(row)/2)
+		for j := 1; j < len(row); j += 2 {
+			record = append(record, csvCell(row[j]))
+		}
+		w.Write(record)
+	}
+	w.Flush()
+
+	return buf.Bytes(), w.Error()
+}
+
+func csvCell(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// ClientBody returns POST body as client sent it, signatures are made over
+// it rather than over transcoded one
+func ClientBody(c *fasthttp.RequestCtx) []byte {
+	if cb, ok := c.UserValue(clientBodyKey).(*clientBody); ok {
+		return cb.body
+	}
+
+	return c.PostBody()
+}
+
+// restoreBody puts body client sent into copy of request relayed to other
+// node, so that it checks signature and transcodes body itself
+func restoreBody(c *fasthttp.RequestCtx, req *fasthttp.Request) {
+	if cb, ok := c.UserValue(clientBodyKey).(*clientBody); ok {
+		req.SetBody(cb.body)
+		req.Header.SetContentTypeBytes(cb.contentType)
+	}
+}
+
+// decodeBody transcodes MessagePack and CBOR request bodies into JSON,
+// body client sent is kept for ClientBody
+func decodeBody(c *fasthttp.RequestCtx) error {
+	ct := c.Request.Header.ContentType()
+	if i := bytes.IndexByte(ct, ';'); i >= 0 {
+		ct = ct[:i]
+	}
+
+	var h codec.Handle
+	switch string(bytes.ToLower(bytes.TrimSpace(ct))) {
+	case "application/msgpack", "application/x-msgpack":
+		h = &msgpackHandle
+	case "application/cbor":
+		h = &cborHandle
+	default:
+		return nil
+	}
+
+	var v interface{}
+	if err := codec.NewDecoderBytes(c.PostBody(), h).Decode(&v); err != nil {
+		return err
+	}
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	c.SetUserValue(clientBodyKey, &clientBody{
+		append([]byte(nil), c.PostBody()...),
+		append([]byte(nil), c.Request.Header.ContentType()...),
+	})
+	c.Request.SetBody(body)
+	c.Request.Header.SetContentType("application/json")
+
+	return nil
+}
+
+// Formats serves JSON responses of h as MessagePack, CBOR or CSV when
+// Accept asks for it and lets POSTs send MessagePack and CBOR bodies
+func Formats(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(c *fasthttp.RequestCtx) {
+		if c.IsPost() {
+			if err := decodeBody(c); err != nil {
+				ErrorResponse(c, fasthttp.StatusBadRequest, true)
+				return
+			}
+		}
+
+		format := FormatJSON
+		if accept := c.Request.Header.Peek("Accept"); len(accept) > 0 {
+			format = negotiateFormat(accept)
+		}
+		if format != FormatJSON {
+			c.SetUserValue(formatKey, format)
+		}
+		h(c)
+		addVary(c, "Accept")
+
+		if format == FormatJSON || c.Response.IsBodyStream() || !bytes.HasPrefix(c.Response.Header.ContentType(), []byte("application/json")) {
+			return
+		}
+		body, err := encodeBody(format, c.Response.Body())
+		if err != nil {
+			log.Printf("%s: %s", formatTypes[format][0], err)
+			return
+		}
+		c.Response.SetBody(body)
+		c.Response.Header.SetContentType(formatTypes[format][0])
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/ugorji/go/codec"
+	"github.com/valyala/fasthttp"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   int
+	}{
+		{"application/json", FormatJSON},
+		{"*/*", FormatJSON},
+		{"application/msgpack", FormatMsgpack},
+		{"application/x-msgpack", FormatMsgpack},
+		{"application/cbor, application/json;q=0.5", FormatCBOR},
+		{"text/*", FormatCSV},
+		{"text/csv;q=0.9, application/*;q=0.8", FormatCSV},
+		{"application/*", FormatJSON},
+		{"image/png", FormatJSON},
+	}
+	for _, tt := range tests {
+		if got := negotiateFormat([]byte(tt.accept)); got != tt.want {
+			t.Errorf("negotiateFormat(%q) = %d, want %d", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestEncodeCSV(t *testing.T) {
+	tests := []struct {
+		body string
+		want string
+		ok   bool
+	}{
+		{`{"visits":[{"mark":5,"place":"Музей"},{"mark":3,"place":"Парк, сад"}]}`, "mark,place\n5,Музей\n3,\"Парк, сад\"\n", true},
+		{`{"avg":3.5}`, "avg\n3.5\n", true},
+		{`{"id":1,"lat":null,"tags":[1,2]}`, "id,lat,tags\n1,,\"[1,2]\"\n", true},
+		{`[1,2]`, "", false},
+		{`{"visits":[1]}`, "", false},
+	}
+	for _, tt := range tests {
+		out, err := encodeBody(FormatCSV, []byte(tt.body))
+		if (err == nil) != tt.ok || tt.ok && string(out) != tt.want {
+			t.Errorf("encodeBody(csv, %s) = %q, %v, want %q", tt.body, out, err, tt.want)
+		}
+	}
+}
+
+func TestFormats(t *testing.T) {
+	body := []byte(`{"id":1,"email":"a@example.com","avg":2.5}`)
+	h := Formats(func(c *fasthttp.RequestCtx) {
+		if c.IsPost() {
+			// echo transcoded request body
+			OkResponse(c, c.PostBody(), false)
+			return
+		}
+		OkResponse(c, body, false)
+	})
+
+	msgpack, cbor := []byte{}, []byte{}
+	obj := map[string]interface{}{"id": 1, "email": "a@example.com"}
+	codec.NewEncoderBytes(&msgpack, &msgpackHandle).Encode(obj)
+	codec.NewEncoderBytes(&cbor, &cborHandle).Encode(obj)
+
+	tests := []struct {
+		name        string
+		accept      string
+		contentType string
+		post        []byte
+		code        int
+		respType    string
+	}{
+		{"json", "", "", nil, 200, "application/json"},
+		{"msgpack", "application/msgpack", "", nil, 200, "application/msgpack"},
+		{"cbor", "application/cbor", "", nil, 200, "application/cbor"},
+		{"csv", "text/csv", "", nil, 200, "text/csv"},
+		{"msgpack body", "", "application/msgpack", msgpack, 200, "application/json"},
+		{"cbor body", "", "application/cbor; charset=utf-8", cbor, 200, "application/json"},
+		{"bad msgpack body", "", "application/msgpack", []byte{0xc1}, 400, "application/json"},
+	}
+	for _, tt := range tests {
+		var c fasthttp.RequestCtx
+		if tt.post != nil {
+			c.Request.Header.SetMethod("POST")
+			c.Request.Header.SetContentType(tt.contentType)
+			c.Request.SetBody(tt.post)
+		}
+		if tt.accept != "" {
+			c.Request.Header.Set("Accept", tt.accept)
+		}
+		h(&c)
+
+		if c.Response.StatusCode() != tt.code || string(c.Response.Header.ContentType()) != tt.respType {
+			t.Errorf("%s: %d %s, want %d %s", tt.name, c.Response.StatusCode(), c.Response.Header.ContentType(), tt.code, tt.respType)
+			continue
+		}
+		if tt.code != 200 {
+			continue
+		}
+
+		var got map[string]interface{}
+		var err error
+		switch tt.respType {
+		case "application/msgpack":
+			err = codec.NewDecoderBytes(c.Response.Body(), &msgpackHandle).Decode(&got)
+		case "application/cbor":
+			err = codec.NewDecoderBytes(c.Response.Body(), &cborHandle).Decode(&got)
+		case "text/csv":
+			if s := string(c.Response.Body()); s != "id,email,avg\n1,a@example.com,2.5\n" {
+				t.Errorf("%s: %q", tt.name, s)
+			}
+			continue
+		default:
+			var jh codec.JsonHandle
+			err = codec.NewDecoderBytes(c.Response.Body(), &jh).Decode(&got)
+		}
+		if err != nil || got["email"] != "a@example.com" {
+			t.Errorf("%s: %v, %s", tt.name, got, err)
+		}
+	}
+}
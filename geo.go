@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// mean Earth radius, km
+const earthRadius = 6371.0
+
+// default and max number of locations returned by /locations/near
+const (
+	nearLimit    = 100
+	nearMaxLimit = 1000
+)
+
+//easyjson:json
+type NearResult struct {
+	Locations []NearHit `json:"locations"`
+}
+
+type NearHit struct {
+	ID       uint32  `json:"id"`
+	Place    string  `json:"place"`
+	City     string  `json:"city"`
+	Country  string  `json:"country"`
+	Distance int     `json:"distance"`
+	Lat      float64 `json:"lat"`
+	Lon      float64 `json:"lon"`
+	Km       float64 `json:"km"`
+}
+
+// Sort function
+type ByKm []NearHit
+
+func (h ByKm) Len() int {
+	return len(h)
+}
+func (h ByKm) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+func (h ByKm) Less(i, j int) bool {
+	if h[i].Km != h[j].Km {
+		return h[i].Km < h[j].Km
+	}
+	return h[i].ID < h[j].ID
+}
+
+// GeoCircle is a "near" condition: center point and radius in km
+type GeoCircle struct {
+	Lat    float64
+	Lon    float64
+	Radius float64
+}
+
+// Contains reports whether point lies within the circle
+func (g GeoCircle) Contains(lat, lon float64) bool {
+	return Haversine(g.Lat, g.Lon, lat, lon) <= g.Radius
+}
+
+// ParseGeoCircle parses "lat,lon,radius"
+func ParseGeoCircle(s string) (GeoCircle, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 3 {
+		return GeoCircle{}, fmt.Errorf("near must be lat,lon,radius")
+	}
+
+	var v [3]float64
+	var err error
+	for i, p := range parts {
+		v[i], err = strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return GeoCircle{}, err
+		}
+	}
+	if !ValidCoords(v[0], v[1]) || v[2] < 0 {
+		return GeoCircle{}, fmt.Errorf("near out of range")
+	}
+
+	return GeoCircle{v[0], v[1], v[2]}, nil
+}
+
+// ValidCoords checks latitude and longitude bounds
+func ValidCoords(lat, lon float64) bool {
+	return lat >= -90 && lat <= 90 && lon >= -180 && lon <= 180
+}
+
+// Haversine returns great-circle distance between two points in km
+func Haversine(lat1, lon1, lat2, lon2 float64) float64 {
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// one degree grid cell
+type geoCell struct {
+	lat int
+	lon int
+}
+
+func cellLon(lon int) int {
+	return ((lon+180)%360+360)%360 - 180
+}
+
+func cellOf(lat, lon float64) geoCell {
+	return geoCell{int(math.Floor(lat)), cellLon(int(math.Floor(lon)))}
+}
+
+type geoPoint struct {
+	lat float64
+	lon float64
+}
+
+// GeoIndex is a grid index of location coordinates
+type GeoIndex struct {
+	mu     sync.RWMutex
+	cells  map[geoCell]map[uint32]struct{}
+	points map[uint32]geoPoint
+}
+
+func NewGeoIndex() *GeoIndex {
+	return &GeoIndex{
+		cells:  make(map[geoCell]map[uint32]struct{}),
+		points: make(map[uint32]geoPoint),
+	}
+}
+
+// Set (re)indexes location coordinates, locations without them are dropped
+func (g *GeoIndex) Set(l Location) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if p, ok := g.points[l.ID]; ok {
+		c := cellOf(p.lat, p.lon)
+		delete(g.cells[c], l.ID)
+		if len(g.cells[c]) == 0 {
+			delete(g.cells, c)
+		}
+		delete(g.points, l.ID)
+	}
+	if l.Lat == nil || l.Lon == nil {
+		return
+	}
+
+	c := cellOf(*l.Lat, *l.Lon)
+	if _, ok := g.cells[c]; !ok {
+		g.cells[c] = make(map[uint32]struct{})
+	}
+	g.cells[c][l.ID] = struct{}{}
+	g.points[l.ID] = geoPoint{*l.Lat, *l.Lon}
+}
+
+// Near returns ids of locations within circle with their distances in km
+func (g *GeoIndex) Near(circle GeoCircle) map[uint32]float64 {
+	out := make(map[uint32]float64)
+
+	// bounding box of the circle in degrees
+	dLat := circle.Radius / earthRadius * 180 / math.Pi
+	minLat := math.Max(-90, circle.Lat-dLat)
+	maxLat := math.Min(90, circle.Lat+dLat)
+	minLon, maxLon := -180.0, 180.0
+	if minLat > -90 && maxLat < 90 {
+		s := math.Sin(circle.Radius/earthRadius) / math.Cos(circle.Lat*math.Pi/180)
+		if s < 1 {
+			dLon := math.Asin(s) * 180 / math.Pi
+			minLon, maxLon = circle.Lon-dLon, circle.Lon+dLon
+		}
+	}
+
+	fromLon, toLon := int(math.Floor(minLon)), int(math.Floor(maxLon))
+	if toLon-fromLon >= 360 {
+		fromLon, toLon = -180, 179
+	}
+
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	for y := int(math.Floor(minLat)); y <= int(math.Floor(maxLat)); y++ {
+		for x := fromLon; x <= toLon; x++ {
+			for id := range g.cells[geoCell{y, cellLon(x)}] {
+				p := g.points[id]
+				if km := Haversine(circle.Lat, circle.Lon, p.lat, p.lon); km <= circle.Radius {
+					out[id] = km
+				}
+			}
+		}
+	}
+
+	return out
+}
+
+// Len returns number of indexed locations
+func (g *GeoIndex) Len() int {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return len(g.points)
+}
+
+// NearLocations returns locations within circle ordered by distance
+func (d Database) NearLocations(circle GeoCircle, limit int) []NearHit {
+	hits := make([]NearHit, 0)
+	for id, km := range d.Geo.Near(circle) {
+		l, _ := d.Locations.Get(id)
+		if l.Lat == nil || l.Lon == nil {
+			continue
+		}
+		hits = append(hits, NearHit{l.ID, l.Place, l.City, l.Country, l.Distance, *l.Lat, *l.Lon, km})
+	}
+	sort.Sort(ByKm(hits))
+	if len(hits) > limit {
+		hits = hits[:limit]
+	}
+
+	return hits
+}
@@ -0,0 +1,208 @@
+// Code generated by easyjson for marshaling/unmarshaling. DO NOT EDIT.
+
+package main
+
+import (
+	json "encoding/json"
+	easyjson "github.com/mailru/easyjson"
+	jlexer "github.com/mailru/easyjson/jlexer"
+	jwriter "github.com/mailru/easyjson/jwriter"
+)
+
+// suppress unused package warning
+var (
+	_ *json.RawMessage
+	_ *jlexer.Lexer
+	_ *jwriter.Writer
+	_ easyjson.Marshaler
+)
+
+func easyjsonA0535929DecodeBitbucketOrgPdedkovHlcup(in *jlexer.Lexer, out *NearResult) {
+	isTopLevel := in.IsStart()
+	if in.IsNull() {
+		if isTopLevel {
+			in.Consumed()
+		}
+		in.Skip()
+		return
+	}
+	in.Delim('{')
+	for !in.IsDelim('}') {
+		key := in.UnsafeFieldName(false)
+		in.WantColon()
+		if in.IsNull() {
+			in.Skip()
+			in.WantComma()
+			continue
+		}
+		switch key {
+		case "locations":
+			if in.IsNull() {
+				in.Skip()
+				out.Locations = nil
+			} else {
+				in.Delim('[')
+				if out.Locations == nil {
+					if !in.IsDelim(']') {
+						out.Locations = make([]NearHit, 0, 0)
+					} else {
+						out.Locations = []NearHit{}
+					}
+				} else {
+					out.Locations = (out.Locations)[:0]
+				}
+				for !in.IsDelim(']') {
+					var v1 NearHit
+					easyjsonA0535929DecodeBitbucketOrgPdedkovHlcup1(in, &v1)
+					out.Locations = append(out.Locations, v1)
+					in.WantComma()
+				}
+				in.Delim(']')
+			}
+		default:
+			in.SkipRecursive()
+		}
+		in.WantComma()
+	}
+	in.Delim('}')
+	if isTopLevel {
+		in.Consumed()
+	}
+}
+func easyjsonA0535929EncodeBitbucketOrgPdedkovHlcup(out *jwriter.Writer, in NearResult) {
+	out.RawByte('{')
+	first := true
+	_ = first
+	{
+		const prefix string = ",\"locations\":"
+		out.RawString(prefix[1:])
+		if in.Locations == nil && (out.Flags&jwriter.NilSliceAsEmpty) == 0 {
+			out.RawString("null")
+		} else {
+			out.RawByte('[')
+			for v2, v3 := range in.Locations {
+				if v2 > 0 {
+					out.RawByte(',')
+				}
+				easyjsonA0535929EncodeBitbucketOrgPdedkovHlcup1(out, v3)
+			}
+			out.RawByte(']')
+		}
+	}
+	out.RawByte('}')
+}
+
+// MarshalJSON supports json.Marshaler interface
+func (v NearResult) MarshalJSON() ([]byte, error) {
+	w := jwriter.Writer{}
+	easyjsonA0535929EncodeBitbucketOrgPdedkovHlcup(&w, v)
+	return w.Buffer.BuildBytes(), w.Error
+}
+
+// MarshalEasyJSON supports easyjson.Marshaler interface
+func (v NearResult) MarshalEasyJSON(w *jwriter.Writer) {
+	easyjsonA0535929EncodeBitbucketOrgPdedkovHlcup(w, v)
+}
+
+// UnmarshalJSON supports json.Unmarshaler interface
+func (v *NearResult) UnmarshalJSON(data []byte) error {
+	r := jlexer.Lexer{Data: data}
+	easyjsonA0535929DecodeBitbucketOrgPdedkovHlcup(&r, v)
+	return r.Error()
+}
+
+// UnmarshalEasyJSON supports easyjson.Unmarshaler interface
+func (v *NearResult) UnmarshalEasyJSON(l *jlexer.Lexer) {
+	easyjsonA0535929DecodeBitbucketOrgPdedkovHlcup(l, v)
+}
+func easyjsonA0535929DecodeBitbucketOrgPdedkovHlcup1(in *jlexer.Lexer, out *NearHit) {
+	isTopLevel := in.IsStart()
+	if in.IsNull() {
+		if isTopLevel {
+			in.Consumed()
+		}
+		in.Skip()
+		return
+	}
+	in.Delim('{')
+	for !in.IsDelim('}') {
+		key := in.UnsafeFieldName(false)
+		in.WantColon()
+		if in.IsNull() {
+			in.Skip()
+			in.WantComma()
+			continue
+		}
+		switch key {
+		case "id":
+			out.ID = uint32(in.Uint32())
+		case "place":
+			out.Place = string(in.String())
+		case "city":
+			out.City = string(in.String())
+		case "country":
+			out.Country = string(in.String())
+		case "distance":
+			out.Distance = int(in.Int())
+		case "lat":
+			out.Lat = float64(in.Float64())
+		case "lon":
+			out.Lon = float64(in.Float64())
+		case "km":
+			out.Km = float64(in.Float64())
+		default:
+			in.SkipRecursive()
+		}
+		in.WantComma()
+	}
+	in.Delim('}')
+	if isTopLevel {
+		in.Consumed()
+	}
+}
+func easyjsonA0535929EncodeBitbucketOrgPdedkovHlcup1(out *jwriter.Writer, in NearHit) {
+	out.RawByte('{')
+	first := true
+	_ = first
+	{
+		const prefix string = ",\"id\":"
+		out.RawString(prefix[1:])
+		out.Uint32(uint32(in.ID))
+	}
+	{
+		const prefix string = ",\"place\":"
+		out.RawString(prefix)
+		out.String(string(in.Place))
+	}
+	{
+		const prefix string = ",\"city\":"
+		out.RawString(prefix)
+		out.String(string(in.City))
+	}
+	{
+		const prefix string = ",\"country\":"
+		out.RawString(prefix)
+		out.String(string(in.Country))
+	}
+	{
+		const prefix string = ",\"distance\":"
+		out.RawString(prefix)
+		out.Int(int(in.Distance))
+	}
+	{
+		const prefix string = ",\"lat\":"
+		out.RawString(prefix)
+		out.Float64(float64(in.Lat))
+	}
+	{
+		const prefix string = ",\"lon\":"
+		out.RawString(prefix)
+		out.Float64(float64(in.Lon))
+	}
+	{
+		const prefix string = ",\"km\":"
+		out.RawString(prefix)
+		out.Float64(float64(in.Km))
+	}
+	out.RawByte('}')
+}
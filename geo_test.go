@@ -0,0 +1,100 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestParseGeoCircle(t *testing.T) {
+	tests := []struct {
+		in   string
+		want GeoCircle
+		ok   bool
+	}{
+		{"55.75,37.61,10", GeoCircle{55.75, 37.61, 10}, true},
+		{" -33.9 , 151.2 , 0 ", GeoCircle{-33.9, 151.2, 0}, true},
+		{"55.75,37.61", GeoCircle{}, false},
+		{"91,0,1", GeoCircle{}, false},
+		{"0,181,1", GeoCircle{}, false},
+		{"0,0,-1", GeoCircle{}, false},
+		{"a,0,1", GeoCircle{}, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseGeoCircle(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("ParseGeoCircle(%q) = %v, %v", tt.in, got, err)
+		}
+	}
+}
+
+func TestHaversine(t *testing.T) {
+	tests := []struct {
+		lat1, lon1, lat2, lon2 float64
+		km                     float64
+	}{
+		{0, 0, 0, 0, 0},
+		{0, 0, 0, 180, math.Pi * earthRadius},
+		{90, 0, -90, 0, math.Pi * earthRadius},
+		// Moscow - Saint Petersburg
+		{55.7558, 37.6173, 59.9343, 30.3351, 633},
+	}
+	for _, tt := range tests {
+		if km := Haversine(tt.lat1, tt.lon1, tt.lat2, tt.lon2); math.Abs(km-tt.km) > 1 {
+			t.Errorf("Haversine(%v, %v, %v, %v) = %v, want %v", tt.lat1, tt.lon1, tt.lat2, tt.lon2, km, tt.km)
+		}
+	}
+}
+
+func TestNearLocations(t *testing.T) {
+	coords := func(lat, lon float64) (*float64, *float64) {
+		return &lat, &lon
+	}
+	d := newTestDatabase(t, StorageMap)
+	for _, p := range []struct {
+		id       uint32
+		lat, lon float64
+	}{
+		{1, 55.7558, 37.6173},
+		{2, 55.80, 37.60},
+		{3, 59.9343, 30.3351},
+		// both sides of antimeridian
+		{4, 0, 179.9},
+		{5, 0, -179.9},
+	} {
+		l := Location{ID: p.id}
+		l.Lat, l.Lon = coords(p.lat, p.lon)
+		d.SetLocation(l)
+	}
+	// without coordinates
+	d.SetLocation(Location{ID: 6})
+
+	tests := []struct {
+		circle GeoCircle
+		limit  int
+		want   []uint32
+	}{
+		{GeoCircle{55.7558, 37.6173, 10}, 10, []uint32{1, 2}},
+		{GeoCircle{55.7558, 37.6173, 1000}, 10, []uint32{1, 2, 3}},
+		{GeoCircle{55.7558, 37.6173, 1000}, 2, []uint32{1, 2}},
+		{GeoCircle{0, 180, 50}, 10, []uint32{4, 5}},
+		{GeoCircle{-45, 0, 10}, 10, nil},
+	}
+	for _, tt := range tests {
+		var got []uint32
+		for _, h := range d.NearLocations(tt.circle, tt.limit) {
+			got = append(got, h.ID)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("NearLocations(%v, %d) = %v, want %v", tt.circle, tt.limit, got, tt.want)
+		}
+	}
+
+	// moved location leaves its old cell
+	l := Location{ID: 3}
+	l.Lat, l.Lon = coords(55.76, 37.62)
+	d.SetLocation(l)
+	if hits := d.NearLocations(GeoCircle{59.9343, 30.3351, 10}, 10); len(hits) != 0 {
+		t.Errorf("moved location still found: %v", hits)
+	}
+}
@@ -0,0 +1,26 @@
+module bitbucket.org/pdedkov/hlcup
+
+go 1.25.0
+
+require (
+	github.com/buaazp/fasthttprouter v0.1.1
+	github.com/graphql-go/graphql v0.8.1
+	github.com/mailru/easyjson v0.7.7
+	github.com/sirupsen/logrus v1.9.3
+	github.com/ugorji/go/codec v1.3.1
+	github.com/valyala/fasthttp v1.65.0
+	google.golang.org/grpc v1.82.1
+)
+
+require (
+	github.com/andybalholm/brotli v1.2.0 // indirect
+	github.com/josharian/intern v1.0.0 // indirect
+	github.com/klauspost/compress v1.18.0 // indirect
+	github.com/valyala/bytebufferpool v1.0.0 // indirect
+	golang.org/x/net v0.53.0 // indirect
+	golang.org/x/sys v0.43.0 // indirect
+	golang.org/x/text v0.36.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20260414002931-afd174a4e478 // indirect
+	google.golang.org/protobuf v1.36.11 // indirect
+)
+
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// visits returned by list field when limit is not given
+	graphqlVisitsLimit = 100
+	// largest limit list field accepts
+	graphqlMaxLimit = 10000
+)
+
+// graphqlRequest is body of POST /graphql
+type graphqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// visit filters of HTTP API accepted by visits and avg fields
+var graphqlFilters = graphql.FieldConfigArgument{
+	"fromDate":   &graphql.ArgumentConfig{Type: graphql.Int},
+	"toDate":     &graphql.ArgumentConfig{Type: graphql.Int},
+	"fromAge":    &graphql.ArgumentConfig{Type: graphql.Int},
+	"toAge":      &graphql.ArgumentConfig{Type: graphql.Int},
+	"asOf":       &graphql.ArgumentConfig{Type: graphql.Int},
+	"toDistance": &graphql.ArgumentConfig{Type: graphql.Int},
+	"gender":     &graphql.ArgumentConfig{Type: graphql.String},
+	"country":    &graphql.ArgumentConfig{Type: graphql.String},
+	"near":       &graphql.ArgumentConfig{Type: graphql.String},
+}
+
+// visitsArgs are filters plus limit of visits list
+func visitsArgs() graphql.FieldConfigArgument {
+	args := graphql.FieldConfigArgument{
+		"limit": &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: graphqlVisitsLimit},
+	}
+	for k, v := range graphqlFilters {
+		args[k] = v
+	}
+
+	return args
+}
+
+// filterArgs turns field arguments into query arguments for ParseFilters
+func filterArgs(p graphql.ResolveParams) *fasthttp.Args {
+	args := &fasthttp.Args{}
+	for k := range graphqlFilters {
+		v, ok := p.Args[k]
+		if !ok {
+			continue
+		}
+		s := fmt.Sprint(v)
+		// ParseFilters unescapes country
+		if k == "country" {
+			s = url.QueryEscape(s)
+		}
+		args.Set(k, s)
+	}
+
+	return args
+}
+
+// NewGraphQLSchema builds schema over user → visits → location graph,
+// visit lists are resolved with UserVisit and LocationVisits indexes
+func NewGraphQLSchema(d *Database) (graphql.Schema, error) {
+	idArgs := graphql.FieldConfigArgument{
+		"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)},
+	}
+
+	user := graphql.NewObject(graphql.ObjectConfig{
+		Name: "User",
+		Fields: graphql.Fields{
+			"id":         &graphql.Field{Type: graphql.Int},
+			"email":      &graphql.Field{Type: graphql.String},
+			"first_name": &graphql.Field{Type: graphql.String},
+			"last_name":  &graphql.Field{Type: graphql.String},
+			"gender":     &graphql.Field{Type: graphql.String},
+			"birth_date": &graphql.Field{Type: graphql.Int},
+		},
+	})
+	location := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Location",
+		Fields: graphql.Fields{
+			"id":       &graphql.Field{Type: graphql.Int},
+			"place":    &graphql.Field{Type: graphql.String},
+			"country":  &graphql.Field{Type: graphql.String},
+			"city":     &graphql.Field{Type: graphql.String},
+			"distance": &graphql.Field{Type: graphql.Int},
+			"lat":      &graphql.Field{Type: graphql.Float},
+			"lon":      &graphql.Field{Type: graphql.Float},
+		},
+	})
+	visit := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Visit",
+		Fields: graphql.Fields{
+			"id":         &graphql.Field{Type: graphql.Int},
+			"mark":       &graphql.Field{Type: graphql.Int},
+			"visited_at": &graphql.Field{Type: graphql.Int},
+			"user": &graphql.Field{
+				Type: user,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					u, ok := d.Users.Get(p.Source.(Visit).User)
+					if !ok {
+						return nil, nil
+					}
+					return u, nil
+				},
+			},
+			"location": &graphql.Field{
+				Type: location,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					l, ok := d.Locations.Get(p.Source.(Visit).Location)
+					if !ok {
+						return nil, nil
+					}
+					return l, nil
+				},
+			},
+		},
+	})
+
+	// visits resolves filtered visits of index ordered by date
+	visits := func(index VisitIndex, id func(p graphql.ResolveParams) uint32) *graphql.Field {
+		return &graphql.Field{
+			Type: graphql.NewList(visit),
+			Args: visitsArgs(),
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				limit := p.Args["limit"].(int)
+				if limit < 0 {
+					return nil, fmt.Errorf("negative visits limit %d", limit)
+				}
+				filters, err := d.ParseFilters(filterArgs(p))
+				if err != nil {
+					return nil, err
+				}
+				recs := d.FilterVisits(filters, d.LoadVisits(index.Get(id(p))))
+				sort.Slice(recs, func(i, j int) bool {
+					return recs[i].Visited < recs[j].Visited
+				})
+				if len(recs) > limit {
+					recs = recs[:limit]
+				}
+				return recs, nil
+			},
+		}
+	}
+	user.AddFieldConfig("visits", visits(d.UserVisit, func(p graphql.ResolveParams) uint32 {
+		return p.Source.(User).ID
+	}))
+	location.AddFieldConfig("visits", visits(d.LocationVisits, func(p graphql.ResolveParams) uint32 {
+		return p.Source.(Location).ID
+	}))
+	location.AddFieldConfig("avg", &graphql.Field{
+		Type: graphql.Float,
+		Args: graphqlFilters,
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return d.LocationAvg(p.Source.(Location).ID, filterArgs(p))
+		},
+	})
+
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"user": &graphql.Field{
+				Type: user,
+				Args: idArgs,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					u, ok := d.Users.Get(uint32(p.Args["id"].(int)))
+					if !ok {
+						return nil, nil
+					}
+					return u, nil
+				},
+			},
+			"location": &graphql.Field{
+				Type: location,
+				Args: idArgs,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					l, ok := d.Locations.Get(uint32(p.Args["id"].(int)))
+					if !ok {
+						return nil, nil
+					}
+					return l, nil
+				},
+			},
+			"visit": &graphql.Field{
+				Type: visit,
+				Args: idArgs,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					v, ok := d.Visits.Get(uint32(p.Args["id"].(int)))
+					if !ok {
+						return nil, nil
+					}
+					return v, nil
+				},
+			},
+		},
+	})
+
+	return graphql.NewSchema(graphql.SchemaConfig{Query: query})
+}
+
+// queryCost estimates work of query before running it: every field costs 1
+// and selections under visits lists are multiplied by their limit. Cost
+// saturates at maxCost+1, so nested lists cannot overflow it
+func queryCost(doc *ast.Document, operation string, vars map[string]interface{}, maxCost int) (int, error) {
+	fragments := make(map[string]*ast.FragmentDefinition)
+	var op *ast.OperationDefinition
+	for _, def := range doc.Definitions {
+		switch def := def.(type) {
+		case *ast.FragmentDefinition:
+			fragments[def.Name.Value] = def
+		case *ast.OperationDefinition:
+			if op == nil && (operation == "" || def.Name != nil && def.Name.Value == operation) {
+				op = def
+			}
+		}
+	}
+	if op == nil {
+		return 0, fmt.Errorf("operation %q not found", operation)
+	}
+	// limits may come from defaults of variables not given
+	values := make(map[string]interface{}, len(vars))
+	for _, def := range op.VariableDefinitions {
+		if v, ok := def.DefaultValue.(*ast.IntValue); ok {
+			n, _ := strconv.ParseFloat(v.Value, 64)
+			values[def.Variable.Name.Value] = n
+		}
+	}
+	for k, v := range vars {
+		values[k] = v
+	}
+
+	visiting := make(map[string]bool)
+	var cost func(set *ast.SelectionSet) (int, error)
+	cost = func(set *ast.SelectionSet) (int, error) {
+		if set == nil {
+			return 0, nil
+		}
+
+		total := 0
+		for _, sel := range set.Selections {
+			switch sel := sel.(type) {
+			case *ast.Field:
+				c, err := cost(sel.SelectionSet)
+				if err != nil {
+					return 0, err
+				}
+				if sel.Name.Value == "visits" {
+					limit, err := listLimit(sel, values)
+					if err != nil {
+						return 0, err
+					}
+					if limit > 0 && c > maxCost/limit {
+						c = maxCost + 1
+					} else {
+						c *= limit
+					}
+				}
+				total += 1 + c
+			case *ast.InlineFragment:
+				c, err := cost(sel.SelectionSet)
+				if err != nil {
+					return 0, err
+				}
+				total += c
+			case *ast.FragmentSpread:
+				name := sel.Name.Value
+				f, ok := fragments[name]
+				if !ok || visiting[name] {
+					return 0, fmt.Errorf("bad fragment %q", name)
+				}
+				visiting[name] = true
+				c, err := cost(f.SelectionSet)
+				visiting[name] = false
+				if err != nil {
+					return 0, err
+				}
+				total += c
+			}
+			if total > maxCost {
+				return maxCost + 1, nil
+			}
+		}
+
+		return total, nil
+	}
+
+	return cost(op.SelectionSet)
+}
+
+// listLimit returns limit argument of list field, literal or variable,
+// negative limits are rejected rather than taken for no limit, as are ones
+// above graphqlMaxLimit
+func listLimit(f *ast.Field, vars map[string]interface{}) (int, error) {
+	for _, arg := range f.Arguments {
+		if arg.Name.Value != "limit" {
+			continue
+		}
+		n := float64(graphqlVisitsLimit)
+		switch v := arg.Value.(type) {
+		case *ast.IntValue:
+			n, _ = strconv.ParseFloat(v.Value, 64)
+		case *ast.Variable:
+			if value, ok := vars[v.Name.Value].(float64); ok {
+				n = value
+			}
+		}
+		if n < 0 {
+			return 0, fmt.Errorf("negative visits limit %v", n)
+		}
+		if n > graphqlMaxLimit {
+			return 0, fmt.Errorf("visits limit %v exceeds %d", n, graphqlMaxLimit)
+		}
+		return int(n), nil
+	}
+
+	return graphqlVisitsLimit, nil
+}
+
+// graphqlError writes errors in GraphQL response shape
+func graphqlError(c *fasthttp.RequestCtx, code int, err error) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"errors": []map[string]string{{"message": err.Error()}},
+	})
+	c.Response.Header.Set("Content-Type", "application/json")
+	c.Response.SetStatusCode(code)
+	c.Write(body)
+}
+
+// GraphQLHandler serves queries from POST JSON body or GET query
+// arguments, queries costing more than maxCost are rejected
+func GraphQLHandler(schema graphql.Schema, maxCost int) fasthttp.RequestHandler {
+	return func(c *fasthttp.RequestCtx) {
+		var r graphqlRequest
+		if c.IsPost() {
+			if err := json.Unmarshal(c.PostBody(), &r); err != nil {
+				graphqlError(c, fasthttp.StatusBadRequest, err)
+				return
+			}
+		} else {
+			args := c.QueryArgs()
+			r.Query = string(args.Peek("query"))
+			r.OperationName = string(args.Peek("operationName"))
+			if vars := args.Peek("variables"); len(vars) > 0 {
+				if err := json.Unmarshal(vars, &r.Variables); err != nil {
+					graphqlError(c, fasthttp.StatusBadRequest, err)
+					return
+				}
+			}
+		}
+
+		doc, err := parser.Parse(parser.ParseParams{Source: r.Query})
+		if err != nil {
+			graphqlError(c, fasthttp.StatusBadRequest, err)
+			return
+		}
+		cost, err := queryCost(doc, r.OperationName, r.Variables, maxCost)
+		if err != nil {
+			graphqlError(c, fasthttp.StatusBadRequest, err)
+			return
+		}
+		if cost > maxCost {
+			graphqlError(c, fasthttp.StatusBadRequest, fmt.Errorf("query cost %d exceeds limit %d", cost, maxCost))
+			return
+		}
+
+		result := graphql.Do(graphql.Params{
+			Schema:         schema,
+			RequestString:  r.Query,
+			VariableValues: r.Variables,
+			OperationName:  r.OperationName,
+		})
+		body, _ := json.Marshal(result)
+		OkResponse(c, body, false)
+	}
+}
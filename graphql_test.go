@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/valyala/fasthttp"
+)
+
+func TestQueryCost(t *testing.T) {
+	tests := []struct {
+		query string
+		vars  map[string]interface{}
+		cost  int
+		ok    bool
+	}{
+		{`{ user(id: 1) { id email } }`, nil, 3, true},
+		{`{ user(id: 1) { visits { mark } } }`, nil, 2 + graphqlVisitsLimit, true},
+		{`{ user(id: 1) { visits(limit: 5) { mark place: location { place } } } }`, nil, 2 + 5*3, true},
+		{`query($n: Int) { user(id: 1) { visits(limit: $n) { mark } } }`, map[string]interface{}{"n": 2.0}, 4, true},
+		{`query($n: Int = 1000) { user(id: 1) { visits(limit: $n) { mark } } }`, nil, 1002, true},
+		{`query($n: Int = 1000) { user(id: 1) { visits(limit: $n) { mark } } }`, map[string]interface{}{"n": 3.0}, 5, true},
+		{`{ user(id: 1) { ...f } } fragment f on User { id visits(limit: 2) { mark } }`, nil, 1 + 1 + 1 + 2, true},
+		{`{ user(id: 1) { visits(limit: -1) { mark } } }`, nil, 0, false},
+		{`query($n: Int) { user(id: 1) { visits(limit: $n) { mark } } }`, map[string]interface{}{"n": -1.0}, 0, false},
+		{`query($n: Int = -1) { user(id: 1) { visits(limit: $n) { mark } } }`, nil, 0, false},
+		{`{ user(id: 1) { ...f } } fragment f on User { ...f }`, nil, 0, false},
+		{`{ user(id: 1) { ...g } }`, nil, 0, false},
+		{`{ user(id: 1) { visits(limit: 10001) { mark } } }`, nil, 0, false},
+		{`query($n: Int) { user(id: 1) { visits(limit: $n) { mark } } }`, map[string]interface{}{"n": 1e300}, 0, false},
+		// nested lists saturate instead of overflowing
+		{`{ user(id: 1) { visits(limit: 10000) { location { visits(limit: 10000) { location { visits(limit: 10000) { mark } } } } } } }`, nil, 1000001, true},
+		{`{ user(id: 1) { visits(limit: 2147483647) { location { visits(limit: 2147483647) { location { visits(limit: 2147483647) { mark } } } } } } }`, nil, 0, false},
+	}
+	for _, tt := range tests {
+		doc, err := parser.Parse(parser.ParseParams{Source: tt.query})
+		if err != nil {
+			t.Fatalf("%s: %s", tt.query, err)
+		}
+		cost, err := queryCost(doc, "", tt.vars, 1000000)
+		if (err == nil) != tt.ok || cost != tt.cost {
+			t.Errorf("queryCost(%s, %v) = %d, %v, want %d", tt.query, tt.vars, cost, err, tt.cost)
+		}
+	}
+}
+
+func TestGraphQLHandler(t *testing.T) {
+	d := newTestDatabase(t, StorageMap)
+	d.SetUser(User{ID: 1, Email: "a@example.com", FirstName: "A", LastName: "B", Gender: "m"})
+	d.SetLocation(Location{ID: 1, Place: "Музей", Country: "Россия", City: "Москва", Distance: 10})
+	for i := 1; i <= 3; i++ {
+		d.SetVisit(Visit{ID: uint32(i), User: 1, Location: 1, Visited: 1000000000 - i, Mark: i})
+	}
+	schema, err := NewGraphQLSchema(&d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := GraphQLHandler(schema, 200)
+
+	tests := []struct {
+		name string
+		body string
+		code int
+		want string
+	}{
+		{"user", `{"query":"{ user(id: 1) { email } }"}`, 200, `{"data":{"user":{"email":"a@example.com"}}}`},
+		{"missing", `{"query":"{ user(id: 9) { email } }"}`, 200, `{"data":{"user":null}}`},
+		{"limited visits", `{"query":"query($n: Int) { user(id: 1) { visits(limit: $n) { mark } } }","variables":{"n":2}}`, 200, `{"data":{"user":{"visits":[{"mark":3},{"mark":2}]}}}`},
+		{"avg", `{"query":"{ location(id: 1) { avg(gender: \"m\") } }"}`, 200, `{"data":{"location":{"avg":2}}}`},
+		{"negative limit", `{"query":"{ user(id: 1) { visits(limit: -1) { mark } } }"}`, 400, "negative"},
+		{"too costly", `{"query":"{ user(id: 1) { visits(limit: 500) { mark } } }"}`, 400, "exceeds"},
+		{"nested max limits", `{"query":"{ user(id: 1) { visits(limit: 2147483647) { location { visits(limit: 2147483647) { location { visits(limit: 2147483647) { mark } } } } } } }"}`, 400, "exceeds"},
+		{"bad query", `{"query":"{ user("}`, 400, "Syntax Error"},
+		{"bad body", `{`, 400, ""},
+	}
+	for _, tt := range tests {
+		var c fasthttp.RequestCtx
+		c.Request.Header.SetMethod("POST")
+		c.Request.SetBody([]byte(tt.body))
+		h(&c)
+
+		body := string(c.Response.Body())
+		if c.Response.StatusCode() != tt.code || !strings.Contains(body, tt.want) {
+			t.Errorf("%s: %d %s, want %d %s", tt.name, c.Response.StatusCode(), body, tt.code, tt.want)
+		}
+		if !json.Valid(c.Response.Body()) {
+			t.Errorf("%s: invalid JSON %s", tt.name, body)
+		}
+	}
+
+	// GET takes query and variables from arguments
+	var c fasthttp.RequestCtx
+	c.Request.SetRequestURI("/graphql?query=" + string(fasthttp.AppendQuotedArg(nil, []byte(`query($id: Int!) { user(id: $id) { id } }`))) + "&variables=" + string(fasthttp.AppendQuotedArg(nil, []byte(`{"id":1}`))))
+	h(&c)
+	if body := string(c.Response.Body()); body != `{"data":{"user":{"id":1}}}` {
+		t.Errorf("GET: %s", body)
+	}
+}
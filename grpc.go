@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// gRPC service name, messages are JSON encoded
+const travelsService = "hlcup.Travels"
+
+// jsonCodec encodes gRPC messages as JSON, so API keeps the types and
+// validation of HTTP handlers instead of generated protobuf ones
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+// EntityRequest asks for entity by id
+type EntityRequest struct {
+	ID uint32 `json:"id"`
+}
+
+// UpsertRequest carries entity fields to update in the same JSON as POST
+// body, id is "new" to create entity
+type UpsertRequest struct {
+	ID     string          `json:"id"`
+	Entity json.RawMessage `json:"entity"`
+}
+
+// UpsertReply is empty as {} answer of POST
+type UpsertReply struct{}
+
+// FilterRequest asks for visits of entity id, filters are query
+// arguments of HTTP API
+type FilterRequest struct {
+	ID      uint32            `json:"id"`
+	Filters map[string]string `json:"filters,omitempty"`
+}
+
+func (r *FilterRequest) args() *fasthttp.Args {
+	args := &fasthttp.Args{}
+	for k, v := range r.Filters {
+		args.Set(k, v)
+	}
+
+	return args
+}
+
+// TravelsService is gRPC API of the same operations as HTTP router
+type TravelsService interface {
+	GetUser(ctx context.Context, r *EntityRequest) (*User, error)
+	GetLocation(ctx context.Context, r *EntityRequest) (*Location, error)
+	GetVisit(ctx context.Context, r *EntityRequest) (*Visit, error)
+	UpsertUser(ctx context.Context, r *UpsertRequest) (*UpsertReply, error)
+	UpsertLocation(ctx context.Context, r *UpsertRequest) (*UpsertReply, error)
+	UpsertVisit(ctx context.Context, r *UpsertRequest) (*UpsertReply, error)
+	UserVisits(ctx context.Context, r *FilterRequest) (*ShortVisits, error)
+	LocationAvg(ctx context.Context, r *FilterRequest) (*Avg, error)
+}
+
+// TravelsServer serves gRPC API over database, upserts go through HTTP
+// write handlers of entity types, so they are routed to shards and audited
+// the same way as POST requests. Reads go through HTTP handlers of routes
+// when reads is set, in cluster mode, and to database otherwise
+type TravelsServer struct {
+	d      *Database
+	writes map[string]fasthttp.RequestHandler
+	reads  map[string]fasthttp.RequestHandler
+}
+
+// grpcError converts database operation error to gRPC status
+func grpcError(err error) error {
+	switch err {
+	case nil:
+		return nil
+	case ErrNotFound:
+		return status.Error(codes.NotFound, err.Error())
+	case ErrConflict:
+		return status.Error(codes.AlreadyExists, err.Error())
+	}
+
+	return status.Error(codes.InvalidArgument, err.Error())
+}
+
+// statusError converts HTTP status of write handler to gRPC status
+func statusError(code int) error {
+	switch code {
+	case fasthttp.StatusOK:
+		return nil
+	case fasthttp.StatusNotFound:
+		return grpcError(ErrNotFound)
+	case fasthttp.StatusConflict:
+		return status.Error(codes.AlreadyExists, "conflict")
+	case fasthttp.StatusBadRequest:
+		return grpcError(ErrInvalid)
+	case fasthttp.StatusUnauthorized:
+		return status.Error(codes.Unauthenticated, "authentication required")
+	case fasthttp.StatusForbidden:
+		return status.Error(codes.PermissionDenied, "access denied")
+	}
+
+	return status.Error(codes.Unavailable, fasthttp.StatusMessage(code))
+}
+
+// upsert serves request with write handler of typ as POST to
+// /<typ>s/<id>
+func (s *TravelsServer) upsert(ctx context.Context, typ string, r *UpsertRequest) error {
+	if strings.ContainsAny(r.ID, "/?#") {
+		return grpcError(ErrNotFound)
+	}
+
+	var req fasthttp.Request
+	req.Header.SetMethod("POST")
+	req.SetRequestURI("/" + typ + "s/" + r.ID)
+	req.Header.SetContentType("application/json")
+	req.SetBody(r.Entity)
+	c := serve(ctx, s.writes[typ], &req, r.ID)
+
+	return statusError(c.Response.StatusCode())
+}
+
+// get serves GET of route for id with its read handler and decodes answer
+// into v
+func (s *TravelsServer) get(ctx context.Context, route string, id uint32, args *fasthttp.Args, v json.Unmarshaler) error {
+	sid := strconv.FormatUint(uint64(id), 10)
+	uri := strings.Replace(route, ":id", sid, 1)
+	if args != nil && args.Len() > 0 {
+		uri += "?" + args.String()
+	}
+	var req fasthttp.Request
+	req.Header.SetMethod("GET")
+	req.SetRequestURI(uri)
+	c := serve(ctx, s.reads[route], &req, sid)
+	if err := statusError(c.Response.StatusCode()); err != nil {
+		return err
+	}
+
+	return v.UnmarshalJSON(c.Response.Body())
+}
+
+// serve runs HTTP handler h with request of gRPC call as router would,
+// principal authenticated by interceptor is vouched for to other shards
+func serve(ctx context.Context, h fasthttp.RequestHandler, req *fasthttp.Request, id string) *fasthttp.RequestCtx {
+	var addr net.Addr = &net.TCPAddr{IP: net.IPv4zero}
+	if p, ok := peer.FromContext(ctx); ok {
+		addr = p.Addr
+	}
+	c := &fasthttp.RequestCtx{}
+	c.Init(req, addr, nil)
+	c.SetUserValue("id", id)
+	if p, ok := ctx.Value(principalContextKey{}).(string); ok && p != "" {
+		c.SetUserValue(principalKey, p)
+	}
+	h(c)
+
+	return c
+}
+
+func (s *TravelsServer) GetUser(ctx context.Context, r *EntityRequest) (*User, error) {
+	if s.reads != nil {
+		var u User
+		if err := s.get(ctx, "/users/:id", r.ID, nil, &u); err != nil {
+			return nil, err
+		}
+		return &u, nil
+	}
+
+	u, ok := s.d.Users.Get(r.ID)
+	if !ok {
+		return nil, grpcError(ErrNotFound)
+	}
+	return &u, nil
+}
+
+func (s *TravelsServer) GetLocation(ctx context.Context, r *EntityRequest) (*Location, error) {
+	l, ok := s.d.Locations.Get(r.ID)
+	if !ok {
+		return nil, grpcError(ErrNotFound)
+	}
+	return &l, nil
+}
+
+func (s *TravelsServer) GetVisit(ctx context.Context, r *EntityRequest) (*Visit, error) {
+	if s.reads != nil {
+		var v Visit
+		if err := s.get(ctx, "/visits/:id", r.ID, nil, &v); err != nil {
+			return nil, err
+		}
+		return &v, nil
+	}
+
+	v, ok := s.d.Visits.Get(r.ID)
+	if !ok {
+		return nil, grpcError(ErrNotFound)
+	}
+	return &v, nil
+}
+
+func (s *TravelsServer) UpsertUser(ctx context.Context, r *UpsertRequest) (*UpsertReply, error) {
+	return &UpsertReply{}, s.upsert(ctx, ChangeUser, r)
+}
+
+func (s *TravelsServer) UpsertLocation(ctx context.Context, r *UpsertRequest) (*UpsertReply, error) {
+	return &UpsertReply{}, s.upsert(ctx, ChangeLocation, r)
+}
+
+func (s *TravelsServer) UpsertVisit(ctx context.Context, r *UpsertRequest) (*UpsertReply, error) {
+	return &UpsertReply{}, s.upsert(ctx, ChangeVisit, r)
+}
+
+func (s *TravelsServer) UserVisits(ctx context.Context, r *FilterRequest) (*ShortVisits, error) {
+	if s.reads != nil {
+		var v ShortVisits
+		if err := s.get(ctx, "/users/:id/visits", r.ID, r.args(), &v); err != nil {
+			return nil, err
+		}
+		return &v, nil
+	}
+
+	v, err := s.d.UserVisits(r.ID, r.args())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &ShortVisits{v}, nil
+}
+
+func (s *TravelsServer) LocationAvg(ctx context.Context, r *FilterRequest) (*Avg, error) {
+	if s.reads != nil {
+		var avg Avg
+		if err := s.get(ctx, "/locations/:id/avg", r.ID, r.args(), &avg); err != nil {
+			return nil, err
+		}
+		return &avg, nil
+	}
+
+	avg, err := s.d.LocationAvg(r.ID, r.args())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &Avg{avg}, nil
+}
+
+// travelsMethod describes unary method, req makes empty request and call
+// runs it against server
+func travelsMethod(name string, req func() interface{}, call func(ctx context.Context, s TravelsService, r interface{}) (interface{}, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			r := req()
+			if err := dec(r); err != nil {
+				return nil, err
+			}
+			h := func(ctx context.Context, r interface{}) (interface{}, error) {
+				return call(ctx, srv.(TravelsService), r)
+			}
+			if interceptor == nil {
+				return h(ctx, r)
+			}
+			info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + travelsService + "/" + name}
+			return interceptor(ctx, r, info, h)
+		},
+	}
+}
+
+var travelsDesc = grpc.ServiceDesc{
+	ServiceName: travelsService,
+	HandlerType: (*TravelsService)(nil),
+	Methods: []grpc.MethodDesc{
+		travelsMethod("GetUser", func() interface{} { return &EntityRequest{} }, func(ctx context.Context, s TravelsService, r interface{}) (interface{}, error) {
+			return s.GetUser(ctx, r.(*EntityRequest))
+		}),
+		travelsMethod("GetLocation", func() interface{} { return &EntityRequest{} }, func(ctx context.Context, s TravelsService, r interface{}) (interface{}, error) {
+			return s.GetLocation(ctx, r.(*EntityRequest))
+		}),
+		travelsMethod("GetVisit", func() interface{} { return &EntityRequest{} }, func(ctx context.Context, s TravelsService, r interface{}) (interface{}, error) {
+			return s.GetVisit(ctx, r.(*EntityRequest))
+		}),
+		travelsMethod("UpsertUser", func() interface{} { return &UpsertRequest{} }, func(ctx context.Context, s TravelsService, r interface{}) (interface{}, error) {
+			return s.UpsertUser(ctx, r.(*UpsertRequest))
+		}),
+		travelsMethod("UpsertLocation", func() interface{} { return &UpsertRequest{} }, func(ctx context.Context, s TravelsService, r interface{}) (interface{}, error) {
+			return s.UpsertLocation(ctx, r.(*UpsertRequest))
+		}),
+		travelsMethod("UpsertVisit", func() interface{} { return &UpsertRequest{} }, func(ctx context.Context, s TravelsService, r interface{}) (interface{}, error) {
+			return s.UpsertVisit(ctx, r.(*UpsertRequest))
+		}),
+		travelsMethod("UserVisits", func() interface{} { return &FilterRequest{} }, func(ctx context.Context, s TravelsService, r interface{}) (interface{}, error) {
+			return s.UserVisits(ctx, r.(*FilterRequest))
+		}),
+		travelsMethod("LocationAvg", func() interface{} { return &FilterRequest{} }, func(ctx context.Context, s TravelsService, r interface{}) (interface{}, error) {
+			return s.LocationAvg(ctx, r.(*FilterRequest))
+		}),
+	},
+}
+
+// NewGRPCServer registers travels service over d with write handlers of
+// entity types and read handlers of routes, reads is nil outside of
+// cluster. It is not bound to listener, so it can be served in-process
+// over any net.Listener
+func NewGRPCServer(d *Database, writes, reads map[string]fasthttp.RequestHandler, opts ...grpc.ServerOption) *grpc.Server {
+	s := grpc.NewServer(append([]grpc.ServerOption{grpc.ForceServerCodec(jsonCodec{})}, opts...)...)
+	s.RegisterService(&travelsDesc, &TravelsServer{d, writes, reads})
+
+	return s
+}
+
+// ServeGRPC starts gRPC API on addr in background
+func ServeGRPC(addr string, d *Database, writes, reads map[string]fasthttp.RequestHandler, opts ...grpc.ServerOption) (*grpc.Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := NewGRPCServer(d, writes, reads, opts...)
+	go func() {
+		if err := s.Serve(ln); err != nil {
+			log.Printf("grpc: %s", err)
+		}
+	}()
+	log.Printf("gRPC listening on %s", addr)
+
+	return s, nil
+}
+
+// TravelsClient calls travels service over conn
+type TravelsClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewTravelsClient(cc grpc.ClientConnInterface) *TravelsClient {
+	return &TravelsClient{cc}
+}
+
+func (c *TravelsClient) invoke(ctx context.Context, method string, req interface{}, reply interface{}) error {
+	return c.cc.Invoke(ctx, "/"+travelsService+"/"+method, req, reply, grpc.CallContentSubtype(jsonCodec{}.Name()))
+}
+
+func (c *TravelsClient) GetUser(ctx context.Context, id uint32) (*User, error) {
+	u := &User{}
+	return u, c.invoke(ctx, "GetUser", &EntityRequest{id}, u)
+}
+
+func (c *TravelsClient) GetLocation(ctx context.Context, id uint32) (*Location, error) {
+	l := &Location{}
+	return l, c.invoke(ctx, "GetLocation", &EntityRequest{id}, l)
+}
+
+func (c *TravelsClient) GetVisit(ctx context.Context, id uint32) (*Visit, error) {
+	v := &Visit{}
+	return v, c.invoke(ctx, "GetVisit", &EntityRequest{id}, v)
+}
+
+func (c *TravelsClient) UpsertUser(ctx context.Context, id string, entity []byte) error {
+	return c.invoke(ctx, "UpsertUser", &UpsertRequest{id, entity}, &UpsertReply{})
+}
+
+func (c *TravelsClient) UpsertLocation(ctx context.Context, id string, entity []byte) error {
+	return c.invoke(ctx, "UpsertLocation", &UpsertRequest{id, entity}, &UpsertReply{})
+}
+
+func (c *TravelsClient) UpsertVisit(ctx context.Context, id string, entity []byte) error {
+	return c.invoke(ctx, "UpsertVisit", &UpsertRequest{id, entity}, &UpsertReply{})
+}
+
+func (c *TravelsClient) UserVisits(ctx context.Context, id uint32, filters map[string]string) ([]ShortVisit, error) {
+	r := &ShortVisits{}
+	err := c.invoke(ctx, "UserVisits", &FilterRequest{id, filters}, r)
+	return r.Visits, err
+}
+
+func (c *TravelsClient) LocationAvg(ctx context.Context, id uint32, filters map[string]string) (float64, error) {
+	r := &Avg{}
+	err := c.invoke(ctx, "LocationAvg", &FilterRequest{id, filters}, r)
+	return r.Avg, err
+}
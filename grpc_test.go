@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newTestTravels serves d over in-process connection, writes are audited
+// like POST requests of router
+func newTestTravels(t *testing.T, d *Database, audit *Audit, opts ...grpc.ServerOption) *TravelsClient {
+	upsert := func(f func(id string, body []byte) error) fasthttp.RequestHandler {
+		return func(c *fasthttp.RequestCtx) {
+			if err := f(c.UserValue("id").(string), c.PostBody()); err != nil {
+				ErrorResponse(c, errorStatus(err), true)
+				return
+			}
+			OkResponse(c, []byte(`{}`), true)
+		}
+	}
+	writes := map[string]fasthttp.RequestHandler{
+		ChangeUser:     audit.Wrap(ChangeUser, d.Users.JSON, upsert(d.UpsertUser)),
+		ChangeLocation: audit.Wrap(ChangeLocation, d.Locations.JSON, upsert(d.UpsertLocation)),
+		ChangeVisit:    audit.Wrap(ChangeVisit, d.Visits.JSON, upsert(d.UpsertVisit)),
+	}
+
+	return dialTravels(t, NewGRPCServer(d, writes, nil, opts...))
+}
+
+// dialTravels serves s over in-process connection
+func dialTravels(t *testing.T, s *grpc.Server) *TravelsClient {
+	ln := bufconn.Listen(1 << 20)
+	go s.Serve(ln)
+	t.Cleanup(s.Stop)
+
+	cc, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return ln.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cc.Close() })
+
+	return NewTravelsClient(cc)
+}
+
+func TestGRPC(t *testing.T) {
+	d := newTestDatabase(t, StorageMap)
+	d.SetUser(User{ID: 1, Email: "a@example.com", FirstName: "A", LastName: "B", Gender: "m", Birthday: 0})
+	d.SetLocation(Location{ID: 1, Place: "Музей", Country: "Россия", City: "Москва", Distance: 10})
+	d.SetVisit(Visit{ID: 1, User: 1, Location: 1, Visited: 1000000000, Mark: 4})
+	d.SetVisit(Visit{ID: 2, User: 1, Location: 1, Visited: 1000000100, Mark: 1})
+	client := newTestTravels(t, &d, NewAudit(10, nil, nil))
+	ctx := context.Background()
+
+	if u, err := client.GetUser(ctx, 1); err != nil || u.Email != "a@example.com" {
+		t.Errorf("GetUser(1) = %v, %v", u, err)
+	}
+	if _, err := client.GetVisit(ctx, 3); status.Code(err) != codes.NotFound {
+		t.Errorf("GetVisit(3) = %v, want NotFound", err)
+	}
+	if v, err := client.UserVisits(ctx, 1, map[string]string{"toDistance": "20"}); err != nil || len(v) != 2 || v[0].Mark != 4 {
+		t.Errorf("UserVisits(1) = %v, %v", v, err)
+	}
+	if _, err := client.UserVisits(ctx, 1, map[string]string{"toDistance": "x"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("UserVisits(1, bad filter) = %v, want InvalidArgument", err)
+	}
+	if avg, err := client.LocationAvg(ctx, 1, nil); err != nil || avg != 2.5 {
+		t.Errorf("LocationAvg(1) = %v, %v", avg, err)
+	}
+
+	tests := []struct {
+		id   string
+		body string
+		code codes.Code
+	}{
+		{"1", `{"first_name":"C"}`, codes.OK},
+		{"new", `{"id":2,"email":"b@example.com","first_name":"D","last_name":"E","gender":"f","birth_date":0}`, codes.OK},
+		{"new", `{"id":3,"email":"c@example.com","first_name":"D","last_name":"E","gender":"x","birth_date":0}`, codes.InvalidArgument},
+		{"9", `{"first_name":"C"}`, codes.NotFound},
+		{"1/visits", `{"first_name":"C"}`, codes.NotFound},
+	}
+	for _, tt := range tests {
+		if err := client.UpsertUser(ctx, tt.id, []byte(tt.body)); status.Code(err) != tt.code {
+			t.Errorf("UpsertUser(%s, %s) = %v, want %s", tt.id, tt.body, err, tt.code)
+		}
+	}
+	if u, _ := d.Users.Get(1); u.FirstName != "C" {
+		t.Errorf("user 1 first name %q, want C", u.FirstName)
+	}
+	if _, ok := d.Users.Get(2); !ok {
+		t.Error("user 2 not created")
+	}
+}
+
+func TestGRPCReads(t *testing.T) {
+	// cluster serves reads with HTTP handlers routing them to shards
+	var uris []string
+	answer := func(code int, body string) fasthttp.RequestHandler {
+		return func(c *fasthttp.RequestCtx) {
+			uris = append(uris, string(c.RequestURI()))
+			if code != fasthttp.StatusOK {
+				ErrorResponse(c, code, false)
+				return
+			}
+			OkResponse(c, []byte(body), false)
+		}
+	}
+	reads := map[string]fasthttp.RequestHandler{
+		"/users/:id":         answer(200, `{"id":7,"email":"a@example.com","first_name":"A","last_name":"B","gender":"m","birth_date":0}`),
+		"/visits/:id":        answer(404, ""),
+		"/users/:id/visits":  answer(200, `{"visits":[{"mark":3,"visited_at":1000000000,"place":"Музей"}]}`),
+		"/locations/:id/avg": answer(200, `{"avg":3.5}`),
+	}
+	d := newTestDatabase(t, StorageMap)
+	client := dialTravels(t, NewGRPCServer(&d, nil, reads))
+	ctx := context.Background()
+
+	if u, err := client.GetUser(ctx, 7); err != nil || u.Email != "a@example.com" {
+		t.Errorf("GetUser(7) = %v, %v", u, err)
+	}
+	if _, err := client.GetVisit(ctx, 9); status.Code(err) != codes.NotFound {
+		t.Errorf("GetVisit(9) = %v, want NotFound", err)
+	}
+	if v, err := client.UserVisits(ctx, 7, map[string]string{"toDistance": "20"}); err != nil || len(v) != 1 || v[0].Mark != 3 {
+		t.Errorf("UserVisits(7) = %v, %v", v, err)
+	}
+	if avg, err := client.LocationAvg(ctx, 1, map[string]string{"gender": "m"}); err != nil || avg != 3.5 {
+		t.Errorf("LocationAvg(1) = %v, %v", avg, err)
+	}
+	want := []string{"/users/7", "/visits/9", "/users/7/visits?toDistance=20", "/locations/1/avg?gender=m"}
+	if strings.Join(uris, " ") != strings.Join(want, " ") {
+		t.Errorf("routed %v, want %v", uris, want)
+	}
+}
+
+func TestGRPCAuth(t *testing.T) {
+	d := newTestDatabase(t, StorageMap)
+	d.SetUser(User{ID: 1, Email: "a@example.com", FirstName: "A", LastName: "B", Gender: "m"})
+	auth := &Auth{
+		schemes: []Authenticator{APIKeys{
+			sha256.Sum256([]byte("reader")): {"apikey:reader", AccessRead},
+			sha256.Sum256([]byte("writer")): {"apikey:writer", AccessWrite},
+		}},
+		anonymous: AccessNone,
+		routes:    map[string]Access{},
+	}
+	audit := NewAudit(10, nil, nil)
+	client := newTestTravels(t, &d, audit, grpc.UnaryInterceptor(auth.UnaryInterceptor))
+
+	tests := []struct {
+		key   string
+		write bool
+		code  codes.Code
+	}{
+		{"", false, codes.Unauthenticated},
+		{"bad", false, codes.Unauthenticated},
+		{"reader", false, codes.OK},
+		{"reader", true, codes.PermissionDenied},
+		{"writer", true, codes.OK},
+	}
+	for _, tt := range tests {
+		ctx := context.Background()
+		if tt.key != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, "x-api-key", tt.key)
+		}
+		var err error
+		if tt.write {
+			err = client.UpsertUser(ctx, "1", []byte(`{"last_name":"Z"}`))
+		} else {
+			_, err = client.GetUser(ctx, 1)
+		}
+		if status.Code(err) != tt.code {
+			t.Errorf("key %q write %v: %v, want %s", tt.key, tt.write, err, tt.code)
+		}
+	}
+
+	// upserts are audited with principal like POST requests
+	entries := audit.entries(auditFilter{}, 0)
+	if len(entries) != 1 || entries[0].Client != "apikey:writer" || entries[0].ID != 1 {
+		t.Errorf("audit entries %+v, want one write of apikey:writer", entries)
+	}
+}
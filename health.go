@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// build info, set with -ldflags "-X main.version=... -X main.commit=..."
+var (
+	version = "dev"
+	commit  = ""
+)
+
+// LoadedFile is a data file read at startup
+type LoadedFile struct {
+	Path    string `json:"path"`
+	Records int    `json:"records"`
+}
+
+// Warmup serves probes while data is loading and switches traffic
+// to the real handler once it is ready
+type Warmup struct {
+	ready int32
+	// set once with ready and never reset, database is complete
+	loaded  int32
+	handler atomic.Value
+	started time.Time
+
+	mu    sync.Mutex
+	files []LoadedFile
+}
+
+func NewWarmup() *Warmup {
+	return &Warmup{started: time.Now()}
+}
+
+// AddFile records loaded data file
+func (w *Warmup) AddFile(path string, records int) {
+	w.mu.Lock()
+	w.files = append(w.files, LoadedFile{path, records})
+	w.mu.Unlock()
+}
+
+// Files returns data files loaded so far
+func (w *Warmup) Files() []LoadedFile {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return append([]LoadedFile{}, w.files...)
+}
+
+// Ready switches traffic to h
+func (w *Warmup) Ready(h fasthttp.RequestHandler) {
+	w.handler.Store(h)
+	atomic.StoreInt32(&w.loaded, 1)
+	atomic.StoreInt32(&w.ready, 1)
+}
+
+// Drain makes /readyz fail while server is shutting down
+func (w *Warmup) Drain() {
+	atomic.StoreInt32(&w.ready, 0)
+}
+
+func (w *Warmup) IsReady() bool {
+	return atomic.LoadInt32(&w.ready) == 1
+}
+
+// Loaded reports whether Ready was called, everything loader wrote
+// before it is visible afterwards
+func (w *Warmup) Loaded() bool {
+	return atomic.LoadInt32(&w.loaded) == 1
+}
+
+// Handler answers /healthz and /readyz, other requests get 503 until ready
+func (w *Warmup) Handler(c *fasthttp.RequestCtx) {
+	switch string(c.Path()) {
+	case "/healthz":
+		OkResponse(c, []byte(`{}`), false)
+		return
+	case "/readyz":
+		if !w.IsReady() {
+			ErrorResponse(c, fasthttp.StatusServiceUnavailable, false)
+			return
+		}
+		OkResponse(c, []byte(`{}`), false)
+		return
+	}
+
+	h, ok := w.handler.Load().(fasthttp.RequestHandler)
+	if !ok {
+		ErrorResponse(c, fasthttp.StatusServiceUnavailable, false)
+		return
+	}
+	h(c)
+}
+
+// AdminStatus is the answer of /admin/status
+type AdminStatus struct {
+	Ready   bool           `json:"ready"`
+	Uptime  float64        `json:"uptime"`
+	Files   []LoadedFile   `json:"files"`
+	Records map[string]int `json:"records"`
+	Now     int64          `json:"now"`
+	Frozen  int64          `json:"frozen"`
+	Config  Config         `json:"config"`
+	Build   struct {
+		Version string `json:"version"`
+		Commit  string `json:"commit"`
+		Go      string `json:"go"`
+	} `json:"build"`
+}
+
+// AdminHandler serves /admin/status on admin port
+func (w *Warmup) AdminHandler(d *Database) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		s := AdminStatus{
+			Ready:  w.IsReady(),
+			Uptime: time.Since(w.started).Seconds(),
+			Files:  w.Files(),
+			Records: map[string]int{
+				"users":     d.Users.Len(),
+				"locations": d.Locations.Len(),
+				"visits":    d.Visits.Len(),
+			},
+			Config: config,
+		}
+		// reference time is set by loader
+		if w.Loaded() {
+			s.Frozen = NOW
+			s.Now = d.Ages.Now()
+		}
+		s.Build.Version = version
+		s.Build.Commit = commit
+		s.Build.Go = runtime.Version()
+
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(s)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestWarmupHandler(t *testing.T) {
+	w := NewWarmup()
+	app := func(c *fasthttp.RequestCtx) {
+		OkResponse(c, []byte(`{"app":true}`), false)
+	}
+	serve := func(path string) int {
+		var c fasthttp.RequestCtx
+		c.Request.SetRequestURI(path)
+		w.Handler(&c)
+		return c.Response.StatusCode()
+	}
+
+	tests := []struct {
+		step string
+		path string
+		code int
+	}{
+		{"loading", "/healthz", 200},
+		{"loading", "/readyz", 503},
+		{"loading", "/users/1", 503},
+		{"ready", "/healthz", 200},
+		{"ready", "/readyz", 200},
+		{"ready", "/users/1", 200},
+		{"draining", "/readyz", 503},
+		{"draining", "/users/1", 200},
+	}
+	for _, tt := range tests {
+		switch tt.step {
+		case "ready":
+			if !w.IsReady() {
+				w.Ready(app)
+			}
+		case "draining":
+			w.Drain()
+		}
+		if code := serve(tt.path); code != tt.code {
+			t.Errorf("%s: %s = %d, want %d", tt.step, tt.path, code, tt.code)
+		}
+	}
+	if !w.Loaded() {
+		t.Error("drained warmup is not loaded")
+	}
+}
+
+func TestWarmupAdminHandler(t *testing.T) {
+	w := NewWarmup()
+	d := newTestDatabase(t, StorageMap)
+	w.AddFile("users_1.json", 2)
+	d.SetUser(User{ID: 1})
+	d.SetUser(User{ID: 2})
+	NOW = 1500000000
+
+	status := func() AdminStatus {
+		rec := httptest.NewRecorder()
+		w.AdminHandler(&d)(rec, httptest.NewRequest("GET", "/admin/status", nil))
+		var s AdminStatus
+		if err := json.Unmarshal(rec.Body.Bytes(), &s); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	tests := []struct {
+		ready  bool
+		frozen int64
+	}{
+		// reference time is not reported while loader may change it
+		{false, 0},
+		{true, 1500000000},
+	}
+	for _, tt := range tests {
+		if tt.ready {
+			w.Ready(func(c *fasthttp.RequestCtx) {})
+		}
+		s := status()
+		if s.Ready != tt.ready || s.Frozen != tt.frozen || s.Now != tt.frozen {
+			t.Errorf("ready %v: status ready %v, frozen %d, now %d", tt.ready, s.Ready, s.Frozen, s.Now)
+		}
+		if s.Records["users"] != 2 || len(s.Files) != 1 || s.Files[0].Records != 2 {
+			t.Errorf("ready %v: records %v, files %v", tt.ready, s.Records, s.Files)
+		}
+	}
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mailru/easyjson"
+	"github.com/valyala/fasthttp"
+)
+
+//easyjson:json
+type Version struct {
+	// unix time state holds since, 0 is state from before history
+	At int64 `json:"at"`
+	// null while entity does not exist
+	Data easyjson.RawMessage `json:"data"`
+}
+
+//easyjson:json
+type Versions struct {
+	History []Version `json:"history"`
+}
+
+// period of sweeping versions out of retention window
+const historySweep = time.Minute
+
+// History keeps versions of changed entities for retention window,
+// entities never changed since start have no history and are current
+type History struct {
+	mu        sync.RWMutex
+	versions  map[string]map[uint32][]Version
+	retention time.Duration
+
+	// changed visits by users and locations of their versions, superset
+	// until the next sweep
+	userVisits     map[uint32]map[uint32]bool
+	locationVisits map[uint32]map[uint32]bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewHistory keeps versions for retention and sweeps older ones in
+// background until closed
+func NewHistory(retention time.Duration) *History {
+	hs := &History{
+		versions: map[string]map[uint32][]Version{
+			ChangeUser:     make(map[uint32][]Version),
+			ChangeLocation: make(map[uint32][]Version),
+			ChangeVisit:    make(map[uint32][]Version),
+		},
+		retention:      retention,
+		userVisits:     make(map[uint32]map[uint32]bool),
+		locationVisits: make(map[uint32]map[uint32]bool),
+		stop:           make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+	go hs.sweep()
+
+	return hs
+}
+
+func (hs *History) sweep() {
+	defer close(hs.done)
+
+	ticker := time.NewTicker(historySweep)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			hs.Sweep(time.Now().Unix())
+		case <-hs.stop:
+			return
+		}
+	}
+}
+
+// Close stops background sweeping, versions are kept
+func (hs *History) Close() {
+	if hs == nil {
+		return
+	}
+
+	select {
+	case <-hs.stop:
+	default:
+		close(hs.stop)
+	}
+	<-hs.done
+}
+
+// indexVisit adds visit to changed visits of its user and location
+func (hs *History) indexVisit(id uint32, data []byte) {
+	var v Visit
+	if data == nil || v.UnmarshalJSON(data) != nil {
+		return
+	}
+	if hs.userVisits[v.User] == nil {
+		hs.userVisits[v.User] = make(map[uint32]bool)
+	}
+	hs.userVisits[v.User][id] = true
+	if hs.locationVisits[v.Location] == nil {
+		hs.locationVisits[v.Location] = make(map[uint32]bool)
+	}
+	hs.locationVisits[v.Location][id] = true
+}
+
+// Record adds version of entity written now, before is nil for created
+// entities
+func (hs *History) Record(typ string, id uint32, before []byte, after []byte) {
+	if hs == nil {
+		return
+	}
+
+	now := time.Now().Unix()
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	vs := hs.versions[typ][id]
+	if len(vs) == 0 && before != nil {
+		vs = append(vs, Version{0, before})
+		if typ == ChangeVisit {
+			hs.indexVisit(id, before)
+		}
+	}
+	if typ == ChangeVisit {
+		hs.indexVisit(id, after)
+	}
+	// versions of the same second collapse into the last one
+	if n := len(vs); n > 0 && vs[n-1].At == now {
+		vs[n-1].Data = after
+	} else {
+		vs = append(vs, Version{now, after})
+	}
+	hs.versions[typ][id] = hs.prune(vs, now)
+}
+
+// prune collapses versions older than retention into state at its start
+func (hs *History) prune(vs []Version, now int64) []Version {
+	cut := now - int64(hs.retention/time.Second)
+	i := sort.Search(len(vs), func(i int) bool {
+		return vs[i].At > cut
+	}) - 1
+	if i < 0 || i == 0 && vs[0].At == 0 {
+		return vs
+	}
+
+	vs = append([]Version{{0, vs[i].Data}}, vs[i+1:]...)
+	return vs
+}
+
+// Sweep prunes versions of every entity older than retention, entities
+// left with the only version are current and lose history
+func (hs *History) Sweep(now int64) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	for _, versions := range hs.versions {
+		for id, vs := range versions {
+			vs = hs.prune(vs, now)
+			if len(vs) == 1 && vs[0].At == 0 {
+				delete(versions, id)
+				continue
+			}
+			versions[id] = vs
+		}
+	}
+
+	// pruned versions may hold visits of other users and locations
+	hs.userVisits = make(map[uint32]map[uint32]bool)
+	hs.locationVisits = make(map[uint32]map[uint32]bool)
+	for id, vs := range hs.versions[ChangeVisit] {
+		for _, v := range vs {
+			hs.indexVisit(id, v.Data)
+		}
+	}
+}
+
+// Versions returns versions of entity within retention window, ok is false
+// when entity has no history
+func (hs *History) Versions(typ string, id uint32) ([]Version, bool) {
+	if hs == nil {
+		return nil, false
+	}
+
+	hs.mu.RLock()
+	defer hs.mu.RUnlock()
+
+	vs, ok := hs.versions[typ][id]
+	if !ok {
+		return nil, false
+	}
+
+	return hs.prune(append([]Version{}, vs...), time.Now().Unix()), true
+}
+
+// At returns entity state at time, data is nil when entity did not exist.
+// ok is false when entity has no history, so current state holds
+func (hs *History) At(typ string, id uint32, at int64) (data []byte, ok bool) {
+	vs, ok := hs.Versions(typ, id)
+	if !ok {
+		return nil, false
+	}
+
+	i := sort.Search(len(vs), func(i int) bool {
+		return vs[i].At > at
+	}) - 1
+	if i < 0 {
+		return nil, true
+	}
+
+	return vs[i].Data, true
+}
+
+// ChangedVisits returns ids of changed visits which belonged to user
+// (byUser) or location within retention window
+func (hs *History) ChangedVisits(byUser bool, id uint32) []uint32 {
+	if hs == nil {
+		return nil
+	}
+
+	hs.mu.RLock()
+	defer hs.mu.RUnlock()
+
+	index := hs.locationVisits
+	if byUser {
+		index = hs.userVisits
+	}
+	ids := make([]uint32, 0, len(index[id]))
+	for vid := range index[id] {
+		ids = append(ids, vid)
+	}
+
+	return ids
+}
+
+// asOf reads asOf argument, past is false when history is not kept, then
+// asOf moves age reference only
+func (d Database) asOf(args *fasthttp.Args) (at int64, past bool, err error) {
+	if d.History == nil || !args.Has("asOf") {
+		return 0, false, nil
+	}
+	at, err = strconv.ParseInt(string(args.Peek("asOf")), 10, 64)
+
+	return at, err == nil, err
+}
+
+// UserAt returns user as of time
+func (d Database) UserAt(id uint32, at int64) (u User, ok bool) {
+	data, changed := d.History.At(ChangeUser, id, at)
+	if !changed {
+		return d.Users.Get(id)
+	}
+
+	return u, data != nil && u.UnmarshalJSON(data) == nil
+}
+
+// LocationAt returns location as of time
+func (d Database) LocationAt(id uint32, at int64) (l Location, ok bool) {
+	data, changed := d.History.At(ChangeLocation, id, at)
+	if !changed {
+		return d.Locations.Get(id)
+	}
+
+	return l, data != nil && l.UnmarshalJSON(data) == nil
+}
+
+// VisitAt returns visit as of time
+func (d Database) VisitAt(id uint32, at int64) (v Visit, ok bool) {
+	data, changed := d.History.At(ChangeVisit, id, at)
+	if !changed {
+		return d.Visits.Get(id)
+	}
+
+	return v, data != nil && v.UnmarshalJSON(data) == nil
+}
+
+// VisitsAt returns visits of user (byUser) or location as of time with
+// user and location fields filled in. Changed visits of id are checked
+// besides indexed ones, they could belong to it back then
+func (d Database) VisitsAt(byUser bool, id uint32, at int64) []Visit {
+	ids := d.LocationVisits.Get(id)
+	if byUser {
+		ids = d.UserVisit.Get(id)
+	}
+	seen := make(map[uint32]bool, len(ids))
+
+	var vs []Visit
+	for _, vid := range append(append([]uint32{}, ids...), d.History.ChangedVisits(byUser, id)...) {
+		if seen[vid] {
+			continue
+		}
+		seen[vid] = true
+
+		v, ok := d.VisitAt(vid, at)
+		if !ok || (byUser && v.User != id) || (!byUser && v.Location != id) {
+			continue
+		}
+		u, _ := d.UserAt(v.User, at)
+		l, _ := d.LocationAt(v.Location, at)
+
+		v.Birthday = u.Birthday
+		v.Gender = d.code(u.Gender)
+
+		v.Distance = l.Distance
+		v.Country, v.country = d.Dict.lookup(l.Country)
+		v.Lat = l.Lat
+		v.Lon = l.Lon
+
+		vs = append(vs, v)
+	}
+
+	return vs
+}
+
+// visitsOf returns visits of user (byUser) or location with user and
+// location fields filled in, as they were at asOf argument when history
+// is kept
+func (d Database) visitsOf(byUser bool, id uint32, args *fasthttp.Args) ([]Visit, error) {
+	at, past, err := d.asOf(args)
+	if err != nil {
+		return nil, ErrInvalid
+	}
+
+	var ok bool
+	switch {
+	case past && byUser:
+		_, ok = d.UserAt(id, at)
+	case past:
+		_, ok = d.LocationAt(id, at)
+	case byUser:
+		_, ok = d.Users.Get(id)
+	default:
+		_, ok = d.Locations.Get(id)
+	}
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	if past {
+		return d.VisitsAt(byUser, id, at), nil
+	}
+	if byUser {
+		return d.LoadVisits(d.UserVisit.Get(id)), nil
+	}
+	return d.LoadVisits(d.LocationVisits.Get(id)), nil
+}
+
+// Entity answers GET of entity with version as of asOf argument, current
+// requests go to h
+func (hs *History) Entity(typ string, h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	if hs == nil {
+		return h
+	}
+
+	return func(c *fasthttp.RequestCtx) {
+		args := c.QueryArgs()
+		if !args.Has("asOf") {
+			h(c)
+			return
+		}
+		at, err := strconv.ParseInt(string(args.Peek("asOf")), 10, 64)
+		if err != nil {
+			ErrorResponse(c, fasthttp.StatusBadRequest, false)
+			return
+		}
+		id, err := strconv.ParseUint(c.UserValue("id").(string), 10, 32)
+		if err != nil {
+			h(c)
+			return
+		}
+
+		data, changed := hs.At(typ, uint32(id), at)
+		if !changed {
+			h(c)
+			return
+		}
+		if data == nil {
+			ErrorResponse(c, fasthttp.StatusNotFound, false)
+			return
+		}
+		OkResponse(c, data, false)
+	}
+}
+
+// Handler lists versions of entity, unchanged ones have the only version
+func (hs *History) Handler(typ string, current func(id uint32) ([]byte, bool)) fasthttp.RequestHandler {
+	return func(c *fasthttp.RequestCtx) {
+		id, err := strconv.ParseUint(c.UserValue("id").(string), 10, 32)
+		if err != nil {
+			ErrorResponse(c, fasthttp.StatusNotFound, false)
+			return
+		}
+
+		vs, ok := hs.Versions(typ, uint32(id))
+		if !ok {
+			data, ok := current(uint32(id))
+			if !ok {
+				ErrorResponse(c, fasthttp.StatusNotFound, false)
+				return
+			}
+			vs = []Version{{0, data}}
+		}
+
+		r := Versions{vs}
+		response, _ := r.MarshalJSON()
+		OkResponse(c, response, false)
+	}
+}
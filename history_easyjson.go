@@ -0,0 +1,190 @@
+// Code generated by easyjson for marshaling/unmarshaling. DO NOT EDIT.
+
+package main
+
+import (
+	json "encoding/json"
+	easyjson "github.com/mailru/easyjson"
+	jlexer "github.com/mailru/easyjson/jlexer"
+	jwriter "github.com/mailru/easyjson/jwriter"
+)
+
+// suppress unused package warning
+var (
+	_ *json.RawMessage
+	_ *jlexer.Lexer
+	_ *jwriter.Writer
+	_ easyjson.Marshaler
+)
+
+func easyjson40eb0d12DecodeBitbucketOrgPdedkovHlcup(in *jlexer.Lexer, out *Versions) {
+	isTopLevel := in.IsStart()
+	if in.IsNull() {
+		if isTopLevel {
+			in.Consumed()
+		}
+		in.Skip()
+		return
+	}
+	in.Delim('{')
+	for !in.IsDelim('}') {
+		key := in.UnsafeFieldName(false)
+		in.WantColon()
+		if in.IsNull() {
+			in.Skip()
+			in.WantComma()
+			continue
+		}
+		switch key {
+		case "history":
+			if in.IsNull() {
+				in.Skip()
+				out.History = nil
+			} else {
+				in.Delim('[')
+				if out.History == nil {
+					if !in.IsDelim(']') {
+						out.History = make([]Version, 0, 2)
+					} else {
+						out.History = []Version{}
+					}
+				} else {
+					out.History = (out.History)[:0]
+				}
+				for !in.IsDelim(']') {
+					var v1 Version
+					(v1).UnmarshalEasyJSON(in)
+					out.History = append(out.History, v1)
+					in.WantComma()
+				}
+				in.Delim(']')
+			}
+		default:
+			in.SkipRecursive()
+		}
+		in.WantComma()
+	}
+	in.Delim('}')
+	if isTopLevel {
+		in.Consumed()
+	}
+}
+func easyjson40eb0d12EncodeBitbucketOrgPdedkovHlcup(out *jwriter.Writer, in Versions) {
+	out.RawByte('{')
+	first := true
+	_ = first
+	{
+		const prefix string = ",\"history\":"
+		out.RawString(prefix[1:])
+		if in.History == nil && (out.Flags&jwriter.NilSliceAsEmpty) == 0 {
+			out.RawString("null")
+		} else {
+			out.RawByte('[')
+			for v2, v3 := range in.History {
+				if v2 > 0 {
+					out.RawByte(',')
+				}
+				(v3).MarshalEasyJSON(out)
+			}
+			out.RawByte(']')
+		}
+	}
+	out.RawByte('}')
+}
+
+// MarshalJSON supports json.Marshaler interface
+func (v Versions) MarshalJSON() ([]byte, error) {
+	w := jwriter.Writer{}
+	easyjson40eb0d12EncodeBitbucketOrgPdedkovHlcup(&w, v)
+	return w.Buffer.BuildBytes(), w.Error
+}
+
+// MarshalEasyJSON supports easyjson.Marshaler interface
+func (v Versions) MarshalEasyJSON(w *jwriter.Writer) {
+	easyjson40eb0d12EncodeBitbucketOrgPdedkovHlcup(w, v)
+}
+
+// UnmarshalJSON supports json.Unmarshaler interface
+func (v *Versions) UnmarshalJSON(data []byte) error {
+	r := jlexer.Lexer{Data: data}
+	easyjson40eb0d12DecodeBitbucketOrgPdedkovHlcup(&r, v)
+	return r.Error()
+}
+
+// UnmarshalEasyJSON supports easyjson.Unmarshaler interface
+func (v *Versions) UnmarshalEasyJSON(l *jlexer.Lexer) {
+	easyjson40eb0d12DecodeBitbucketOrgPdedkovHlcup(l, v)
+}
+func easyjson40eb0d12DecodeBitbucketOrgPdedkovHlcup1(in *jlexer.Lexer, out *Version) {
+	isTopLevel := in.IsStart()
+	if in.IsNull() {
+		if isTopLevel {
+			in.Consumed()
+		}
+		in.Skip()
+		return
+	}
+	in.Delim('{')
+	for !in.IsDelim('}') {
+		key := in.UnsafeFieldName(false)
+		in.WantColon()
+		if in.IsNull() {
+			in.Skip()
+			in.WantComma()
+			continue
+		}
+		switch key {
+		case "at":
+			out.At = int64(in.Int64())
+		case "data":
+			(out.Data).UnmarshalEasyJSON(in)
+		default:
+			in.SkipRecursive()
+		}
+		in.WantComma()
+	}
+	in.Delim('}')
+	if isTopLevel {
+		in.Consumed()
+	}
+}
+func easyjson40eb0d12EncodeBitbucketOrgPdedkovHlcup1(out *jwriter.Writer, in Version) {
+	out.RawByte('{')
+	first := true
+	_ = first
+	{
+		const prefix string = ",\"at\":"
+		out.RawString(prefix[1:])
+		out.Int64(int64(in.At))
+	}
+	{
+		const prefix string = ",\"data\":"
+		out.RawString(prefix)
+		(in.Data).MarshalEasyJSON(out)
+	}
+	out.RawByte('}')
+}
+
+// MarshalJSON supports json.Marshaler interface
+func (v Version) MarshalJSON() ([]byte, error) {
+	w := jwriter.Writer{}
+	easyjson40eb0d12EncodeBitbucketOrgPdedkovHlcup1(&w, v)
+	return w.Buffer.BuildBytes(), w.Error
+}
+
+// MarshalEasyJSON supports easyjson.Marshaler interface
+func (v Version) MarshalEasyJSON(w *jwriter.Writer) {
+	easyjson40eb0d12EncodeBitbucketOrgPdedkovHlcup1(w, v)
+}
+
+// UnmarshalJSON supports json.Unmarshaler interface
+func (v *Version) UnmarshalJSON(data []byte) error {
+	r := jlexer.Lexer{Data: data}
+	easyjson40eb0d12DecodeBitbucketOrgPdedkovHlcup1(&r, v)
+	return r.Error()
+}
+
+// UnmarshalEasyJSON supports easyjson.Unmarshaler interface
+func (v *Version) UnmarshalEasyJSON(l *jlexer.Lexer) {
+	easyjson40eb0d12DecodeBitbucketOrgPdedkovHlcup1(l, v)
+}
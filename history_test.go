@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestHistoryRecord(t *testing.T) {
+	hs := NewHistory(time.Hour)
+	defer hs.Close()
+	now := time.Now().Unix()
+	hs.Record(ChangeUser, 1, []byte(`{"id":1,"v":0}`), []byte(`{"id":1,"v":1}`))
+	hs.Record(ChangeUser, 2, nil, []byte(`{"id":2}`))
+
+	tests := []struct {
+		id      uint32
+		at      int64
+		want    string
+		changed bool
+	}{
+		{1, now - 10, `{"id":1,"v":0}`, true},
+		{1, now + 10, `{"id":1,"v":1}`, true},
+		// created entity did not exist before
+		{2, now - 10, "", true},
+		{2, now, `{"id":2}`, true},
+		{3, now, "", false},
+	}
+	for _, tt := range tests {
+		data, changed := hs.At(ChangeUser, tt.id, tt.at)
+		if string(data) != tt.want || changed != tt.changed {
+			t.Errorf("At(%d, %d) = %s, %v, want %s, %v", tt.id, tt.at, data, changed, tt.want, tt.changed)
+		}
+	}
+
+	// versions of the same second collapse
+	hs.Record(ChangeUser, 1, []byte(`{"id":1,"v":1}`), []byte(`{"id":1,"v":2}`))
+	if vs, _ := hs.Versions(ChangeUser, 1); len(vs) != 2 || string(vs[1].Data) != `{"id":1,"v":2}` {
+		t.Errorf("versions %+v", vs)
+	}
+
+	// sweep past retention leaves current state only
+	hs.Sweep(now + 2*3600)
+	for _, id := range []uint32{1, 2} {
+		if _, changed := hs.At(ChangeUser, id, now); changed {
+			t.Errorf("user %d has history after sweep", id)
+		}
+	}
+}
+
+func TestHistoryClose(t *testing.T) {
+	hs := NewHistory(time.Hour)
+	hs.Close()
+	// closing again is a no-op
+	hs.Close()
+	select {
+	case <-hs.done:
+	default:
+		t.Error("sweeping not stopped")
+	}
+
+	var none *History
+	none.Close()
+}
+
+func TestHistoryChangedVisits(t *testing.T) {
+	hs := NewHistory(time.Hour)
+	defer hs.Close()
+	now := time.Now().Unix()
+	// visit 1 moved from user 1 to user 2, visit 2 created at location 5
+	hs.Record(ChangeVisit, 1, []byte(`{"id":1,"user":1,"location":3}`), []byte(`{"id":1,"user":2,"location":3}`))
+	hs.Record(ChangeVisit, 2, nil, []byte(`{"id":2,"user":2,"location":5}`))
+
+	tests := []struct {
+		byUser bool
+		id     uint32
+		want   string
+	}{
+		{true, 1, "[1]"},
+		{true, 2, "[1 2]"},
+		{true, 3, "[]"},
+		{false, 3, "[1]"},
+		{false, 5, "[2]"},
+	}
+	check := func() {
+		for _, tt := range tests {
+			ids := hs.ChangedVisits(tt.byUser, tt.id)
+			sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+			if got := fmt.Sprint(ids); got != tt.want {
+				t.Errorf("ChangedVisits(%v, %d) = %s, want %s", tt.byUser, tt.id, got, tt.want)
+			}
+		}
+	}
+	check()
+	// sweep within retention keeps index
+	hs.Sweep(now)
+	check()
+
+	hs.Sweep(now + 2*3600)
+	for _, tt := range tests {
+		if ids := hs.ChangedVisits(tt.byUser, tt.id); len(ids) != 0 {
+			t.Errorf("ChangedVisits(%v, %d) = %v after sweep", tt.byUser, tt.id, ids)
+		}
+	}
+
+	var none *History
+	if none.ChangedVisits(true, 1) != nil {
+		t.Error("nil history has changed visits")
+	}
+}
+
+func TestVisitsAt(t *testing.T) {
+	d := newTestDatabase(t, StorageMap)
+	d.SetUser(User{ID: 1, Email: "a@example.com", Gender: "m"})
+	d.SetUser(User{ID: 2, Email: "b@example.com", Gender: "f"})
+	d.SetLocation(Location{ID: 1, Place: "Музей", Country: "Россия", Distance: 10})
+	d.SetVisit(Visit{ID: 1, User: 1, Location: 1, Visited: 1000000000, Mark: 4})
+	// loaded data is state from before history
+	d.History = NewHistory(time.Hour)
+	defer d.History.Close()
+	before := time.Now().Unix() - 1
+
+	if err := d.UpsertVisit("1", []byte(`{"user":2,"mark":1}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.UpsertVisit("new", []byte(`{"id":2,"user":1,"location":1,"visited_at":1000000100,"mark":5}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		user uint32
+		asOf int64
+		want string
+	}{
+		{1, before, "[4]"},
+		{2, before, "[]"},
+		{1, 0, "[5]"},
+		{2, 0, "[1]"},
+	}
+	for _, tt := range tests {
+		args := &fasthttp.Args{}
+		if tt.asOf != 0 {
+			args.Set("asOf", strconv.FormatInt(tt.asOf, 10))
+		}
+		vs, err := d.UserVisits(tt.user, args)
+		marks := make([]int, 0)
+		for _, v := range vs {
+			marks = append(marks, v.Mark)
+		}
+		if got := fmt.Sprint(marks); err != nil || got != tt.want {
+			t.Errorf("UserVisits(%d, asOf %d) = %s, %v, want %s", tt.user, tt.asOf, got, err, tt.want)
+		}
+	}
+}
+
+func TestHistoryHandlers(t *testing.T) {
+	hs := NewHistory(time.Hour)
+	defer hs.Close()
+	hs.Record(ChangeUser, 1, []byte(`{"id":1,"v":0}`), []byte(`{"id":1,"v":1}`))
+	current := func(id uint32) ([]byte, bool) {
+		if id == 2 {
+			return []byte(`{"id":2}`), true
+		}
+		return nil, false
+	}
+	entity := hs.Entity(ChangeUser, func(c *fasthttp.RequestCtx) {
+		OkResponse(c, []byte("current"), false)
+	})
+	list := hs.Handler(ChangeUser, current)
+
+	tests := []struct {
+		h    fasthttp.RequestHandler
+		id   string
+		uri  string
+		code int
+		want string
+	}{
+		{entity, "1", "/users/1", 200, "current"},
+		{entity, "1", "/users/1?asOf=1", 200, `{"id":1,"v":0}`},
+		{entity, "2", "/users/2?asOf=1", 200, "current"},
+		{entity, "1", "/users/1?asOf=x", 400, "{}"},
+		{list, "2", "/users/2/history", 200, `{"history":[{"at":0,"data":{"id":2}}]}`},
+		{list, "3", "/users/3/history", 404, "{}"},
+	}
+	for _, tt := range tests {
+		var c fasthttp.RequestCtx
+		c.Request.SetRequestURI(tt.uri)
+		c.SetUserValue("id", tt.id)
+		tt.h(&c)
+		if c.Response.StatusCode() != tt.code || string(c.Response.Body()) != tt.want {
+			t.Errorf("%s: %d %s, want %d %s", tt.uri, c.Response.StatusCode(), c.Response.Body(), tt.code, tt.want)
+		}
+	}
+	var c fasthttp.RequestCtx
+	c.SetUserValue("id", "1")
+	list(&c)
+	var vs Versions
+	if err := vs.UnmarshalJSON(c.Response.Body()); err != nil || len(vs.History) != 2 || vs.History[0].At != 0 {
+		t.Errorf("history of changed user %s", c.Response.Body())
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import "sync"
+
+const (
+	// noCode never matches interned string, used for filters on unknown text
+	noCode = ^uint32(0)
+	// rawCode marks string kept raw as dictionary was full
+	rawCode = noCode - 1
+)
+
+// dictLimit caps dictionary, cities and countries posted past it are
+// kept as raw strings
+const dictLimit = 1 << 16
+
+// Dict interns repeated strings into small integer codes, code 0 is empty
+// string. Codes are never freed, so dictionary stops growing at limit and
+// strings new past it are not interned. As it never shrinks either, a
+// string kept raw once is never interned later
+type Dict struct {
+	mu    sync.RWMutex
+	codes map[string]uint32
+	strs  []string
+	limit int
+}
+
+// NewDict returns dictionary of at most limit strings, genders are
+// interned upfront so they always have a code
+func NewDict(limit int) *Dict {
+	d := &Dict{codes: map[string]uint32{"": 0}, strs: []string{""}, limit: limit}
+	d.Intern("f")
+	d.Intern("m")
+
+	return d
+}
+
+// Intern returns code of s, adding it to dictionary if needed, ok is
+// false when s is new and dictionary is full
+func (d *Dict) Intern(s string) (uint32, bool) {
+	if c, ok := d.Code(s); ok {
+		return c, true
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if c, ok := d.codes[s]; ok {
+		return c, true
+	}
+	if len(d.strs) >= d.limit {
+		return rawCode, false
+	}
+	c := uint32(len(d.strs))
+	d.codes[s] = c
+	d.strs = append(d.strs, s)
+
+	return c, true
+}
+
+// intern returns code of s or rawCode with s when it is not interned
+func (d *Dict) intern(s string) (uint32, string) {
+	if c, ok := d.Intern(s); ok {
+		return c, ""
+	}
+	return rawCode, s
+}
+
+// lookup returns code of s or rawCode with s when it is not interned,
+// without adding it
+func (d *Dict) lookup(s string) (uint32, string) {
+	if c, ok := d.Code(s); ok {
+		return c, ""
+	}
+	return rawCode, s
+}
+
+// Code returns code of s without adding it
+func (d *Dict) Code(s string) (uint32, bool) {
+	d.mu.RLock()
+	c, ok := d.codes[s]
+	d.mu.RUnlock()
+
+	return c, ok
+}
+
+// String decodes code back to string
+func (d *Dict) String(c uint32) string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if int64(c) >= int64(len(d.strs)) {
+		return ""
+	}
+
+	return d.strs[c]
+}
+
+// Len returns number of interned strings
+func (d *Dict) Len() int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return len(d.strs)
+}
+
+// user is User as kept in store, gender interned
+type user struct {
+	ID        uint32
+	FirstName string
+	LastName  string
+	Email     string
+	Gender    uint32
+	Birthday  int64
+}
+
+// location is Location as kept in store, country and city interned, text
+// holds them raw when dictionary was full
+type location struct {
+	ID       uint32
+	Distance int
+	Country  uint32
+	City     uint32
+	Place    string
+	Lat      *float64
+	Lon      *float64
+	text     *locationText
+}
+
+// locationText is raw country and city of location not interned
+type locationText struct {
+	Country string
+	City    string
+}
+
+// country returns raw country text, empty when it is interned
+func (l location) country() string {
+	if l.text == nil {
+		return ""
+	}
+	return l.text.Country
+}
+
+func (d *Dict) user(u User) user {
+	g, _ := d.Intern(u.Gender)
+	return user{u.ID, u.FirstName, u.LastName, u.Email, g, u.Birthday}
+}
+
+func (d *Dict) User(u user) User {
+	return User{u.ID, u.FirstName, u.LastName, u.Email, d.String(u.Gender), u.Birthday}
+}
+
+func (d *Dict) location(l Location) location {
+	rec := location{ID: l.ID, Distance: l.Distance, Place: l.Place, Lat: l.Lat, Lon: l.Lon}
+	var text locationText
+	rec.Country, text.Country = d.intern(l.Country)
+	rec.City, text.City = d.intern(l.City)
+	if rec.Country == rawCode || rec.City == rawCode {
+		rec.text = &text
+	}
+
+	return rec
+}
+
+func (d *Dict) Location(l location) Location {
+	country, city := d.String(l.Country), d.String(l.City)
+	if l.text != nil {
+		if l.Country == rawCode {
+			country = l.text.Country
+		}
+		if l.City == rawCode {
+			city = l.text.City
+		}
+	}
+
+	return Location{l.ID, l.Distance, country, city, l.Place, l.Lat, l.Lon}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestDict(t *testing.T) {
+	d := NewDict(5)
+	tests := []struct {
+		s    string
+		code uint32
+	}{
+		{"", 0},
+		{"f", 1},
+		{"m", 2},
+		{"Россия", 3},
+		{"Россия", 3},
+		{"россия", 4},
+	}
+	for _, tt := range tests {
+		if c, ok := d.Intern(tt.s); c != tt.code || !ok {
+			t.Errorf("Intern(%q) = %d, want %d", tt.s, c, tt.code)
+		}
+		if s := d.String(tt.code); s != tt.s {
+			t.Errorf("String(%d) = %q, want %q", tt.code, s, tt.s)
+		}
+	}
+	if _, ok := d.Code("Франция"); ok {
+		t.Error("Code added string")
+	}
+	if s := d.String(noCode); s != "" {
+		t.Errorf("String(noCode) = %q", s)
+	}
+
+	// full dictionary keeps known strings only
+	if c, ok := d.Intern("Франция"); ok || c != rawCode {
+		t.Errorf("Intern past limit = %d, %v", c, ok)
+	}
+	if c, ok := d.Intern("Россия"); !ok || c != 3 {
+		t.Errorf("Intern(Россия) past limit = %d, %v", c, ok)
+	}
+	if d.Len() != 5 {
+		t.Errorf("Len() = %d, want 5", d.Len())
+	}
+}
+
+func TestDictBounded(t *testing.T) {
+	for _, kind := range []string{StorageMap, StorageDense} {
+		db := newTestDatabase(t, kind)
+		db.SetUser(User{ID: 1, Gender: "m"})
+		db.SetLocation(Location{ID: 1, Country: "Россия", City: "Москва", Place: "Музей"})
+		n := db.Dict.Len()
+
+		// clients posting new places, cities and countries do not grow
+		// dictionary past its limit
+		for i := 0; i < dictLimit; i++ {
+			db.SetLocation(Location{ID: 1, Country: "Страна " + strconv.Itoa(i%100), City: "Город " + strconv.Itoa(i), Place: "Место " + strconv.Itoa(i)})
+		}
+		if db.Dict.Len() != dictLimit {
+			t.Errorf("%s: dictionary grew from %d to %d", kind, n, db.Dict.Len())
+		}
+		db.SetLocation(Location{ID: 2, Country: "Атлантида", City: "Город последний", Place: "Место"})
+		db.SetVisit(Visit{ID: 1, User: 1, Location: 2})
+		db.SetVisit(Visit{ID: 2, User: 1, Location: 1})
+
+		l, _ := db.Locations.Get(1)
+		if l.Country != "Страна 35" || l.City != "Город 65535" || l.Place != "Место 65535" {
+			t.Errorf("%s: location %+v", kind, l)
+		}
+		l, _ = db.Locations.Get(2)
+		if l.Country != "Атлантида" || l.City != "Город последний" {
+			t.Errorf("%s: raw location %+v", kind, l)
+		}
+
+		// raw countries are filtered by text
+		visits := db.LoadVisits([]uint32{1, 2})
+		for country, want := range map[string]uint32{"Атлантида": 1, "Страна 35": 2} {
+			var args fasthttp.Args
+			args.Set("country", country)
+			conditions, err := db.ParseFilters(&args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := db.FilterVisits(conditions, visits); len(got) != 1 || got[0].ID != want {
+				t.Errorf("%s: country %s matched %+v", kind, country, got)
+			}
+		}
+	}
+}
@@ -1,23 +1,29 @@
 package main
 
 import (
+	"archive/zip"
 	"bufio"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"github.com/buaazp/fasthttprouter"
 	"github.com/mailru/easyjson"
-	"github.com/mholt/archiver"
 	log "github.com/sirupsen/logrus"
 	"github.com/valyala/fasthttp"
+	"google.golang.org/grpc"
+	"io"
 	"io/ioutil"
+	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime"
-	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
-	"unicode/utf8"
 )
 
 // path to zip folder
@@ -27,7 +33,7 @@ const zipPath = "/tmp/data/"
 const dataPath = "/root/data/"
 //const dataPath = "/tmp/data/data/"
 
-// port
+// default port
 const port = ":80"
 //const port = ":8080"
 
@@ -66,11 +72,13 @@ type Users struct {
 // Location struct
 //easyjson:json
 type Location struct {
-	ID       uint32 `json:"id"`
-	Distance int    `json:"distance"`
-	Country  string `json:"country"`
-	City     string `json:"city"`
-	Place    string `json:"place"`
+	ID       uint32   `json:"id"`
+	Distance int      `json:"distance"`
+	Country  string   `json:"country"`
+	City     string   `json:"city"`
+	Place    string   `json:"place"`
+	Lat      *float64 `json:"lat,omitempty"`
+	Lon      *float64 `json:"lon,omitempty"`
 }
 
 //easyjson:json
@@ -80,6 +88,8 @@ type RawLocation struct {
 	Country  easyjson.RawMessage `json:"country"`
 	City     easyjson.RawMessage `json:"city"`
 	Place    easyjson.RawMessage `json:"place"`
+	Lat      easyjson.RawMessage `json:"lat"`
+	Lon      easyjson.RawMessage `json:"lon"`
 }
 
 // Locations is an array of location
@@ -90,15 +100,18 @@ type Locations struct {
 // Visit struct contain user locations visits
 //easyjson:json
 type Visit struct {
-	ID       uint32 `json:"id"`
-	User     uint32 `json:"user"`
-	Location uint32 `json:"location"`
-	Visited  int    `json:"visited_at"`
-	Mark     int    `json:"mark"`
-	Age      int    `json:"-"`
-	Gender   string `json:"-"`
-	Country  string `json:"-"`
-	Distance int    `json:"-"`
+	ID       uint32   `json:"id"`
+	User     uint32   `json:"user"`
+	Location uint32   `json:"location"`
+	Visited  int      `json:"visited_at"`
+	Mark     int      `json:"mark"`
+	Birthday int64    `json:"-"`
+	Gender   uint32   `json:"-"`
+	Country  uint32   `json:"-"`
+	Distance int      `json:"-"`
+	Lat      *float64 `json:"-"`
+	Lon      *float64 `json:"-"`
+	country  string   // raw country when not interned
 }
 
 //easyjson:json
@@ -116,11 +129,112 @@ type Visits struct {
 }
 
 type Database struct {
-	Locations      map[uint32]Location
-	Users          map[uint32]User
-	Visits         map[uint32]Visit
-	UserVisit      map[uint32]map[uint32]uint32
-	LocationVisits map[uint32]map[uint32]uint32
+	Locations      LocationStore
+	Users          UserStore
+	Visits         VisitStore
+	UserVisit      VisitIndex
+	LocationVisits VisitIndex
+	Emails         *EmailIndex
+	Search         *SearchIndex
+	Geo            *GeoIndex
+	Ages           *AgeClock
+	Cache          *ResponseCache
+	Dict           *Dict
+	Changes        *ChangeFeed
+	History        *History
+
+	// serializes writes, snapshots hold it to see consistent state
+	mu *sync.Mutex
+}
+
+// SetUser stores user and keeps email index in sync
+func (d Database) SetUser(u User) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.setUser(u)
+}
+
+func (d Database) setUser(u User) {
+	old, _ := d.Users.Get(u.ID)
+	before, _ := d.Users.JSON(u.ID)
+	d.Emails.Set(old.Email, u.Email, u.ID)
+	d.Users.Set(u)
+	d.invalidateUser(old, u)
+
+	after, _ := d.Users.JSON(u.ID)
+	d.Changes.Append(ChangeUser, u.ID, before, after)
+	d.History.Record(ChangeUser, u.ID, before, after)
+}
+
+// SetLocation stores location and reindexes its text
+func (d Database) SetLocation(l Location) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.setLocation(l)
+}
+
+func (d Database) setLocation(l Location) {
+	before, _ := d.Locations.JSON(l.ID)
+	d.Search.Set(l)
+	d.Geo.Set(l)
+	d.Locations.Set(l)
+	d.invalidateLocation(l)
+
+	after, _ := d.Locations.JSON(l.ID)
+	d.Changes.Append(ChangeLocation, l.ID, before, after)
+	d.History.Record(ChangeLocation, l.ID, before, after)
+}
+
+// SetVisit stores visit and moves it between user and location indexes
+func (d Database) SetVisit(v Visit) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.setVisit(v)
+}
+
+func (d Database) setVisit(v Visit) {
+	before, _ := d.Visits.JSON(v.ID)
+	if old, ok := d.Visits.Get(v.ID); ok {
+		d.UserVisit.Remove(old.User, v.ID)
+		d.LocationVisits.Remove(old.Location, v.ID)
+		d.invalidateVisit(old)
+	}
+
+	d.UserVisit.Add(v.User, v.ID)
+	d.LocationVisits.Add(v.Location, v.ID)
+	d.Visits.Set(v)
+	d.invalidateVisit(v)
+
+	after, _ := d.Visits.JSON(v.ID)
+	d.Changes.Append(ChangeVisit, v.ID, before, after)
+	d.History.Record(ChangeVisit, v.ID, before, after)
+}
+
+// DeleteVisit removes visit from store and indexes, cluster moves visits
+// to shard of their new user this way
+func (d Database) DeleteVisit(id uint32) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.deleteVisit(id)
+}
+
+func (d Database) deleteVisit(id uint32) {
+	old, ok := d.Visits.Get(id)
+	if !ok {
+		return
+	}
+	before, _ := d.Visits.JSON(id)
+	d.UserVisit.Remove(old.User, id)
+	d.LocationVisits.Remove(old.Location, id)
+	d.Visits.Delete(id)
+	d.invalidateVisit(old)
+
+	d.Changes.Append(ChangeVisit, id, before, nil)
+	d.History.Record(ChangeVisit, id, before, nil)
 }
 
 // ValidateFilter validates passed filters
@@ -145,12 +259,21 @@ func (d Database) ParseFilters(args *fasthttp.Args) (map[string]interface{}, err
 		conditions["toDate"] = v
 	}
 
+	// ages turn into birth date bounds against reference time
+	ref := d.Ages.Now()
+	if args.Has("asOf") {
+		ref, err = strconv.ParseInt(string(args.Peek("asOf")), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	if args.Has("fromAge") {
 		v, err = strconv.Atoi(string(args.Peek("fromAge")))
 		if err != nil {
 			return nil, err
 		}
-		conditions["fromAge"] = v
+		conditions["fromAge"] = d.Ages.Cut(ref, v)
 	}
 
 	if args.Has("toAge") {
@@ -158,7 +281,7 @@ func (d Database) ParseFilters(args *fasthttp.Args) (map[string]interface{}, err
 		if err != nil {
 			return nil, err
 		}
-		conditions["toAge"] = v
+		conditions["toAge"] = d.Ages.Cut(ref, v)
 	}
 
 	if args.Has("gender") {
@@ -166,11 +289,12 @@ func (d Database) ParseFilters(args *fasthttp.Args) (map[string]interface{}, err
 		if g != "m" && g != "f" {
 			return nil, fmt.Errorf("Gender fail")
 		}
-		conditions["gender"] = g
+		conditions["gender"] = d.code(g)
 	}
 	if args.Has("country") {
 		c, _ := url.QueryUnescape(string(args.Peek("country")))
-		conditions["country"] = c
+		code, text := d.Dict.lookup(c)
+		conditions["country"] = countryFilter{code, text}
 	}
 
 	if args.Has("toDistance") {
@@ -181,9 +305,54 @@ func (d Database) ParseFilters(args *fasthttp.Args) (map[string]interface{}, err
 		conditions["toDistance"] = v
 	}
 
+	if args.Has("near") {
+		g, err := ParseGeoCircle(string(args.Peek("near")))
+		if err != nil {
+			return nil, err
+		}
+		conditions["near"] = g
+	}
+
 	return conditions, nil
 }
 
+// countryFilter is country condition, text is set for countries kept raw
+type countryFilter struct {
+	code uint32
+	text string
+}
+
+// code returns interned code of filter value, unknown values match nothing
+func (d Database) code(s string) uint32 {
+	if c, ok := d.Dict.Code(s); ok {
+		return c
+	}
+	return noCode
+}
+
+// LoadVisits returns indexed visits with user and location fields filled in
+func (d Database) LoadVisits(ids []uint32) []Visit {
+	vs := make([]Visit, 0, len(ids))
+	for _, vID := range ids {
+		t, _ := d.Visits.Get(vID)
+		u, _ := d.Users.Entry(t.User)
+		l, _ := d.Locations.Entry(t.Location)
+
+		t.Birthday = u.Birthday
+		t.Gender = u.Gender
+
+		t.Distance = l.Distance
+		t.Country = l.Country
+		t.country = l.country()
+		t.Lat = l.Lat
+		t.Lon = l.Lon
+
+		vs = append(vs, t)
+	}
+
+	return vs
+}
+
 // Filter visits in database
 func (d Database) FilterVisits(conditions map[string]interface{}, recs []Visit) []Visit {
 	var out []Visit
@@ -202,12 +371,12 @@ func (d Database) FilterVisits(conditions map[string]interface{}, recs []Visit)
 			}
 		}
 		if v, ok = conditions["fromAge"]; ok {
-			if rec.Age < v.(int) {
+			if rec.Birthday >= v.(int64) {
 				continue
 			}
 		}
 		if v, ok = conditions["toAge"]; ok {
-			if rec.Age >= v.(int) {
+			if rec.Birthday < v.(int64) {
 				continue
 			}
 		}
@@ -217,13 +386,19 @@ func (d Database) FilterVisits(conditions map[string]interface{}, recs []Visit)
 			}
 		}
 		if v, ok = conditions["gender"]; ok {
-			if rec.Gender != v.(string) {
+			if rec.Gender != v.(uint32) {
 				continue
 			}
 		}
 
 		if v, ok = conditions["country"]; ok {
-			if rec.Country != v.(string) {
+			if f := v.(countryFilter); rec.Country != f.code || rec.country != f.text {
+				continue
+			}
+		}
+
+		if v, ok = conditions["near"]; ok {
+			if rec.Lat == nil || rec.Lon == nil || !v.(GeoCircle).Contains(*rec.Lat, *rec.Lon) {
 				continue
 			}
 		}
@@ -278,17 +453,77 @@ func loadData(path string, v interface{}) error {
 	return nil
 }
 
-func calcAge(now int64, bd int64) int {
-	y, _, _ := time.Unix(now-bd, 0).Date()
+// unzip extracts files of zip archive into dir, entries pointing outside
+// of it are rejected
+func unzip(path string, dir string) error {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for _, f := range r.File {
+		name := filepath.Join(dir, f.Name)
+		if !strings.HasPrefix(name, filepath.Clean(dir)+string(os.PathSeparator)) {
+			return fmt.Errorf("%s: entry %s outside of %s", path, f.Name, dir)
+		}
+		if f.FileInfo().IsDir() {
+			if err := os.MkdirAll(name, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			return err
+		}
+		if err := unzipFile(f, name); err != nil {
+			return err
+		}
+	}
 
-	return y - 1970
+	return nil
+}
+
+func unzipFile(f *zip.File, name string) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	out, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, rc)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// AvgMark returns average mark rounded half up to 5 digits
+func AvgMark(sum, count int) float64 {
+	if count == 0 {
+		return 0
+	}
+
+	avg := float64(sum) / float64(count)
+	tmp := int(avg * 100000)
+	last := int(avg*1000000) - tmp*10
+	if last >= 5 {
+		tmp++
+	}
+
+	return float64(tmp) / 100000
 }
 
 func ErrorResponse(c *fasthttp.RequestCtx, code int, close bool) {
 	c.Response.Header.Set("Content-Type", "application/json")
 	c.Response.SetStatusCode(code)
 	c.Write([]byte(`{}`))
-	if close {
+	if close && config.CloseOnWrite {
 		c.SetConnectionClose()
 	}
 }
@@ -297,26 +532,113 @@ func OkResponse(c *fasthttp.RequestCtx, body []byte, close bool) {
 	c.Response.Header.Set("Content-Type", "application/json")
 	c.Response.SetStatusCode(fasthttp.StatusOK)
 	c.Write(body)
-	if close {
+	if close && config.CloseOnWrite {
 		c.SetConnectionClose()
 	}
 }
 
+// prefix of user lookup by email, served by clashingRoutes because it
+// clashes with /users/:id
+var usersByEmailPrefix = []byte("/users/by-email/")
+
 func main() {
+	flag.Parse()
+
 	var Db Database
-	Db.Locations = make(map[uint32]Location)
-	Db.Users = make(map[uint32]User)
-	Db.Visits = make(map[uint32]Visit)
-	Db.UserVisit = make(map[uint32]map[uint32]uint32)
-	Db.LocationVisits = make(map[uint32]map[uint32]uint32)
+	if err := Db.InitStorage(config.Storage); err != nil {
+		panic(err)
+	}
+	Db.Emails = NewEmailIndex()
+	Db.Search = NewSearchIndex()
+	Db.Geo = NewGeoIndex()
+	if config.CacheSize > 0 {
+		Db.Cache = NewResponseCache(config.CacheSize)
+	}
+	var cluster *Cluster
+	if config.Shards != "" {
+		cl, err := NewCluster(strings.Split(config.Shards, ","), config.Shard, config.ClusterSecret)
+		if err != nil {
+			panic(err)
+		}
+		cluster = cl
+	}
+
+	// listen right away, requests get 503 until data is ready
+	warmup := NewWarmup()
+	deadLetter := io.Writer(os.Stderr)
+	if config.WebhookDeadLetter != "" {
+		f, err := os.OpenFile(config.WebhookDeadLetter, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			panic(err)
+		}
+		defer f.Close()
+		deadLetter = f
+	}
+	auth, err := LoadAuth()
+	if err != nil {
+		panic(err)
+	}
+	if cluster != nil {
+		auth.Trust(cluster)
+	}
+	webhooks := NewWebhooks(config.WebhookRetries, config.WebhookBackoff, deadLetter)
+	var audit *Audit
+	if config.AuditBuffer > 0 {
+		var auditLog io.Writer
+		if config.AuditLog != "" {
+			f, err := os.OpenFile(config.AuditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+			if err != nil {
+				panic(err)
+			}
+			defer f.Close()
+			auditLog = f
+		}
+		trusted, err := resolveHosts(strings.Split(config.TrustedProxies, ","))
+		if err != nil {
+			panic(err)
+		}
+		for ip := range cluster.Peers() {
+			trusted[ip] = true
+		}
+		audit = NewAudit(config.AuditBuffer, auditLog, trusted)
+	}
+	if config.AdminAddr != "" {
+		admin := http.NewServeMux()
+		admin.Handle("/metrics", metrics.Handler(&Db, warmup))
+		admin.Handle("/admin/status", warmup.AdminHandler(&Db))
+		admin.Handle("/admin/webhooks", webhooks.AdminHandler())
+		if audit != nil {
+			admin.Handle("/admin/audit", audit.AdminHandler())
+		}
+		go func() {
+			log.Fatal(http.ListenAndServe(config.AdminAddr, auth.Admin(admin)))
+		}()
+	}
+	server := NewServer(warmup.Handler)
+	ln, err := Listen()
+	if err != nil {
+		panic(err)
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(ln)
+	}()
 
 	var m runtime.MemStats
+	start := time.Now()
 
 	// prepare database
-	// unzip
-	err := archiver.Zip.Open(zipPath+"data.zip", dataPath)
-	if err != nil {
-		panic(err)
+	// final snapshot of previous run takes place of data.zip
+	dataDir := dataPath
+	if config.SnapshotDir != "" && HasSnapshot(config.SnapshotDir) {
+		dataDir = strings.TrimRight(config.SnapshotDir, "/") + "/"
+		log.Printf("load snapshot from %s", dataDir)
+	} else {
+		// unzip
+		err = unzip(zipPath+"data.zip", dataPath)
+		if err != nil {
+			panic(err)
+		}
 	}
 	// load timestamp
 	f, err := os.Open(zipPath + "options.txt")
@@ -333,6 +655,10 @@ func main() {
 		}
 		f.Close()
 	}
+	if config.Now != 0 {
+		NOW = config.Now
+		log.Printf("get timestamp from -now %d", NOW)
+	}
 	if NOW == 0 {
 		log.Printf("open fail: %s", dataPath+"options.txt")
 		info, err := os.Stat(zipPath)
@@ -344,11 +670,15 @@ func main() {
 			log.Printf("get timestamp from mtime %d", NOW)
 		}
 	}
+	Db.Ages, err = NewAgeClock(config.Clock, NOW)
+	if err != nil {
+		panic(err)
+	}
 
 	// load data to structs
 	for key, value := range dataMap {
 		for i := 1; ; i++ {
-			path := fmt.Sprintf(dataPath+value, i)
+			path := fmt.Sprintf(dataDir+value, i)
 			if _, err := os.Stat(path); os.IsNotExist(err) {
 				break
 			}
@@ -361,17 +691,22 @@ func main() {
 					panic(err)
 				}
 				for _, r := range l.Records {
-					Db.Locations[r.ID] = r
+					Db.SetLocation(r)
 				}
+				warmup.AddFile(path, len(l.Records))
 			case "users":
 				var u Users
 				err = loadData(path, &u)
 				if err != nil {
 					panic(err)
 				}
+				// other shards own the rest
 				for _, v := range u.Records {
-					Db.Users[v.ID] = v
+					if cluster.Owns(v.ID) {
+						Db.SetUser(v)
+					}
 				}
+				warmup.AddFile(path, len(u.Records))
 			case "visits":
 				var v Visits
 				err = loadData(path, &v)
@@ -379,514 +714,405 @@ func main() {
 					panic(err)
 				}
 				for _, r := range v.Records {
-					r.Age = calcAge(NOW, Db.Users[r.User].Birthday)
-
-					r.Gender = Db.Users[r.User].Gender
-
-					r.Distance = Db.Locations[r.Location].Distance
-					r.Country = Db.Locations[r.Location].Country
-
-					Db.Visits[r.ID] = r
+					if cluster.Owns(r.User) {
+						Db.SetVisit(r)
+					}
 				}
+				warmup.AddFile(path, len(v.Records))
 			default:
 				panic(fmt.Errorf("something went wrong"))
 			}
 		}
 	}
-	log.Print("Data loaded")
+	log.Printf("Data loaded into %s storage", config.Storage)
+	// they keep shared email, nobody else can take it while one of them has it
+	for email, ids := range Db.Emails.Shared() {
+		log.Printf("email %s is shared by users %v", email, ids)
+	}
 
 	runtime.ReadMemStats(&m)
 	log.Printf("Alloc=%v Sys=%v NumGC=%v", m.Alloc/1024, m.Sys/1024, m.NumGC)
 
-	for _, value := range Db.Visits {
-		if _, ok := Db.UserVisit[value.User]; !ok {
-			Db.UserVisit[value.User] = make(map[uint32]uint32)
-		}
-		Db.UserVisit[value.User][value.ID]++
-
-		if _, ok := Db.LocationVisits[value.Location]; !ok {
-			Db.LocationVisits[value.Location] = make(map[uint32]uint32)
-		}
-		Db.LocationVisits[value.Location][value.ID]++
-	}
 	log.Print("Data ready")
+	metrics.SetLoadDuration(time.Since(start))
 
 	runtime.ReadMemStats(&m)
 	log.Printf("Alloc=%v Sys=%v NumGC =%v", m.Alloc/1024, m.Sys/1024, m.NumGC)
 
+	var compressor *Compressor
+	if config.Compress != "" {
+		compressor, err = NewCompressor(config.Compress, config.CompressMin, config.CompressLevel, config.CacheSize)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	// loaded data is state from before history
+	if config.HistoryRetention > 0 {
+		Db.History = NewHistory(config.HistoryRetention)
+	}
+
+	// follower serves reads and forwards writes to leader
+	var follower *Follower
+	switch config.Role {
+	case RoleStandalone, RoleLeader:
+	case RoleFollower:
+		if config.Leader == "" || config.LeaderAPI == "" {
+			panic("follower needs -leader and -leader-api")
+		}
+		follower = NewFollower(&Db, config.Leader, config.LeaderAPI, config.ReplicationSecret)
+	default:
+		panic(fmt.Sprintf("unknown role %q", config.Role))
+	}
+
 	router := fasthttprouter.New()
-	router.GET("/users/:id", func(c *fasthttp.RequestCtx) {
+	get := func(path string, h fasthttp.RequestHandler) {
+		router.GET(path, metrics.Instrument("GET", path, auth.Guard("GET", path, AccessRead, h)))
+	}
+	post := func(path string, need Access, h fasthttp.RequestHandler) {
+		router.POST(path, metrics.Instrument("POST", path, auth.Guard("POST", path, need, h)))
+	}
+	write := func(path string, h fasthttp.RequestHandler) {
+		post(path, AccessWrite, follower.Forward(h))
+	}
+	// GET routes clashing with wildcards of router
+	clashing := make(map[string]fasthttp.RequestHandler)
+	getClashing := func(path, route string, h fasthttp.RequestHandler) {
+		clashing[path] = metrics.Instrument("GET", route, auth.Guard("GET", route, AccessRead, h))
+	}
+
+	// gRPC reads of cluster are served by the same handlers, so they are
+	// routed to shards
+	reads := map[string]fasthttp.RequestHandler{}
+	reads["/users/:id"] = cluster.ByUser(Db.History.Entity(ChangeUser, func(c *fasthttp.RequestCtx) {
 		id, err := strconv.Atoi(c.UserValue("id").(string))
 
 		if err != nil {
 			ErrorResponse(c, fasthttp.StatusNotFound, false)
 			return
 		}
-		if _, ok := Db.Users[uint32(id)]; !ok {
+		response, ok := Db.Users.JSON(uint32(id))
+		if !ok {
 			ErrorResponse(c, fasthttp.StatusNotFound, false)
 			return
 		}
 
-		response, _ := Db.Users[uint32(id)].MarshalJSON()
-		OkResponse(c, response, false)
+		compressor.Entity(c, EntityUser, uint32(id), response)
 		return
-	})
-
-	router.GET("/visits/:id", func(c *fasthttp.RequestCtx) {
-		id, err := strconv.Atoi(c.UserValue("id").(string))
+	}))
+	get("/users/:id", reads["/users/:id"])
+	if Db.History != nil {
+		get("/users/:id/history", cluster.ByUser(Db.History.Handler(ChangeUser, Db.Users.JSON)))
+	}
 
-		if err != nil {
-			ErrorResponse(c, fasthttp.StatusNotFound, false)
-			return
-		}
-		if _, ok := Db.Visits[uint32(id)]; !ok {
+	getClashing(string(usersByEmailPrefix), "/users/by-email/:email", cluster.Any(func(c *fasthttp.RequestCtx) {
+		id, ok := Db.Emails.Get(string(c.Path()[len(usersByEmailPrefix):]))
+		if !ok {
 			ErrorResponse(c, fasthttp.StatusNotFound, false)
 			return
 		}
 
-		response, _ := Db.Visits[uint32(id)].MarshalJSON()
-		OkResponse(c, response, false)
+		response, _ := Db.Users.JSON(id)
+		compressor.Entity(c, EntityUser, id, response)
 		return
-	})
+	}))
 
-	router.GET("/locations/:id", func(c *fasthttp.RequestCtx) {
+	reads["/visits/:id"] = cluster.Any(Db.History.Entity(ChangeVisit, func(c *fasthttp.RequestCtx) {
 		id, err := strconv.Atoi(c.UserValue("id").(string))
 
 		if err != nil {
 			ErrorResponse(c, fasthttp.StatusNotFound, false)
 			return
 		}
-		if _, ok := Db.Locations[uint32(id)]; !ok {
+		response, ok := Db.Visits.JSON(uint32(id))
+		if !ok {
 			ErrorResponse(c, fasthttp.StatusNotFound, false)
 			return
 		}
 
-		response, _ := Db.Locations[uint32(id)].MarshalJSON()
-		OkResponse(c, response, false)
+		compressor.Entity(c, EntityVisit, uint32(id), response)
 		return
-	})
+	}))
+	get("/visits/:id", reads["/visits/:id"])
 
-	router.GET("/users/:id/visits", func(c *fasthttp.RequestCtx) {
-		id, err := strconv.Atoi(c.UserValue("id").(string))
-		if err != nil {
-			ErrorResponse(c, fasthttp.StatusNotFound, false)
-			return
-		}
-
-		if _, ok := Db.Users[uint32(id)]; !ok {
-			ErrorResponse(c, fasthttp.StatusNotFound, false)
-			return
-		}
-		v := make([]ShortVisit, 0)
-		filters, err := Db.ParseFilters(c.QueryArgs())
-		if err != nil {
+	getClashing("/locations/search", "/locations/search", func(c *fasthttp.RequestCtx) {
+		q := string(c.QueryArgs().Peek("q"))
+		if len(q) == 0 {
 			ErrorResponse(c, fasthttp.StatusBadRequest, false)
 			return
 		}
 
-		if _, ok := Db.UserVisit[uint32(id)]; ok {
-			var vs []Visit
-			for vID, cnt := range Db.UserVisit[uint32(id)] {
-				if cnt <= 0 {
-					continue
-				}
-
-				t := Db.Visits[vID]
-
-				t.Age = calcAge(NOW, Db.Users[t.User].Birthday)
-				t.Gender = Db.Users[t.User].Gender
-
-				t.Distance = Db.Locations[t.Location].Distance
-				t.Country = Db.Locations[t.Location].Country
-
-				vs = append(vs, t)
-			}
-			recs := Db.FilterVisits(filters, vs)
-
-			for _, value := range recs {
-				v = append(v, ShortVisit{
-					value.Mark,
-					value.Visited,
-					Db.Locations[value.Location].Place,
-				})
+		limit := searchLimit
+		if c.QueryArgs().Has("limit") {
+			l, err := strconv.Atoi(string(c.QueryArgs().Peek("limit")))
+			if err != nil || l <= 0 || l > searchMaxLimit {
+				ErrorResponse(c, fasthttp.StatusBadRequest, false)
+				return
 			}
-			sort.Sort(ByVisited(v))
+			limit = l
 		}
-		r := ShortVisits{v}
 
+		r := SearchResult{Db.SearchLocations(q, limit)}
 		response, _ := r.MarshalJSON()
-
 		OkResponse(c, response, false)
 		return
 	})
 
-	router.GET("/locations/:id/avg", func(c *fasthttp.RequestCtx) {
-		var sum, count int
-		var avg float64
-
-		id, err := strconv.Atoi(c.UserValue("id").(string))
-		if err != nil {
-			ErrorResponse(c, fasthttp.StatusNotFound, false)
-			return
-		}
-
-		if _, ok := Db.Locations[uint32(id)]; !ok {
-			ErrorResponse(c, fasthttp.StatusNotFound, false)
+	getClashing("/locations/near", "/locations/near", func(c *fasthttp.RequestCtx) {
+		args := c.QueryArgs()
+		if !args.Has("lat") || !args.Has("lon") || !args.Has("radius") {
+			ErrorResponse(c, fasthttp.StatusBadRequest, false)
 			return
 		}
-
-		filters, err := Db.ParseFilters(c.QueryArgs())
+		circle, err := ParseGeoCircle(string(args.Peek("lat")) + "," + string(args.Peek("lon")) + "," + string(args.Peek("radius")))
 		if err != nil {
 			ErrorResponse(c, fasthttp.StatusBadRequest, false)
 			return
 		}
 
-		if _, ok := Db.LocationVisits[uint32(id)]; ok {
-			var vs []Visit
-			for vID, cnt := range Db.LocationVisits[uint32(id)] {
-				if cnt <= 0 {
-					continue
-				}
-				t := Db.Visits[vID]
-
-				t.Age = calcAge(NOW, Db.Users[t.User].Birthday)
-				t.Gender = Db.Users[t.User].Gender
-
-				t.Distance = Db.Locations[t.Location].Distance
-				t.Country = Db.Locations[t.Location].Country
-
-				vs = append(vs, t)
-			}
-			recs := Db.FilterVisits(filters, vs)
-			if err != nil {
+		limit := nearLimit
+		if args.Has("limit") {
+			l, err := strconv.Atoi(string(args.Peek("limit")))
+			if err != nil || l <= 0 || l > nearMaxLimit {
 				ErrorResponse(c, fasthttp.StatusBadRequest, false)
 				return
 			}
-
-			for _, rec := range recs {
-				sum += rec.Mark
-				count++
-			}
-
-			if count > 0 {
-				avg = float64(sum) / float64(count)
-				tmp := int(avg * 100000)
-				last := int(avg*1000000) - tmp*10
-				if last >= 5 {
-					tmp++
-				}
-				avg = float64(tmp) / 100000
-			}
+			limit = l
 		}
 
-		A := Avg{avg}
-		response, _ := A.MarshalJSON()
-
+		r := NearResult{Db.NearLocations(circle, limit)}
+		response, _ := r.MarshalJSON()
 		OkResponse(c, response, false)
 		return
 	})
 
-	router.POST("/users/:id", func(c *fasthttp.RequestCtx) {
+	get("/locations/:id", Db.History.Entity(ChangeLocation, func(c *fasthttp.RequestCtx) {
 		id, err := strconv.Atoi(c.UserValue("id").(string))
 
-		if c.UserValue("id").(string) != "new" && err != nil {
-			ErrorResponse(c, fasthttp.StatusNotFound, true)
-			return
-		}
-
-		var u User
-		var str string
-		t := RawUser{}
-
-		if err := t.UnmarshalJSON(c.PostBody()); err != nil {
-			ErrorResponse(c, fasthttp.StatusBadRequest, true)
-			return
-		}
-
-		if string(t.ID) == "null" || string(t.Gender) == "null" || string(t.Birthday) == "null" || string(t.FirstName) == "null" || string(t.LastName) == "null" || string(t.Email) == "null" {
-			ErrorResponse(c, fasthttp.StatusBadRequest, true)
-			return
-		}
-
-		if c.UserValue("id").(string) != "new" {
-			if _, ok := Db.Users[uint32(id)]; !ok {
-				ErrorResponse(c, fasthttp.StatusNotFound, true)
-				return
-			}
-			u = Db.Users[uint32(id)]
-		} else {
-			u = User{}
-		}
-		if len(t.ID) > 0 {
-			tId, err := strconv.Atoi(string(t.ID))
-			if err != nil {
-				ErrorResponse(c, fasthttp.StatusBadRequest, true)
-				return
-			}
-			u.ID = uint32(tId)
-		}
-		if c.UserValue("id").(string) != "new" && u.ID != uint32(id) {
-			ErrorResponse(c, fasthttp.StatusBadRequest, true)
-			return
-		}
-
-		if len(t.FirstName) > 0 {
-			str, _ = strconv.Unquote(string(t.FirstName))
-			u.FirstName = strings.Trim(str, "\"")
-		}
-		if utf8.RuneCountInString(u.FirstName) > 50 {
-			ErrorResponse(c, fasthttp.StatusBadRequest, true)
-			return
-		}
-
-		if len(t.LastName) > 0 {
-			str, _ = strconv.Unquote(string(t.LastName))
-			u.LastName = strings.Trim(str, "\"")
-		}
-		if utf8.RuneCountInString(u.LastName) > 50 {
-			ErrorResponse(c, fasthttp.StatusBadRequest, true)
-			return
-		}
-
-		if len(t.Gender) > 0 {
-			str, _ = strconv.Unquote(string(t.Gender))
-			u.Gender = strings.Trim(str, "\"")
-		}
-		if u.Gender != "f" && u.Gender != "m" {
-			ErrorResponse(c, fasthttp.StatusBadRequest, true)
-			return
-		}
-
-		if len(t.Birthday) > 0 {
-			u.Birthday, err = strconv.ParseInt(string(t.Birthday), 10, 64)
-			if err != nil {
-				ErrorResponse(c, fasthttp.StatusBadRequest, true)
-				return
-			}
-		}
-
-		if u.Birthday < -1262304000 || u.Birthday > 915235199 {
-			ErrorResponse(c, fasthttp.StatusBadRequest, true)
+		if err != nil {
+			ErrorResponse(c, fasthttp.StatusNotFound, false)
 			return
 		}
-
-		if len(t.Email) > 0 {
-			str, _ = strconv.Unquote(string(t.Email))
-			u.Email = strings.Trim(str, "\"")
-		}
-		if utf8.RuneCountInString(u.Email) > 100 {
-			ErrorResponse(c, fasthttp.StatusBadRequest, true)
+		response, ok := Db.Locations.JSON(uint32(id))
+		if !ok {
+			ErrorResponse(c, fasthttp.StatusNotFound, false)
 			return
 		}
-		Db.Users[u.ID] = u
 
-		OkResponse(c, []byte(`{}`), true)
+		compressor.Entity(c, EntityLocation, uint32(id), response)
 		return
-	})
+	}))
 
-	router.POST("/visits/:id", func(c *fasthttp.RequestCtx) {
+	reads["/users/:id/visits"] = cluster.ByUser(Db.Cached(CacheUserVisits, func(c *fasthttp.RequestCtx) {
 		id, err := strconv.Atoi(c.UserValue("id").(string))
-
-		if c.UserValue("id").(string) != "new" && err != nil {
-			ErrorResponse(c, fasthttp.StatusNotFound, true)
+		if err != nil {
+			ErrorResponse(c, fasthttp.StatusNotFound, false)
 			return
 		}
 
-		var v Visit
-		t := RawVisit{}
-
-		if err = t.UnmarshalJSON(c.PostBody()); err != nil {
-			ErrorResponse(c, fasthttp.StatusBadRequest, true)
+		v, err := Db.UserVisits(uint32(id), c.QueryArgs())
+		if err != nil {
+			ErrorResponse(c, errorStatus(err), false)
 			return
 		}
+		r := ShortVisits{v}
 
-		if string(t.ID) == "null" || string(t.User) == "null" || string(t.Location) == "null" || string(t.Visited) == "null" || string(t.Mark) == "null" {
-			ErrorResponse(c, fasthttp.StatusBadRequest, true)
-			return
-		}
+		response, _ := r.MarshalJSON()
 
-		var oldUser, oldLocation uint32
-		var ok bool
+		OkResponse(c, response, false)
+		return
+	}))
+	get("/users/:id/visits", reads["/users/:id/visits"])
 
-		if c.UserValue("id").(string) == "new" {
-			v = Visit{}
-		} else {
-			if _, ok = Db.Visits[uint32(id)]; !ok {
-				ErrorResponse(c, fasthttp.StatusNotFound, true)
-				return
-			}
-			v = Db.Visits[uint32(id)]
-		}
-		if len(t.ID) > 0 {
-			tId, err := strconv.Atoi(string(t.ID))
+	// merged averages of cluster are not cached
+	if cluster == nil {
+		reads["/locations/:id/avg"] = Db.Cached(CacheLocationAvg, func(c *fasthttp.RequestCtx) {
+			id, err := strconv.Atoi(c.UserValue("id").(string))
 			if err != nil {
-				ErrorResponse(c, fasthttp.StatusBadRequest, true)
+				ErrorResponse(c, fasthttp.StatusNotFound, false)
 				return
 			}
-			v.ID = uint32(tId)
-		}
-		if c.UserValue("id").(string) != "new" && v.ID != uint32(id) {
-			ErrorResponse(c, fasthttp.StatusBadRequest, true)
-			return
-		}
-		if len(t.User) > 0 {
-			if v.User > 0 {
-				oldUser = v.User
-			}
-			tId, err := strconv.Atoi(string(t.User))
+
+			avg, err := Db.LocationAvg(uint32(id), c.QueryArgs())
 			if err != nil {
-				ErrorResponse(c, fasthttp.StatusBadRequest, true)
+				ErrorResponse(c, errorStatus(err), false)
 				return
 			}
-			v.User = uint32(tId)
-		}
 
-		if _, ok = Db.Users[v.User]; !ok {
-			ErrorResponse(c, fasthttp.StatusBadRequest, true)
-			return
-		}
+			A := Avg{avg}
+			response, _ := A.MarshalJSON()
 
-		if len(t.Location) > 0 {
-			if v.Location > 0 {
-				oldLocation = v.Location
-			}
-			tId, err := strconv.Atoi(string(t.Location))
-			if err != nil {
-				ErrorResponse(c, fasthttp.StatusBadRequest, true)
-				return
-			}
-			v.Location = uint32(tId)
-		}
-		if _, ok = Db.Locations[v.Location]; !ok {
-			ErrorResponse(c, fasthttp.StatusBadRequest, true)
+			OkResponse(c, response, false)
 			return
-		}
+		})
+	} else {
+		reads["/locations/:id/avg"] = cluster.LocationAvg(&Db)
+		get("/locations/:id/sum", cluster.SumHandler(&Db))
+	}
+	get("/locations/:id/avg", reads["/locations/:id/avg"])
 
-		if len(t.Visited) > 0 {
-			v.Visited, err = strconv.Atoi(string(t.Visited))
-			if err != nil {
-				ErrorResponse(c, fasthttp.StatusBadRequest, true)
-				return
-			}
+	timeline := func(c *fasthttp.RequestCtx, byUser bool) {
+		id, err := strconv.Atoi(c.UserValue("id").(string))
+		if err != nil {
+			ErrorResponse(c, fasthttp.StatusNotFound, false)
+			return
 		}
-		if v.Visited < 946684800 || v.Visited > 1420156799 {
-			ErrorResponse(c, fasthttp.StatusBadRequest, true)
+		visits, err := Db.visitsOf(byUser, uint32(id), c.QueryArgs())
+		if err != nil {
+			ErrorResponse(c, errorStatus(err), false)
 			return
 		}
 
-		if len(t.Mark) > 0 {
-			v.Mark, err = strconv.Atoi(string(t.Mark))
-			if err != nil {
-				ErrorResponse(c, fasthttp.StatusBadRequest, true)
-				return
-			}
+		filters, err := Db.ParseFilters(c.QueryArgs())
+		if err != nil {
+			ErrorResponse(c, fasthttp.StatusBadRequest, false)
+			return
 		}
-		if v.Mark < 0 || v.Mark > 5 {
-			ErrorResponse(c, fasthttp.StatusBadRequest, true)
+		bucket, loc, err := ParseTimelineArgs(c.QueryArgs())
+		if err != nil {
+			ErrorResponse(c, fasthttp.StatusBadRequest, false)
 			return
 		}
 
-		if _, ok = Db.UserVisit[oldUser][v.ID]; ok && oldUser > 0 {
-			Db.UserVisit[oldUser][v.ID]--
-		}
+		r := Timeline{MakeTimeline(Db.FilterVisits(filters, visits), bucket, loc)}
+		response, _ := r.MarshalJSON()
 
-		if _, ok = Db.LocationVisits[oldLocation][v.ID]; ok && oldLocation > 0 {
-			Db.LocationVisits[oldLocation][v.ID]--
-		}
+		OkResponse(c, response, false)
+		return
+	}
 
-		if _, ok = Db.UserVisit[v.User]; !ok {
-			Db.UserVisit[v.User] = make(map[uint32]uint32)
-		}
-		Db.UserVisit[v.User][v.ID]++
+	get("/users/:id/timeline", cluster.ByUser(Db.Cached(CacheUserTimeline, func(c *fasthttp.RequestCtx) {
+		timeline(c, true)
+	})))
+
+	// timeline of location needs visits of every shard
+	if cluster == nil {
+		get("/locations/:id/timeline", Db.Cached(CacheLocationTimeline, func(c *fasthttp.RequestCtx) {
+			timeline(c, false)
+		}))
+	} else {
+		get("/locations/:id/timeline", cluster.Unsupported)
+	}
 
-		if _, ok = Db.LocationVisits[v.Location]; !ok {
-			Db.LocationVisits[v.Location] = make(map[uint32]uint32)
+	// gRPC upserts are served by the same handlers, it checks access and
+	// rejects writes to follower itself
+	writes := map[string]fasthttp.RequestHandler{}
+	writes[ChangeUser] = cluster.ByUser(audit.Wrap(ChangeUser, Db.Users.JSON, func(c *fasthttp.RequestCtx) {
+		if err := Db.UpsertUser(c.UserValue("id").(string), c.PostBody()); err != nil {
+			ErrorResponse(c, errorStatus(err), true)
+			return
 		}
-		Db.LocationVisits[v.Location][v.ID]++
-
-		Db.Visits[v.ID] = v
 
 		OkResponse(c, []byte(`{}`), true)
 		return
-	})
+	}))
 
-	router.POST("/locations/:id", func(c *fasthttp.RequestCtx) {
-		id, err := strconv.Atoi(c.UserValue("id").(string))
-
-		if c.UserValue("id").(string) != "new" && err != nil {
-			ErrorResponse(c, fasthttp.StatusNotFound, true)
-			return
-		}
-		var l Location
-		t := RawLocation{}
-		var u string
-		if err = t.UnmarshalJSON(c.PostBody()); err != nil {
-			ErrorResponse(c, fasthttp.StatusBadRequest, true)
-			return
-		}
-		if string(t.ID) == "null" || string(t.Distance) == "null" || string(t.Country) == "null" || string(t.City) == "null" || string(t.Place) == "null" {
-			ErrorResponse(c, fasthttp.StatusBadRequest, true)
+	writes[ChangeVisit] = cluster.VisitWrite(&Db, audit.Wrap(ChangeVisit, Db.Visits.JSON, func(c *fasthttp.RequestCtx) {
+		if err := Db.UpsertVisit(c.UserValue("id").(string), c.PostBody()); err != nil {
+			ErrorResponse(c, errorStatus(err), true)
 			return
 		}
 
-		if c.UserValue("id").(string) == "new" {
-			l = Location{}
-		} else {
-			if _, ok := Db.Locations[uint32(id)]; !ok {
-				ErrorResponse(c, fasthttp.StatusNotFound, true)
-				return
-			}
-			l = Db.Locations[uint32(id)]
-		}
-		if len(t.ID) > 0 {
-			tId, err := strconv.Atoi(string(t.ID))
-			if err != nil {
-				ErrorResponse(c, fasthttp.StatusBadRequest, true)
-				return
-			}
-			l.ID = uint32(tId)
-		}
+		OkResponse(c, []byte(`{}`), true)
+		return
+	}))
 
-		if c.UserValue("id").(string) != "new" && l.ID != uint32(id) {
-			ErrorResponse(c, fasthttp.StatusBadRequest, true)
+	writes[ChangeLocation] = cluster.Broadcast(audit.Wrap(ChangeLocation, Db.Locations.JSON, func(c *fasthttp.RequestCtx) {
+		if err := Db.UpsertLocation(c.UserValue("id").(string), c.PostBody()); err != nil {
+			ErrorResponse(c, errorStatus(err), true)
 			return
 		}
 
-		if len(t.Country) > 0 {
-			u, _ = strconv.Unquote(string(t.Country))
-			l.Country = strings.Trim(u, "\"")
+		OkResponse(c, []byte(`{}`), true)
+		return
+	}))
+
+	write("/users/:id", writes[ChangeUser])
+	write("/visits/:id", writes[ChangeVisit])
+	write("/locations/:id", writes[ChangeLocation])
+
+	// loaded data is not a change
+	if config.ChangesBuffer > 0 {
+		Db.Changes = NewChangeFeed(config.ChangesBuffer)
+		streamFor := 5 * time.Minute
+		if config.WriteTimeout > 0 {
+			streamFor = config.WriteTimeout * 9 / 10
+		}
+		get("/changes", Db.Changes.Handler(changesBatch, streamFor))
+		webhooks.Start(Db.Changes)
+	} else {
+		log.Print("change feed disabled, /changes and webhooks need -changes-buffer")
+	}
+
+	var repl io.Closer
+	if config.Role == RoleLeader {
+		// stream carries every entity, so it is not left open when API is not
+		if auth != nil && config.ReplicationSecret == "" {
+			panic("leader with authentication needs -replication-secret")
 		}
-		if utf8.RuneCountInString(l.Country) > 50 {
-			ErrorResponse(c, fasthttp.StatusBadRequest, true)
-			return
+		leader, err := ServeReplication(config.ReplicationAddr, &Db, config.ReplicationSecret)
+		if err != nil {
+			panic(err)
 		}
+		repl = leader
+	}
+	if follower != nil {
+		follower.Run()
+		repl = follower
+	}
 
-		if len(t.City) > 0 {
-			u, _ = strconv.Unquote(string(t.City))
-			l.City = strings.Trim(u, "\"")
+	// resolvers read local shard only
+	graphqlHandler := fasthttp.RequestHandler(cluster.Unsupported)
+	if cluster == nil {
+		schema, err := NewGraphQLSchema(&Db)
+		if err != nil {
+			panic(err)
 		}
-		if utf8.RuneCountInString(l.City) > 50 {
-			ErrorResponse(c, fasthttp.StatusBadRequest, true)
-			return
+		graphqlHandler = GraphQLHandler(schema, config.GraphQLMaxCost)
+	}
+	get("/graphql", graphqlHandler)
+	// queries only, mutations are not supported
+	post("/graphql", AccessRead, graphqlHandler)
+
+	handler := compressor.Wrap(Formats(clashingRoutes(clashing, router.Handler)))
+	var accessLog *AccessLog
+	if config.AccessLogRate > 0 {
+		accessLog = NewAccessLog(os.Stderr, config.AccessLogRate, config.AccessLogBuffer)
+		handler = accessLog.Wrap(handler)
+	}
+	var rpc *grpc.Server
+	if config.GRPCAddr != "" {
+		var interceptors []grpc.UnaryServerInterceptor
+		if auth != nil {
+			interceptors = append(interceptors, auth.UnaryInterceptor)
 		}
-
-		if len(t.Place) > 0 {
-			u, _ = strconv.Unquote(string(t.Place))
-			l.Place = strings.Trim(u, "\"")
+		if follower != nil {
+			interceptors = append(interceptors, follower.UnaryInterceptor)
 		}
-
-		if len(t.Distance) > 0 {
-			l.Distance, err = strconv.Atoi(string(t.Distance))
-			if err != nil {
-				ErrorResponse(c, fasthttp.StatusBadRequest, true)
-				return
-			}
+		// single node reads its own store directly
+		if cluster == nil {
+			reads = nil
 		}
-
-		Db.Locations[l.ID] = l
-
-		OkResponse(c, []byte(`{}`), true)
-		return
-	})
-	log.Fatal(fasthttp.ListenAndServe(port, router.Handler))
+		rpc, err = ServeGRPC(config.GRPCAddr, &Db, writes, reads, grpc.ChainUnaryInterceptor(interceptors...))
+		if err != nil {
+			panic(err)
+		}
+	}
+	if follower != nil {
+		log.Printf("Waiting for leader %s", config.Leader)
+		<-follower.Synced()
+	}
+	warmup.Ready(handler)
+	log.Print("Ready")
+
+	// nothing to lose before this point, so signals keep default behaviour
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-serveErr:
+		log.Fatal(err)
+	case sig := <-sigs:
+		log.Printf("%s received, shutting down", sig)
+	}
+	Shutdown(server, rpc, warmup, &Db, accessLog, webhooks, repl, cluster)
 }
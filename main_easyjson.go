@@ -604,6 +604,10 @@ func easyjson89aae3efDecodeBitbucketOrgPdedkovHlcup6(in *jlexer.Lexer, out *RawL
 			(out.City).UnmarshalEasyJSON(in)
 		case "place":
 			(out.Place).UnmarshalEasyJSON(in)
+		case "lat":
+			(out.Lat).UnmarshalEasyJSON(in)
+		case "lon":
+			(out.Lon).UnmarshalEasyJSON(in)
 		default:
 			in.SkipRecursive()
 		}
@@ -648,6 +652,18 @@ func easyjson89aae3efEncodeBitbucketOrgPdedkovHlcup6(out *jwriter.Writer, in Raw
 	first = false
 	out.RawString("\"place\":")
 	(in.Place).MarshalEasyJSON(out)
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"lat\":")
+	(in.Lat).MarshalEasyJSON(out)
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"lon\":")
+	(in.Lon).MarshalEasyJSON(out)
 	out.RawByte('}')
 }
 
@@ -703,6 +719,26 @@ func easyjson89aae3efDecodeBitbucketOrgPdedkovHlcup7(in *jlexer.Lexer, out *Loca
 			out.City = string(in.String())
 		case "place":
 			out.Place = string(in.String())
+		case "lat":
+			if in.IsNull() {
+				in.Skip()
+				out.Lat = nil
+			} else {
+				if out.Lat == nil {
+					out.Lat = new(float64)
+				}
+				*out.Lat = float64(in.Float64())
+			}
+		case "lon":
+			if in.IsNull() {
+				in.Skip()
+				out.Lon = nil
+			} else {
+				if out.Lon == nil {
+					out.Lon = new(float64)
+				}
+				*out.Lon = float64(in.Float64())
+			}
 		default:
 			in.SkipRecursive()
 		}
@@ -747,6 +783,22 @@ func easyjson89aae3efEncodeBitbucketOrgPdedkovHlcup7(out *jwriter.Writer, in Loc
 	first = false
 	out.RawString("\"place\":")
 	out.String(string(in.Place))
+	if in.Lat != nil {
+		if !first {
+			out.RawByte(',')
+		}
+		first = false
+		out.RawString("\"lat\":")
+		out.Float64(float64(*in.Lat))
+	}
+	if in.Lon != nil {
+		if !first {
+			out.RawByte(',')
+		}
+		first = false
+		out.RawString("\"lon\":")
+		out.Float64(float64(*in.Lon))
+	}
 	out.RawByte('}')
 }
 
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// user value holding metrics of the route being served
+const routeKey = "route"
+
+// request latency histogram buckets, seconds
+var latencyBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+// RouteMetrics are request counters of a single route
+type RouteMetrics struct {
+	Method string
+	Route  string
+
+	codes   [600]uint64
+	buckets []uint64
+	count   uint64
+	nanos   uint64
+}
+
+// Observe accounts served request
+func (r *RouteMetrics) Observe(code int, d time.Duration) {
+	if code >= 0 && code < len(r.codes) {
+		atomic.AddUint64(&r.codes[code], 1)
+	}
+	s := d.Seconds()
+	for i, b := range latencyBuckets {
+		if s <= b {
+			atomic.AddUint64(&r.buckets[i], 1)
+		}
+	}
+	atomic.AddUint64(&r.count, 1)
+	atomic.AddUint64(&r.nanos, uint64(d))
+}
+
+// Metrics collects request stats for prometheus
+type Metrics struct {
+	mu     sync.Mutex
+	routes map[string]*RouteMetrics
+
+	// nanoseconds spent on loading data and building indexes
+	loadNanos int64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{routes: make(map[string]*RouteMetrics)}
+}
+
+var metrics = NewMetrics()
+
+// SetLoadDuration records time spent on loading data
+func (m *Metrics) SetLoadDuration(d time.Duration) {
+	atomic.StoreInt64(&m.loadNanos, int64(d))
+}
+
+// Route returns metrics of route, creating them on first use
+func (m *Metrics) Route(method, route string) *RouteMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := method + " " + route
+	if _, ok := m.routes[key]; !ok {
+		m.routes[key] = &RouteMetrics{Method: method, Route: route, buckets: make([]uint64, len(latencyBuckets))}
+	}
+
+	return m.routes[key]
+}
+
+// Instrument counts requests served by h
+func (m *Metrics) Instrument(method, route string, h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	rm := m.Route(method, route)
+
+	return func(c *fasthttp.RequestCtx) {
+		start := time.Now()
+		c.SetUserValue(routeKey, rm)
+		h(c)
+		if r, ok := c.UserValue(routeKey).(*RouteMetrics); ok {
+			r.Observe(c.Response.StatusCode(), time.Since(start))
+		}
+	}
+}
+
+// Expose writes metrics in prometheus text format, database fields
+// assigned during warmup are read only once it is loaded
+func (m *Metrics) Expose(w io.Writer, d *Database, loaded bool) {
+	m.mu.Lock()
+	routes := make([]*RouteMetrics, 0, len(m.routes))
+	for _, r := range m.routes {
+		routes = append(routes, r)
+	}
+	m.mu.Unlock()
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Route != routes[j].Route {
+			return routes[i].Route < routes[j].Route
+		}
+		return routes[i].Method < routes[j].Method
+	})
+
+	fmt.Fprintln(w, "# HELP hlcup_requests_total Requests served by route and status code.")
+	fmt.Fprintln(w, "# TYPE hlcup_requests_total counter")
+	for _, r := range routes {
+		for code := range r.codes {
+			if n := atomic.LoadUint64(&r.codes[code]); n > 0 {
+				fmt.Fprintf(w, "hlcup_requests_total{method=%q,route=%q,code=\"%d\"} %d\n", r.Method, r.Route, code, n)
+			}
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP hlcup_request_duration_seconds Request latency by route.")
+	fmt.Fprintln(w, "# TYPE hlcup_request_duration_seconds histogram")
+	for _, r := range routes {
+		for i, b := range latencyBuckets {
+			fmt.Fprintf(w, "hlcup_request_duration_seconds_bucket{method=%q,route=%q,le=\"%g\"} %d\n", r.Method, r.Route, b, atomic.LoadUint64(&r.buckets[i]))
+		}
+		count := atomic.LoadUint64(&r.count)
+		fmt.Fprintf(w, "hlcup_request_duration_seconds_bucket{method=%q,route=%q,le=\"+Inf\"} %d\n", r.Method, r.Route, count)
+		fmt.Fprintf(w, "hlcup_request_duration_seconds_sum{method=%q,route=%q} %g\n", r.Method, r.Route, time.Duration(atomic.LoadUint64(&r.nanos)).Seconds())
+		fmt.Fprintf(w, "hlcup_request_duration_seconds_count{method=%q,route=%q} %d\n", r.Method, r.Route, count)
+	}
+
+	fmt.Fprintln(w, "# HELP hlcup_entities Entities stored in database.")
+	fmt.Fprintln(w, "# TYPE hlcup_entities gauge")
+	fmt.Fprintf(w, "hlcup_entities{type=\"users\"} %d\n", d.Users.Len())
+	fmt.Fprintf(w, "hlcup_entities{type=\"locations\"} %d\n", d.Locations.Len())
+	fmt.Fprintf(w, "hlcup_entities{type=\"visits\"} %d\n", d.Visits.Len())
+
+	fmt.Fprintln(w, "# HELP hlcup_index_size Keys in database indexes.")
+	fmt.Fprintln(w, "# TYPE hlcup_index_size gauge")
+	fmt.Fprintf(w, "hlcup_index_size{index=\"user_visits\"} %d\n", d.UserVisit.Len())
+	fmt.Fprintf(w, "hlcup_index_size{index=\"location_visits\"} %d\n", d.LocationVisits.Len())
+	fmt.Fprintf(w, "hlcup_index_size{index=\"emails\"} %d\n", d.Emails.Len())
+	fmt.Fprintf(w, "hlcup_index_size{index=\"search_terms\"} %d\n", d.Search.Len())
+	fmt.Fprintf(w, "hlcup_index_size{index=\"geo\"} %d\n", d.Geo.Len())
+	fmt.Fprintf(w, "hlcup_index_size{index=\"strings\"} %d\n", d.Dict.Len())
+
+	if d.Cache != nil {
+		fmt.Fprintf(w, "hlcup_index_size{index=\"response_cache\"} %d\n", d.Cache.Len())
+
+		fmt.Fprintln(w, "# HELP hlcup_cache_requests_total Response cache lookups by result.")
+		fmt.Fprintln(w, "# TYPE hlcup_cache_requests_total counter")
+		for kind, name := range cacheNames {
+			hits, misses := d.Cache.Stats(kind)
+			fmt.Fprintf(w, "hlcup_cache_requests_total{cache=%q,result=\"hit\"} %d\n", name, hits)
+			fmt.Fprintf(w, "hlcup_cache_requests_total{cache=%q,result=\"miss\"} %d\n", name, misses)
+		}
+	}
+
+	if loaded && d.Changes != nil {
+		fmt.Fprintln(w, "# HELP hlcup_changes_seq Sequence of last change in change feed.")
+		fmt.Fprintln(w, "# TYPE hlcup_changes_seq counter")
+		fmt.Fprintf(w, "hlcup_changes_seq %d\n", d.Changes.Last())
+	}
+
+	fmt.Fprintln(w, "# HELP hlcup_load_duration_seconds Time spent on loading data at startup.")
+	fmt.Fprintln(w, "# TYPE hlcup_load_duration_seconds gauge")
+	fmt.Fprintf(w, "hlcup_load_duration_seconds %g\n", time.Duration(atomic.LoadInt64(&m.loadNanos)).Seconds())
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	fmt.Fprintln(w, "# HELP go_goroutines Number of goroutines.")
+	fmt.Fprintln(w, "# TYPE go_goroutines gauge")
+	fmt.Fprintf(w, "go_goroutines %d\n", runtime.NumGoroutine())
+	fmt.Fprintln(w, "# HELP go_gc_cycles_total Completed GC cycles.")
+	fmt.Fprintln(w, "# TYPE go_gc_cycles_total counter")
+	fmt.Fprintf(w, "go_gc_cycles_total %d\n", ms.NumGC)
+	fmt.Fprintln(w, "# HELP go_gc_pause_seconds_total Total GC stop-the-world pause.")
+	fmt.Fprintln(w, "# TYPE go_gc_pause_seconds_total counter")
+	fmt.Fprintf(w, "go_gc_pause_seconds_total %g\n", time.Duration(ms.PauseTotalNs).Seconds())
+	fmt.Fprintln(w, "# HELP go_memstats_alloc_bytes Bytes of allocated heap objects.")
+	fmt.Fprintln(w, "# TYPE go_memstats_alloc_bytes gauge")
+	fmt.Fprintf(w, "go_memstats_alloc_bytes %d\n", ms.Alloc)
+	fmt.Fprintln(w, "# HELP go_memstats_sys_bytes Bytes obtained from system.")
+	fmt.Fprintln(w, "# TYPE go_memstats_sys_bytes gauge")
+	fmt.Fprintf(w, "go_memstats_sys_bytes %d\n", ms.Sys)
+	fmt.Fprintln(w, "# HELP go_memstats_heap_objects Number of allocated heap objects.")
+	fmt.Fprintln(w, "# TYPE go_memstats_heap_objects gauge")
+	fmt.Fprintf(w, "go_memstats_heap_objects %d\n", ms.HeapObjects)
+}
+
+// Handler serves /metrics on admin port
+func (m *Metrics) Handler(d *Database, warmup *Warmup) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		m.Expose(w, d, warmup.Loaded())
+	}
+}
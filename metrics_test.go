@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestMetricsExpose(t *testing.T) {
+	m := NewMetrics()
+	h := m.Instrument("GET", "/users/:id", func(c *fasthttp.RequestCtx) {
+		if string(c.Path()) == "/users/1" {
+			OkResponse(c, []byte(`{}`), false)
+			return
+		}
+		ErrorResponse(c, fasthttp.StatusNotFound, false)
+	})
+	for _, path := range []string{"/users/1", "/users/1", "/users/2"} {
+		var c fasthttp.RequestCtx
+		c.Request.SetRequestURI(path)
+		h(&c)
+	}
+	m.SetLoadDuration(1500 * time.Millisecond)
+
+	d := newTestDatabase(t, StorageMap)
+	d.SetUser(User{ID: 1, Email: "a@example.com"})
+	d.Changes = NewChangeFeed(10)
+	d.Changes.Append(ChangeUser, 1, nil, []byte(`{}`))
+
+	tests := []struct {
+		loaded bool
+		line   string
+		found  bool
+	}{
+		{false, `hlcup_requests_total{method="GET",route="/users/:id",code="200"} 2`, true},
+		{false, `hlcup_requests_total{method="GET",route="/users/:id",code="404"} 1`, true},
+		{false, `hlcup_request_duration_seconds_count{method="GET",route="/users/:id"} 3`, true},
+		{false, `hlcup_entities{type="users"} 1`, true},
+		{false, `hlcup_index_size{index="emails"} 1`, true},
+		{false, `hlcup_load_duration_seconds 1.5`, true},
+		{false, `hlcup_changes_seq 1`, false},
+		{true, `hlcup_changes_seq 1`, true},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		m.Expose(&buf, &d, tt.loaded)
+		if found := strings.Contains(buf.String(), tt.line+"\n"); found != tt.found {
+			t.Errorf("loaded %v: %q found %v, want %v", tt.loaded, tt.line, found, tt.found)
+		}
+	}
+}
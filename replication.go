@@ -0,0 +1,522 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// replication roles
+const (
+	RoleStandalone = "standalone"
+	RoleLeader     = "leader"
+	RoleFollower   = "follower"
+)
+
+// types of replication stream records besides entity changes: synced ends
+// snapshot or resume, ping keeps idle connection alive
+const (
+	replicationSynced = "synced"
+	replicationPing   = "ping"
+)
+
+// ping period of idle stream, followers reconnect after missing a few,
+// pause between reconnects
+const (
+	replicationHeartbeat = 5 * time.Second
+	replicationTimeout   = 3 * replicationHeartbeat
+	replicationRetry     = time.Second
+)
+
+// replicationChallenge is first line of leader, follower signs its nonce,
+// so a hello seen once cannot be replayed on another connection
+type replicationChallenge struct {
+	Nonce string `json:"nonce"`
+}
+
+// replicationHello opens stream in both directions. Follower sends epoch
+// and sequence it has applied, leader answers with its epoch and sequence
+// stream resumes from, snapshot is set when it sends all entities first.
+// With replication secret follower signs nonce of leader challenge
+type replicationHello struct {
+	Epoch    string `json:"epoch"`
+	Seq      uint64 `json:"seq"`
+	Snapshot bool   `json:"snapshot,omitempty"`
+	Auth     string `json:"auth,omitempty"`
+}
+
+// replicationNonce returns random challenge nonce
+func replicationNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// replicationSignature returns signature of follower hello to nonce
+func replicationSignature(secret string, nonce string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("REPLICATE\n" + nonce))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verify checks signature of follower hello to nonce, anything goes
+// without secret
+func (h *replicationHello) verify(secret string, nonce string) error {
+	if secret == "" {
+		return nil
+	}
+	sig, err := hex.DecodeString(h.Auth)
+	want, _ := hex.DecodeString(replicationSignature(secret, nonce))
+	if err != nil || !hmac.Equal(sig, want) {
+		return errors.New("bad hello signature")
+	}
+
+	return nil
+}
+
+// Leader streams change feed to followers over TCP. Stream is JSON lines:
+// hello, snapshot entities when follower cannot resume from the feed,
+// synced record and then changes as they happen
+type Leader struct {
+	d      *Database
+	ln     net.Listener
+	epoch  string
+	secret string
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+	stop  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// ServeReplication accepts followers on addr in background, changes come
+// from d.Changes, so change feed has to be enabled. Followers have to sign
+// their hello with secret unless it is empty
+func ServeReplication(addr string, d *Database, secret string) (*Leader, error) {
+	if d.Changes == nil {
+		return nil, errors.New("replication needs change feed")
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Leader{
+		d:  d,
+		ln: ln,
+		// feed starts from 0 on every run, so followers of the previous
+		// one have to take snapshot
+		epoch:  strconv.FormatInt(time.Now().UnixNano(), 36),
+		secret: secret,
+		conns:  make(map[net.Conn]struct{}),
+		stop:   make(chan struct{}),
+	}
+	l.wg.Add(1)
+	go l.serve()
+	log.Printf("replication listening on %s", addr)
+
+	return l, nil
+}
+
+func (l *Leader) serve() {
+	defer l.wg.Done()
+
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			select {
+			case <-l.stop:
+			default:
+				log.Printf("replication: %s", err)
+			}
+			return
+		}
+
+		l.mu.Lock()
+		l.conns[conn] = struct{}{}
+		l.mu.Unlock()
+		l.wg.Add(1)
+		go func() {
+			defer l.wg.Done()
+			if err := l.handle(conn); err != nil {
+				log.Printf("replication: follower %s: %s", conn.RemoteAddr(), err)
+			}
+			l.mu.Lock()
+			delete(l.conns, conn)
+			l.mu.Unlock()
+			conn.Close()
+		}()
+	}
+}
+
+func (l *Leader) handle(conn net.Conn) error {
+	nonce := replicationNonce()
+	data, _ := json.Marshal(replicationChallenge{nonce})
+	conn.SetWriteDeadline(time.Now().Add(replicationTimeout))
+	if _, err := conn.Write(append(data, '\n')); err != nil {
+		return err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(replicationTimeout))
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+	var hello replicationHello
+	if err := json.Unmarshal(line, &hello); err != nil {
+		return err
+	}
+	if err := hello.verify(l.secret, nonce); err != nil {
+		return err
+	}
+
+	feed := l.d.Changes
+	seq := hello.Seq
+	_, _, ok := feed.Since(seq, 0)
+	snapshot := hello.Epoch != l.epoch || !ok || seq > feed.Last()
+	var records []Change
+	if snapshot {
+		seq, records = l.snapshot()
+	}
+
+	// buffer flushes by itself while snapshot streams, so every write
+	// extends deadline and follower not reading it is dropped
+	w := bufio.NewWriter(conn)
+	write := func(ch Change) error {
+		data, _ := ch.MarshalJSON()
+		conn.SetWriteDeadline(time.Now().Add(replicationTimeout))
+		w.Write(data)
+		return w.WriteByte('\n')
+	}
+	flush := func() error {
+		conn.SetWriteDeadline(time.Now().Add(replicationTimeout))
+		return w.Flush()
+	}
+
+	data, _ = json.Marshal(replicationHello{Epoch: l.epoch, Seq: seq, Snapshot: snapshot})
+	w.Write(data)
+	w.WriteByte('\n')
+	if snapshot {
+		log.Printf("replication: sending snapshot at %d to %s", seq, conn.RemoteAddr())
+		for _, ch := range records {
+			if err := write(ch); err != nil {
+				return err
+			}
+		}
+	}
+	write(Change{Seq: seq, Type: replicationSynced})
+	if err := flush(); err != nil {
+		return err
+	}
+
+	heartbeat := time.NewTicker(replicationHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		changes, notify, ok := feed.Since(seq, changesBatch)
+		if !ok {
+			return fmt.Errorf("changes after %d overwritten, follower has to resync", seq)
+		}
+		for _, ch := range changes {
+			write(ch)
+			seq = ch.Seq
+		}
+		if len(changes) > 0 {
+			if err := flush(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		select {
+		case <-notify:
+		case <-heartbeat.C:
+			write(Change{Seq: seq, Type: replicationPing})
+			if err := flush(); err != nil {
+				return err
+			}
+		case <-l.stop:
+			return nil
+		}
+	}
+}
+
+// snapshot returns all entities as they are at returned sequence of change
+// feed. Writes wait for it, entities are marshalled already, so it only
+// collects them
+func (l *Leader) snapshot() (uint64, []Change) {
+	l.d.mu.Lock()
+	defer l.d.mu.Unlock()
+
+	records := make([]Change, 0, l.d.Users.Len()+l.d.Locations.Len()+l.d.Visits.Len())
+	// visits refer to users and locations, so they go last
+	l.d.Users.RangeJSON(func(b []byte) {
+		records = append(records, Change{Type: ChangeUser, After: b})
+	})
+	l.d.Locations.RangeJSON(func(b []byte) {
+		records = append(records, Change{Type: ChangeLocation, After: b})
+	})
+	l.d.Visits.RangeJSON(func(b []byte) {
+		records = append(records, Change{Type: ChangeVisit, After: b})
+	})
+
+	return l.d.Changes.Last(), records
+}
+
+// Close stops accepting followers and drops connected ones
+func (l *Leader) Close() error {
+	close(l.stop)
+	err := l.ln.Close()
+	l.mu.Lock()
+	for conn := range l.conns {
+		conn.Close()
+	}
+	l.mu.Unlock()
+	l.wg.Wait()
+
+	return err
+}
+
+// Follower applies changes streamed by leader and forwards writes to it.
+// Writes become visible on follower once leader streams them back
+type Follower struct {
+	d      *Database
+	leader string
+	api    *fasthttp.HostClient
+	secret string
+
+	mu    sync.Mutex
+	conn  net.Conn
+	epoch string
+	seq   uint64
+
+	synced chan struct{}
+	once   sync.Once
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// NewFollower replicates from leader replication address, signing hello
+// with secret, and forwards writes to leader API address
+func NewFollower(d *Database, leader string, api string, secret string) *Follower {
+	return &Follower{
+		d:      d,
+		leader: leader,
+		api:    &fasthttp.HostClient{Addr: api, ReadTimeout: config.ReadTimeout, WriteTimeout: config.WriteTimeout},
+		secret: secret,
+		synced: make(chan struct{}),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// Run keeps following leader in background, reconnecting on errors
+func (f *Follower) Run() {
+	go func() {
+		defer close(f.done)
+
+		for {
+			err := f.follow()
+			select {
+			case <-f.stop:
+				return
+			default:
+			}
+			log.Printf("replication: leader %s: %s", f.leader, err)
+
+			select {
+			case <-time.After(replicationRetry):
+			case <-f.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Synced is closed once follower has caught up with leader first time
+func (f *Follower) Synced() <-chan struct{} {
+	return f.synced
+}
+
+func (f *Follower) follow() error {
+	conn, err := net.DialTimeout("tcp", f.leader, replicationTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	f.mu.Lock()
+	select {
+	case <-f.stop:
+		f.mu.Unlock()
+		return nil
+	default:
+	}
+	f.conn = conn
+	req := replicationHello{Epoch: f.epoch, Seq: f.seq}
+	f.mu.Unlock()
+
+	r := bufio.NewReader(conn)
+	read := func() ([]byte, error) {
+		conn.SetReadDeadline(time.Now().Add(replicationTimeout))
+		return r.ReadBytes('\n')
+	}
+
+	line, err := read()
+	if err != nil {
+		return err
+	}
+	var challenge replicationChallenge
+	if err := json.Unmarshal(line, &challenge); err != nil {
+		return err
+	}
+	if f.secret != "" {
+		req.Auth = replicationSignature(f.secret, challenge.Nonce)
+	}
+	data, _ := json.Marshal(req)
+	conn.SetWriteDeadline(time.Now().Add(replicationTimeout))
+	if _, err := conn.Write(append(data, '\n')); err != nil {
+		return err
+	}
+
+	line, err = read()
+	if err != nil {
+		return err
+	}
+	var hello replicationHello
+	if err := json.Unmarshal(line, &hello); err != nil {
+		return err
+	}
+	if hello.Snapshot {
+		log.Printf("replication: loading snapshot at %d from %s", hello.Seq, f.leader)
+	}
+
+	for {
+		line, err := read()
+		if err != nil {
+			return err
+		}
+		var ch Change
+		if err := ch.UnmarshalJSON(line); err != nil {
+			return err
+		}
+
+		switch ch.Type {
+		case replicationPing:
+			continue
+		case replicationSynced:
+			f.once.Do(func() {
+				close(f.synced)
+			})
+			log.Printf("replication: synced with %s at %d", f.leader, ch.Seq)
+		default:
+			if err := f.apply(ch); err != nil {
+				return err
+			}
+		}
+
+		// snapshot entities have no sequence, position is known at its end
+		if ch.Seq > 0 {
+			f.mu.Lock()
+			f.epoch, f.seq = hello.Epoch, ch.Seq
+			f.mu.Unlock()
+		}
+	}
+}
+
+func (f *Follower) apply(ch Change) error {
+	switch ch.Type {
+	case ChangeUser:
+		var u User
+		if err := u.UnmarshalJSON(ch.After); err != nil {
+			return err
+		}
+		f.d.SetUser(u)
+	case ChangeLocation:
+		var l Location
+		if err := l.UnmarshalJSON(ch.After); err != nil {
+			return err
+		}
+		f.d.SetLocation(l)
+	case ChangeVisit:
+		// visits moved to other shard are deleted
+		if len(ch.After) == 0 || string(ch.After) == "null" {
+			f.d.DeleteVisit(ch.ID)
+			break
+		}
+		var v Visit
+		if err := v.UnmarshalJSON(ch.After); err != nil {
+			return err
+		}
+		f.d.SetVisit(v)
+	default:
+		return fmt.Errorf("unknown change type %q", ch.Type)
+	}
+
+	return nil
+}
+
+// Seq returns sequence of last change applied from leader
+func (f *Follower) Seq() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.seq
+}
+
+// Close stops following leader
+func (f *Follower) Close() error {
+	f.mu.Lock()
+	close(f.stop)
+	if f.conn != nil {
+		f.conn.Close()
+	}
+	f.mu.Unlock()
+	<-f.done
+
+	return nil
+}
+
+// Forward sends request to leader and relays its answer, follower is nil
+// outside of follower role and h is served locally then
+func (f *Follower) Forward(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	if f == nil {
+		return h
+	}
+
+	return func(c *fasthttp.RequestCtx) {
+		forwardedFor(c)
+		if err := relay(f.api, c); err != nil {
+			log.Printf("replication: forward to %s: %s", f.api.Addr, err)
+			ErrorResponse(c, fasthttp.StatusBadGateway, false)
+		}
+	}
+}
+
+// UnaryInterceptor rejects gRPC upserts, clients have to send them to leader
+func (f *Follower) UnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if strings.HasPrefix(path.Base(info.FullMethod), "Upsert") {
+		return nil, status.Error(codes.FailedPrecondition, "follower is read-only, write to leader")
+	}
+
+	return handler(ctx, req)
+}
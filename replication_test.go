@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// waitFor polls cond until it holds or a few seconds pass
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	leaderDb := newTestDatabase(t, StorageMap)
+	leaderDb.Changes = NewChangeFeed(1000)
+	leaderDb.SetUser(User{ID: 1, Email: "a@example.com", FirstName: "A", LastName: "B", Gender: "m"})
+	leaderDb.SetLocation(Location{ID: 1, Place: "Музей", Country: "Россия", City: "Москва", Distance: 10})
+	leaderDb.SetVisit(Visit{ID: 1, User: 1, Location: 1, Visited: 1000000000, Mark: 4})
+
+	leader, err := ServeReplication("127.0.0.1:0", &leaderDb, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leader.Close()
+
+	followerDb := newTestDatabase(t, StorageDense)
+	follower := NewFollower(&followerDb, leader.ln.Addr().String(), "127.0.0.1:1", "s3cret")
+	follower.Run()
+	defer follower.Close()
+
+	select {
+	case <-follower.Synced():
+	case <-time.After(5 * time.Second):
+		t.Fatal("follower not synced")
+	}
+	if v, ok := followerDb.Visits.Get(1); !ok || v.Mark != 4 {
+		t.Fatalf("snapshot visit %v, %v", v, ok)
+	}
+
+	// writes on leader while follower serves reads
+	const writes = 200
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			followerDb.UserVisits(1, &fasthttp.Args{})
+			followerDb.LocationAvg(1, &fasthttp.Args{})
+			followerDb.Users.JSON(1)
+		}
+	}()
+	for i := 2; i <= writes; i++ {
+		id := strconv.Itoa(i)
+		if err := leaderDb.UpsertVisit("new", []byte(`{"id":`+id+`,"user":1,"location":1,"visited_at":1000000000,"mark":`+strconv.Itoa(i%6)+`}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	leaderDb.UpsertUser("1", []byte(`{"first_name":"Z"}`))
+
+	waitFor(t, "changes", func() bool { return follower.Seq() == leaderDb.Changes.Last() })
+	close(stop)
+	wg.Wait()
+
+	if n := followerDb.Visits.Len(); n != writes {
+		t.Errorf("follower has %d visits, want %d", n, writes)
+	}
+	if u, _ := followerDb.Users.Get(1); u.FirstName != "Z" {
+		t.Errorf("follower user %+v", u)
+	}
+	lavg, _ := leaderDb.LocationAvg(1, &fasthttp.Args{})
+	favg, _ := followerDb.LocationAvg(1, &fasthttp.Args{})
+	if lavg != favg {
+		t.Errorf("follower avg %v, leader %v", favg, lavg)
+	}
+}
+
+func TestReplicationResume(t *testing.T) {
+	leaderDb := newTestDatabase(t, StorageMap)
+	leaderDb.Changes = NewChangeFeed(3)
+	leaderDb.SetUser(User{ID: 1, Email: "a@example.com", FirstName: "A", LastName: "B", Gender: "m"})
+	leader, err := ServeReplication("127.0.0.1:0", &leaderDb, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leader.Close()
+
+	// hello asks to resume, leader answers whether it sends snapshot
+	hello := func(epoch string, seq uint64) (replicationHello, []Change) {
+		conn, err := net.Dial("tcp", leader.ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		r.ReadBytes('\n')
+		data, _ := json.Marshal(replicationHello{Epoch: epoch, Seq: seq})
+		conn.Write(append(data, '\n'))
+
+		line, _ := r.ReadBytes('\n')
+		var h replicationHello
+		json.Unmarshal(line, &h)
+		var records []Change
+		for {
+			line, err := r.ReadBytes('\n')
+			var ch Change
+			if err != nil || ch.UnmarshalJSON(line) != nil {
+				t.Fatalf("stream: %s", err)
+			}
+			if ch.Type == replicationSynced {
+				return h, records
+			}
+			records = append(records, ch)
+		}
+	}
+	for i := 2; i <= 3; i++ {
+		leaderDb.SetUser(User{ID: uint32(i), Email: strconv.Itoa(i) + "@example.com", Gender: "f"})
+	}
+
+	tests := []struct {
+		name     string
+		epoch    string
+		seq      uint64
+		snapshot bool
+		// seq stream resumes from
+		from uint64
+	}{
+		{"new follower", "", 0, true, 3},
+		{"other leader run", "old", 1, true, 3},
+		{"resumes", leader.epoch, 1, false, 1},
+		{"ahead of leader", leader.epoch, 9, true, 3},
+	}
+	for _, tt := range tests {
+		h, records := hello(tt.epoch, tt.seq)
+		if h.Epoch != leader.epoch || h.Snapshot != tt.snapshot || h.Seq != tt.from {
+			t.Errorf("%s: hello %+v, want snapshot %v from %d", tt.name, h, tt.snapshot, tt.from)
+		}
+		if tt.snapshot && len(records) != 3 {
+			t.Errorf("%s: snapshot of %d records, want 3", tt.name, len(records))
+		}
+	}
+	leaderDb.SetUser(User{ID: 4, Email: "4@example.com", Gender: "f"})
+	leaderDb.SetUser(User{ID: 5, Email: "5@example.com", Gender: "f"})
+	if h, _ := hello(leader.epoch, 1); !h.Snapshot {
+		t.Error("resumed from overwritten changes")
+	}
+
+	// snapshot sequence covers every entity it holds
+	if seq, records := leader.snapshot(); seq != 5 || len(records) != 5 {
+		t.Errorf("snapshot at %d of %d records, want 5 of 5", seq, len(records))
+	}
+}
+
+func TestReplicationAuth(t *testing.T) {
+	leaderDb := newTestDatabase(t, StorageMap)
+	leaderDb.Changes = NewChangeFeed(10)
+	leaderDb.SetUser(User{ID: 1, Email: "a@example.com", FirstName: "A", LastName: "B", Gender: "m"})
+	leader, err := ServeReplication("127.0.0.1:0", &leaderDb, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leader.Close()
+
+	// hello of a previous connection, signed right
+	seen := replicationSignature("s3cret", replicationNonce())
+	tests := []struct {
+		name string
+		auth func(nonce string) string
+		ok   bool
+	}{
+		{"signed", func(nonce string) string { return replicationSignature("s3cret", nonce) }, true},
+		{"unsigned", func(string) string { return "" }, false},
+		{"other secret", func(nonce string) string { return replicationSignature("guess", nonce) }, false},
+		{"replayed", func(string) string { return seen }, false},
+		{"malformed", func(string) string { return "zz" }, false},
+	}
+	for _, tt := range tests {
+		conn, err := net.Dial("tcp", leader.ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		r := bufio.NewReader(conn)
+		var challenge replicationChallenge
+		if line, err := r.ReadBytes('\n'); err != nil || json.Unmarshal(line, &challenge) != nil || challenge.Nonce == "" {
+			t.Fatalf("%s: challenge %s, %v", tt.name, line, err)
+		}
+		data, _ := json.Marshal(replicationHello{Auth: tt.auth(challenge.Nonce)})
+		conn.Write(append(data, '\n'))
+		line, err := r.ReadBytes('\n')
+		conn.Close()
+
+		var h replicationHello
+		ok := err == nil && json.Unmarshal(line, &h) == nil && h.Epoch == leader.epoch
+		if ok != tt.ok {
+			t.Errorf("%s: answered %v (%s, %v), want %v", tt.name, ok, line, err, tt.ok)
+		}
+	}
+}
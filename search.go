@@ -0,0 +1,158 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// weights of location fields in search ranking
+const (
+	placeWeight   = 3
+	cityWeight    = 2
+	countryWeight = 1
+)
+
+// default and max number of search results
+const (
+	searchLimit    = 10
+	searchMaxLimit = 100
+)
+
+//easyjson:json
+type SearchResult struct {
+	Locations []SearchHit `json:"locations"`
+}
+
+type SearchHit struct {
+	ID       uint32  `json:"id"`
+	Place    string  `json:"place"`
+	City     string  `json:"city"`
+	Country  string  `json:"country"`
+	Distance int     `json:"distance"`
+	Score    float64 `json:"score"`
+}
+
+// Sort function
+type ByScore []SearchHit
+
+func (h ByScore) Len() int {
+	return len(h)
+}
+func (h ByScore) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+func (h ByScore) Less(i, j int) bool {
+	if h[i].Score != h[j].Score {
+		return h[i].Score > h[j].Score
+	}
+	return h[i].ID < h[j].ID
+}
+
+// foldRune lowercases rune and folds cyrillic ё to е
+func foldRune(r rune) rune {
+	r = unicode.ToLower(r)
+	if r == 'ё' {
+		return 'е'
+	}
+	return r
+}
+
+// Tokenize splits text into folded words of letters and digits
+func Tokenize(s string) []string {
+	return strings.FieldsFunc(strings.Map(foldRune, s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// SearchIndex is an inverted index over location place, city and country
+type SearchIndex struct {
+	mu    sync.RWMutex
+	terms map[string]map[uint32]int
+	docs  map[uint32]map[string]int
+}
+
+func NewSearchIndex() *SearchIndex {
+	return &SearchIndex{
+		terms: make(map[string]map[uint32]int),
+		docs:  make(map[uint32]map[string]int),
+	}
+}
+
+// Set (re)indexes location
+func (s *SearchIndex) Set(l Location) {
+	weights := make(map[string]int)
+	for _, t := range Tokenize(l.Place) {
+		weights[t] += placeWeight
+	}
+	for _, t := range Tokenize(l.City) {
+		weights[t] += cityWeight
+	}
+	for _, t := range Tokenize(l.Country) {
+		weights[t] += countryWeight
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for t := range s.docs[l.ID] {
+		delete(s.terms[t], l.ID)
+		if len(s.terms[t]) == 0 {
+			delete(s.terms, t)
+		}
+	}
+	for t, w := range weights {
+		if _, ok := s.terms[t]; !ok {
+			s.terms[t] = make(map[uint32]int)
+		}
+		s.terms[t][l.ID] = w
+	}
+	s.docs[l.ID] = weights
+}
+
+// Search returns ids of locations matching query with their tf-idf scores
+func (s *SearchIndex) Search(q string) map[uint32]float64 {
+	scores := make(map[uint32]float64)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	n := float64(len(s.docs))
+	for _, t := range Tokenize(q) {
+		postings, ok := s.terms[t]
+		if !ok {
+			continue
+		}
+		idf := math.Log(1 + n/float64(len(postings)))
+		for id, w := range postings {
+			scores[id] += float64(w) * idf
+		}
+	}
+
+	return scores
+}
+
+// Len returns number of indexed terms
+func (s *SearchIndex) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.terms)
+}
+
+// SearchLocations returns best ranked locations for query
+func (d Database) SearchLocations(q string, limit int) []SearchHit {
+	hits := make([]SearchHit, 0)
+	for id, score := range d.Search.Search(q) {
+		l, _ := d.Locations.Get(id)
+		hits = append(hits, SearchHit{l.ID, l.Place, l.City, l.Country, l.Distance, score})
+	}
+	sort.Sort(ByScore(hits))
+	if len(hits) > limit {
+		hits = hits[:limit]
+	}
+
+	return hits
+}
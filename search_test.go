@@ -0,0 +1,58 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"", []string{}},
+		{"Москва", []string{"москва"}},
+		{"Ёлкино, Озеро-2", []string{"елкино", "озеро", "2"}},
+		{"  New   York ", []string{"new", "york"}},
+	}
+	for _, tt := range tests {
+		if got := Tokenize(tt.in); len(got) != len(tt.want) || len(got) > 0 && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Tokenize(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSearchLocations(t *testing.T) {
+	d := newTestDatabase(t, StorageMap)
+	d.SetLocation(Location{ID: 1, Place: "Музей", City: "Москва", Country: "Россия"})
+	d.SetLocation(Location{ID: 2, Place: "Парк", City: "Москва", Country: "Россия"})
+	d.SetLocation(Location{ID: 3, Place: "Москва-река", City: "Тверь", Country: "Россия"})
+	d.SetLocation(Location{ID: 4, Place: "Музей", City: "Берлин", Country: "Германия"})
+
+	tests := []struct {
+		q     string
+		limit int
+		want  []uint32
+	}{
+		{"москва", 10, []uint32{3, 1, 2}},
+		{"МУЗЕЙ", 10, []uint32{1, 4}},
+		{"музей москва", 10, []uint32{1, 4, 3, 2}},
+		{"музей москва", 1, []uint32{1}},
+		{"нигде", 10, nil},
+	}
+	for _, tt := range tests {
+		var got []uint32
+		for _, h := range d.SearchLocations(tt.q, tt.limit) {
+			got = append(got, h.ID)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("SearchLocations(%q, %d) = %v, want %v", tt.q, tt.limit, got, tt.want)
+		}
+	}
+
+	// reindexed location drops old terms
+	d.SetLocation(Location{ID: 4, Place: "Зоопарк", City: "Берлин", Country: "Германия"})
+	if hits := d.SearchLocations("музей", 10); len(hits) != 1 || hits[0].ID != 1 {
+		t.Errorf("after reindex got %v", hits)
+	}
+}
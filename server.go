@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"net"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/reuseport"
+)
+
+// NewServer returns fasthttp server tuned by flags
+func NewServer(h fasthttp.RequestHandler) *fasthttp.Server {
+	return &fasthttp.Server{
+		Handler:            h,
+		Name:               "hlcup",
+		Concurrency:        config.Concurrency,
+		ReadTimeout:        config.ReadTimeout,
+		WriteTimeout:       config.WriteTimeout,
+		IdleTimeout:        config.IdleTimeout,
+		MaxRequestBodySize: config.MaxBodySize,
+		DisableKeepalive:   !config.KeepAlive,
+	}
+}
+
+// Listen opens server socket, with SO_REUSEPORT when configured
+func Listen() (net.Listener, error) {
+	if config.ReusePort {
+		return reuseport.Listen("tcp4", config.Listen)
+	}
+
+	return net.Listen("tcp4", config.Listen)
+}
+
+// clashingRoutes serves GET requests of paths clashing with wildcards of
+// router, e.g. /locations/search next to /locations/:id, and passes the
+// rest to router. Paths ending with slash are prefixes, handler takes the
+// last segment from path itself
+func clashingRoutes(routes map[string]fasthttp.RequestHandler, router fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(c *fasthttp.RequestCtx) {
+		if c.IsGet() {
+			path := c.Path()
+			if h, ok := routes[string(path)]; ok {
+				h(c)
+				return
+			}
+			if i := bytes.LastIndexByte(path, '/'); i > 0 {
+				if h, ok := routes[string(path[:i+1])]; ok {
+					h(c)
+					return
+				}
+			}
+		}
+		router(c)
+	}
+}
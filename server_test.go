@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	stdlog "log"
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestServer(t *testing.T) {
+	defer func(c Config) { config = c }(config)
+	config.Listen = "127.0.0.1:0"
+	config.MaxBodySize = 64
+
+	for _, reuse := range []bool{false, true} {
+		config.ReusePort = reuse
+		for _, keepAlive := range []bool{true, false} {
+			config.KeepAlive = keepAlive
+			server := NewServer(func(c *fasthttp.RequestCtx) {
+				OkResponse(c, c.PostBody(), false)
+			})
+			server.Logger = stdlog.New(ioutil.Discard, "", 0)
+			ln, err := Listen()
+			if err != nil {
+				t.Fatalf("reuseport %v: %s", reuse, err)
+			}
+			go server.Serve(ln)
+
+			tests := []struct {
+				body string
+				code int
+			}{
+				{`{}`, 200},
+				{`{"a":"` + strings.Repeat("x", 100) + `"}`, 400},
+			}
+			for _, tt := range tests {
+				req, resp := fasthttp.AcquireRequest(), fasthttp.AcquireResponse()
+				req.Header.SetMethod("POST")
+				req.SetRequestURI("http://" + ln.Addr().String() + "/users/1")
+				req.SetBodyString(tt.body)
+				if err := fasthttp.Do(req, resp); err != nil {
+					t.Fatalf("reuseport %v: %s", reuse, err)
+				}
+				if resp.StatusCode() != tt.code {
+					t.Errorf("reuseport %v, keepalive %v: %d bytes got %d, want %d", reuse, keepAlive, len(tt.body), resp.StatusCode(), tt.code)
+				}
+				if tt.code == 200 && !bytes.Equal(resp.Body(), []byte(tt.body)) {
+					t.Errorf("body %q", resp.Body())
+				}
+				if resp.ConnectionClose() == keepAlive && tt.code == 200 {
+					t.Errorf("keepalive %v: Connection: close %v", keepAlive, resp.ConnectionClose())
+				}
+				fasthttp.ReleaseRequest(req)
+				fasthttp.ReleaseResponse(resp)
+			}
+			if err := server.Shutdown(); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+}
+
+func TestClashingRoutes(t *testing.T) {
+	answer := func(body string) fasthttp.RequestHandler {
+		return func(c *fasthttp.RequestCtx) {
+			OkResponse(c, []byte(body), false)
+		}
+	}
+	h := clashingRoutes(map[string]fasthttp.RequestHandler{
+		"/locations/search": answer("search"),
+		"/users/by-email/":  answer("email"),
+	}, answer("router"))
+
+	tests := []struct {
+		method, path string
+		want         string
+	}{
+		{"GET", "/locations/search", "search"},
+		{"GET", "/locations/searches", "router"},
+		{"GET", "/locations/1", "router"},
+		{"POST", "/locations/search", "router"},
+		{"GET", "/users/by-email/a@example.com", "email"},
+		{"GET", "/users/by-email/", "email"},
+		{"GET", "/users/by-email/a/b", "router"},
+		{"GET", "/users/1", "router"},
+	}
+	for _, tt := range tests {
+		var c fasthttp.RequestCtx
+		c.Request.Header.SetMethod(tt.method)
+		c.Request.SetRequestURI(tt.path)
+		h(&c)
+		if string(c.Response.Body()) != tt.want {
+			t.Errorf("%s %s served by %s, want %s", tt.method, tt.path, c.Response.Body(), tt.want)
+		}
+	}
+}
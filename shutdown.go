@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+	"google.golang.org/grpc"
+)
+
+// Shutdown stops servers gracefully: listeners are closed, in-flight requests
+// are given timeout to finish, then buffered logs are flushed and the final
+// snapshot is written when configured. Writes not finished by then are held
+// until exit, so snapshot has every accepted one. rpc, repl and cluster may
+// be nil
+func Shutdown(server *fasthttp.Server, rpc *grpc.Server, warmup *Warmup, d *Database, access *AccessLog, hooks *Webhooks, repl io.Closer, cluster *Cluster) {
+	warmup.Drain()
+
+	done := make(chan error, 2)
+	go func() {
+		done <- server.Shutdown()
+	}()
+	pending := 1
+	if rpc != nil {
+		pending++
+		go func() {
+			rpc.GracefulStop()
+			done <- nil
+		}()
+	}
+	deadline := time.After(config.ShutdownTimeout)
+wait:
+	for ; pending > 0; pending-- {
+		select {
+		case err := <-done:
+			if err != nil {
+				log.Printf("shutdown: %s", err)
+			}
+		case <-deadline:
+			log.Printf("shutdown: requests not drained in %s", config.ShutdownTimeout)
+			break wait
+		}
+	}
+	if rpc != nil {
+		rpc.Stop()
+	}
+
+	if repl != nil {
+		repl.Close()
+	}
+	cluster.Close()
+	hooks.Close()
+	d.History.Close()
+	if access != nil {
+		access.Close()
+	}
+
+	d.mu.Lock()
+	if config.SnapshotDir != "" {
+		start := time.Now()
+		if err := d.writeSnapshot(config.SnapshotDir); err != nil {
+			log.Printf("snapshot fail: %s", err)
+		} else {
+			log.Printf("snapshot written to %s in %s", config.SnapshotDir, time.Since(start))
+		}
+	}
+	log.Print("Bye")
+}
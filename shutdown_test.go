@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+func TestShutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shutdown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(timeout time.Duration, snapshot string) {
+		config.ShutdownTimeout, config.SnapshotDir = timeout, snapshot
+	}(config.ShutdownTimeout, config.SnapshotDir)
+	config.SnapshotDir = dir
+
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		// time in-flight request takes
+		slow time.Duration
+	}{
+		{"drained", time.Second, 10 * time.Millisecond},
+		// access log is closed while request is still running
+		{"deadline", 20 * time.Millisecond, 200 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		config.ShutdownTimeout = tt.timeout
+		d := newTestDatabase(t, StorageMap)
+		d.SetUser(User{ID: 1, Email: "a@example.com"})
+
+		var out bytes.Buffer
+		access := NewAccessLog(&out, 1, 10)
+		started, finished := make(chan struct{}), make(chan struct{})
+		warmup := NewWarmup()
+		warmup.Ready(access.Wrap(func(c *fasthttp.RequestCtx) {
+			close(started)
+			time.Sleep(tt.slow)
+			OkResponse(c, []byte(`{}`), false)
+			close(finished)
+		}))
+		server := NewServer(warmup.Handler)
+		ln := fasthttputil.NewInmemoryListener()
+		go server.Serve(ln)
+
+		go func() {
+			conn, err := ln.Dial()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("GET /users/1 HTTP/1.1\r\nHost: x\r\n\r\n"))
+		}()
+		<-started
+		Shutdown(server, nil, warmup, &d, access, NewWebhooks(0, time.Second, ioutil.Discard), nil, nil)
+		if !HasSnapshot(dir) {
+			t.Errorf("%s: snapshot not written", tt.name)
+		}
+		// late request must not log into closed access log
+		<-finished
+		time.Sleep(10 * time.Millisecond)
+		os.RemoveAll(dir)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+)
+
+// file written after all data files of snapshot, crash before it leaves
+// files of two snapshots mixed, so they are not loaded
+const snapshotMarker = "snapshot.done"
+
+// HasSnapshot reports whether dir holds complete snapshot to load instead
+// of data.zip
+func HasSnapshot(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, snapshotMarker))
+
+	return err == nil
+}
+
+// WriteSnapshot dumps database into dir as data files of the same format
+// as in data.zip, so they can be loaded back at startup. Writes wait
+// until it is done
+func (d Database) WriteSnapshot(dir string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.writeSnapshot(dir)
+}
+
+func (d Database) writeSnapshot(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	marker := filepath.Join(dir, snapshotMarker)
+	if err := os.Remove(marker); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := syncDir(dir); err != nil {
+		return err
+	}
+
+	if err := writeSnapshotFile(filepath.Join(dir, "users_1.json"), "users", d.Users.RangeJSON); err != nil {
+		return err
+	}
+	if err := writeSnapshotFile(filepath.Join(dir, "locations_1.json"), "locations", d.Locations.RangeJSON); err != nil {
+		return err
+	}
+	if err := writeSnapshotFile(filepath.Join(dir, "visits_1.json"), "visits", d.Visits.RangeJSON); err != nil {
+		return err
+	}
+	// renames reach disk before marker does
+	if err := syncDir(dir); err != nil {
+		return err
+	}
+
+	return writeSnapshotFile(marker, "", nil)
+}
+
+// syncDir flushes renames and removals of files in dir to disk
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// writeSnapshotFile streams records as {"key":[...]} into path atomically,
+// without records file is left empty
+func writeSnapshotFile(path string, key string, records func(emit func([]byte))) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+
+	if records != nil {
+		w.WriteString(`{"` + key + `":[`)
+		first := true
+		records(func(b []byte) {
+			if err != nil {
+				return
+			}
+			if !first {
+				w.WriteByte(',')
+			}
+			first = false
+			_, err = w.Write(b)
+		})
+		if err == nil {
+			_, err = w.WriteString("]}")
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
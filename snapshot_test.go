@@ -0,0 +1,161 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	for _, kind := range []string{StorageMap, StorageDense} {
+		dir, err := ioutil.TempDir("", "snapshot")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		if HasSnapshot(dir) {
+			t.Errorf("%s: empty dir has snapshot", kind)
+		}
+
+		d := newTestDatabase(t, kind)
+		lat, lon := 55.75, 37.61
+		want := map[string]interface{}{
+			"users": []User{
+				{ID: 1, Email: "a@example.com", FirstName: "Иван", LastName: "Петров", Gender: "m", Birthday: -100},
+				{ID: 2, Email: "b@example.com", FirstName: "Анна", LastName: "Иванова", Gender: "f", Birthday: 200},
+			},
+			"locations": []Location{
+				{ID: 1, Place: "Музей", City: "Москва", Country: "Россия", Distance: 10, Lat: &lat, Lon: &lon},
+			},
+			"visits": []Visit{
+				{ID: 1, User: 1, Location: 1, Visited: 1000000000, Mark: 5},
+				{ID: 2, User: 2, Location: 1, Visited: 1100000000, Mark: 0},
+			},
+		}
+		for _, u := range want["users"].([]User) {
+			d.SetUser(u)
+		}
+		for _, l := range want["locations"].([]Location) {
+			d.SetLocation(l)
+		}
+		for _, v := range want["visits"].([]Visit) {
+			d.SetVisit(v)
+		}
+
+		if err := d.WriteSnapshot(dir); err != nil {
+			t.Fatal(err)
+		}
+		if !HasSnapshot(dir) {
+			t.Fatalf("%s: snapshot not found", kind)
+		}
+
+		for key, value := range dataMap {
+			var got interface{}
+			switch key {
+			case "users":
+				var u Users
+				err = loadData(filepath.Join(dir, fmt.Sprintf(value, 1)), &u)
+				sort.Slice(u.Records, func(i, j int) bool { return u.Records[i].ID < u.Records[j].ID })
+				got = u.Records
+			case "locations":
+				var l Locations
+				err = loadData(filepath.Join(dir, fmt.Sprintf(value, 1)), &l)
+				got = l.Records
+			case "visits":
+				var v Visits
+				err = loadData(filepath.Join(dir, fmt.Sprintf(value, 1)), &v)
+				sort.Slice(v.Records, func(i, j int) bool { return v.Records[i].ID < v.Records[j].ID })
+				got = v.Records
+			}
+			if err != nil {
+				t.Fatalf("%s: %s: %s", kind, key, err)
+			}
+			if !reflect.DeepEqual(got, want[key]) {
+				t.Errorf("%s: %s = %+v, want %+v", kind, key, got, want[key])
+			}
+		}
+	}
+}
+
+func TestSnapshotInterrupted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := newTestDatabase(t, StorageMap)
+	d.SetUser(User{ID: 1, Email: "a@example.com", FirstName: "A", LastName: "B", Gender: "m"})
+	if err := d.WriteSnapshot(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// visits file cannot take place of directory, so the next snapshot
+	// stops after users and locations are replaced
+	os.Remove(filepath.Join(dir, "visits_1.json"))
+	os.Mkdir(filepath.Join(dir, "visits_1.json"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "visits_1.json", "x"), nil, 0644)
+	d.SetUser(User{ID: 2, Email: "b@example.com", FirstName: "C", LastName: "D", Gender: "f"})
+	if err := d.WriteSnapshot(dir); err == nil {
+		t.Fatal("snapshot written over directory")
+	}
+	if HasSnapshot(dir) {
+		t.Error("interrupted snapshot is taken for complete")
+	}
+
+	os.RemoveAll(filepath.Join(dir, "visits_1.json"))
+	if err := d.WriteSnapshot(dir); err != nil {
+		t.Fatal(err)
+	}
+	if !HasSnapshot(dir) {
+		t.Error("complete snapshot not found")
+	}
+}
+
+func TestUnzip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	archive := func(name string, files map[string]string) string {
+		path := filepath.Join(dir, name)
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := zip.NewWriter(f)
+		for name, content := range files {
+			fw, _ := w.Create(name)
+			fw.Write([]byte(content))
+		}
+		w.Close()
+		f.Close()
+		return path
+	}
+
+	data := filepath.Join(dir, "data")
+	if err := unzip(archive("data.zip", map[string]string{"users_1.json": `{"users":[]}`, "sub/x": "x"}), data); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(data, "users_1.json")); err != nil || string(b) != `{"users":[]}` {
+		t.Errorf("users_1.json = %q, %v", b, err)
+	}
+	if _, err := os.Stat(filepath.Join(data, "sub", "x")); err != nil {
+		t.Error(err)
+	}
+
+	if err := unzip(archive("evil.zip", map[string]string{"../evil": "x"}), data); err == nil {
+		t.Error("entry outside of dir extracted")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "evil")); err == nil {
+		t.Error("evil file written")
+	}
+}
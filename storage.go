@@ -0,0 +1,745 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// storage backends
+const (
+	// records in maps keyed by id
+	StorageMap = "map"
+	// records in slices indexed by id, for dense ids of the cup data
+	StorageDense = "dense"
+)
+
+// dense stores grow up to twice the number of records plus slack,
+// ids past that are kept in sparse maps
+const denseSlack = 1 << 16
+
+// Stores and indexes are safe for concurrent use: reads take read lock,
+// writes and growth of dense slices take write lock. Database serializes
+// writes, so records only change under readers of other stores
+
+// denseFits tells whether id may extend dense part of store holding n records
+func denseFits(id uint32, n int) bool {
+	return int64(id) < 2*int64(n)+denseSlack
+}
+
+// UserStore keeps users with their marshalled JSON
+type UserStore interface {
+	Get(id uint32) (User, bool)
+	// Entry returns record in stored form, without decoding interned strings
+	Entry(id uint32) (user, bool)
+	JSON(id uint32) ([]byte, bool)
+	Set(u User)
+	Len() int
+	RangeJSON(f func(b []byte))
+}
+
+type mapUsers struct {
+	mu   sync.RWMutex
+	recs map[uint32]user
+	raw  map[uint32][]byte
+	dict *Dict
+}
+
+func newMapUsers(dict *Dict) *mapUsers {
+	return &mapUsers{recs: make(map[uint32]user), raw: make(map[uint32][]byte), dict: dict}
+}
+
+func (s *mapUsers) Get(id uint32) (User, bool) {
+	u, ok := s.Entry(id)
+	return s.dict.User(u), ok
+}
+
+func (s *mapUsers) Entry(id uint32) (user, bool) {
+	s.mu.RLock()
+	u, ok := s.recs[id]
+	s.mu.RUnlock()
+
+	return u, ok
+}
+
+func (s *mapUsers) JSON(id uint32) ([]byte, bool) {
+	s.mu.RLock()
+	b, ok := s.raw[id]
+	s.mu.RUnlock()
+
+	return b, ok
+}
+
+func (s *mapUsers) Set(u User) {
+	rec := s.dict.user(u)
+	raw, _ := u.MarshalJSON()
+
+	s.mu.Lock()
+	s.recs[u.ID], s.raw[u.ID] = rec, raw
+	s.mu.Unlock()
+}
+
+func (s *mapUsers) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.recs)
+}
+
+// RangeJSON calls f outside of lock, for records stored when it started
+func (s *mapUsers) RangeJSON(f func(b []byte)) {
+	for _, b := range s.rawList() {
+		f(b)
+	}
+}
+
+func (s *mapUsers) rawList() [][]byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([][]byte, 0, len(s.raw))
+	for _, b := range s.raw {
+		list = append(list, b)
+	}
+
+	return list
+}
+
+// denseUsers keeps users in slices indexed by id, outliers go to sparse map
+type denseUsers struct {
+	mu     sync.RWMutex
+	recs   []user
+	raw    [][]byte
+	n      int
+	dict   *Dict
+	sparse *mapUsers
+}
+
+func newDenseUsers(dict *Dict) *denseUsers {
+	return &denseUsers{dict: dict, sparse: newMapUsers(dict)}
+}
+
+func (s *denseUsers) Get(id uint32) (User, bool) {
+	u, ok := s.Entry(id)
+	return s.dict.User(u), ok
+}
+
+func (s *denseUsers) Entry(id uint32) (user, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if int64(id) < int64(len(s.recs)) {
+		return s.recs[id], s.raw[id] != nil
+	}
+	return s.sparse.Entry(id)
+}
+
+func (s *denseUsers) JSON(id uint32) ([]byte, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if int64(id) < int64(len(s.recs)) {
+		return s.raw[id], s.raw[id] != nil
+	}
+	return s.sparse.JSON(id)
+}
+
+func (s *denseUsers) Set(u User) {
+	rec := s.dict.user(u)
+	raw, _ := u.MarshalJSON()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if int64(u.ID) >= int64(len(s.recs)) && denseFits(u.ID, s.len()) {
+		s.grow(int(u.ID) + 1)
+	}
+	if int64(u.ID) >= int64(len(s.recs)) {
+		s.sparse.Set(u)
+		return
+	}
+
+	if s.raw[u.ID] == nil {
+		s.n++
+	}
+	s.recs[u.ID], s.raw[u.ID] = rec, raw
+}
+
+func (s *denseVisits) Delete(id uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if int64(id) >= int64(len(s.recs)) {
+		s.sparse.Delete(id)
+		return
+	}
+	if s.raw[id] != nil {
+		s.n--
+	}
+	s.recs[id], s.raw[id] = Visit{}, nil
+}
+
+// grow extends dense part to size and moves covered outliers into it,
+// called under write lock
+func (s *denseUsers) grow(size int) {
+	s.sparse.mu.Lock()
+	defer s.sparse.mu.Unlock()
+
+	s.recs = append(s.recs, make([]user, size-len(s.recs))...)
+	s.raw = append(s.raw, make([][]byte, size-len(s.raw))...)
+	for id, u := range s.sparse.recs {
+		if int64(id) < int64(size) {
+			s.recs[id], s.raw[id] = u, s.sparse.raw[id]
+			s.n++
+			delete(s.sparse.recs, id)
+			delete(s.sparse.raw, id)
+		}
+	}
+}
+
+func (s *denseUsers) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.len()
+}
+
+func (s *denseUsers) len() int {
+	return s.n + s.sparse.Len()
+}
+
+// RangeJSON calls f outside of lock, for records stored when it started
+func (s *denseUsers) RangeJSON(f func(b []byte)) {
+	s.mu.RLock()
+	list := make([][]byte, 0, s.n)
+	for _, b := range s.raw {
+		if b != nil {
+			list = append(list, b)
+		}
+	}
+	list = append(list, s.sparse.rawList()...)
+	s.mu.RUnlock()
+
+	for _, b := range list {
+		f(b)
+	}
+}
+
+// LocationStore keeps locations with their marshalled JSON
+type LocationStore interface {
+	Get(id uint32) (Location, bool)
+	// Entry returns record in stored form, without decoding interned strings
+	Entry(id uint32) (location, bool)
+	JSON(id uint32) ([]byte, bool)
+	Set(l Location)
+	Len() int
+	RangeJSON(f func(b []byte))
+}
+
+type mapLocations struct {
+	mu   sync.RWMutex
+	recs map[uint32]location
+	raw  map[uint32][]byte
+	dict *Dict
+}
+
+func newMapLocations(dict *Dict) *mapLocations {
+	return &mapLocations{recs: make(map[uint32]location), raw: make(map[uint32][]byte), dict: dict}
+}
+
+func (s *mapLocations) Get(id uint32) (Location, bool) {
+	l, ok := s.Entry(id)
+	return s.dict.Location(l), ok
+}
+
+func (s *mapLocations) Entry(id uint32) (location, bool) {
+	s.mu.RLock()
+	l, ok := s.recs[id]
+	s.mu.RUnlock()
+
+	return l, ok
+}
+
+func (s *mapLocations) JSON(id uint32) ([]byte, bool) {
+	s.mu.RLock()
+	b, ok := s.raw[id]
+	s.mu.RUnlock()
+
+	return b, ok
+}
+
+func (s *mapLocations) Set(l Location) {
+	rec := s.dict.location(l)
+	raw, _ := l.MarshalJSON()
+
+	s.mu.Lock()
+	s.recs[l.ID], s.raw[l.ID] = rec, raw
+	s.mu.Unlock()
+}
+
+func (s *mapLocations) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.recs)
+}
+
+// RangeJSON calls f outside of lock, for records stored when it started
+func (s *mapLocations) RangeJSON(f func(b []byte)) {
+	for _, b := range s.rawList() {
+		f(b)
+	}
+}
+
+func (s *mapLocations) rawList() [][]byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([][]byte, 0, len(s.raw))
+	for _, b := range s.raw {
+		list = append(list, b)
+	}
+
+	return list
+}
+
+// denseLocations keeps locations in slices indexed by id, outliers go to sparse map
+type denseLocations struct {
+	mu     sync.RWMutex
+	recs   []location
+	raw    [][]byte
+	n      int
+	dict   *Dict
+	sparse *mapLocations
+}
+
+func newDenseLocations(dict *Dict) *denseLocations {
+	return &denseLocations{dict: dict, sparse: newMapLocations(dict)}
+}
+
+func (s *denseLocations) Get(id uint32) (Location, bool) {
+	l, ok := s.Entry(id)
+	return s.dict.Location(l), ok
+}
+
+func (s *denseLocations) Entry(id uint32) (location, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if int64(id) < int64(len(s.recs)) {
+		return s.recs[id], s.raw[id] != nil
+	}
+	return s.sparse.Entry(id)
+}
+
+func (s *denseLocations) JSON(id uint32) ([]byte, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if int64(id) < int64(len(s.recs)) {
+		return s.raw[id], s.raw[id] != nil
+	}
+	return s.sparse.JSON(id)
+}
+
+func (s *denseLocations) Set(l Location) {
+	rec := s.dict.location(l)
+	raw, _ := l.MarshalJSON()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if int64(l.ID) >= int64(len(s.recs)) && denseFits(l.ID, s.len()) {
+		s.grow(int(l.ID) + 1)
+	}
+	if int64(l.ID) >= int64(len(s.recs)) {
+		s.sparse.Set(l)
+		return
+	}
+
+	if s.raw[l.ID] == nil {
+		s.n++
+	}
+	s.recs[l.ID], s.raw[l.ID] = rec, raw
+}
+
+// grow extends dense part to size and moves covered outliers into it,
+// called under write lock
+func (s *denseLocations) grow(size int) {
+	s.sparse.mu.Lock()
+	defer s.sparse.mu.Unlock()
+
+	s.recs = append(s.recs, make([]location, size-len(s.recs))...)
+	s.raw = append(s.raw, make([][]byte, size-len(s.raw))...)
+	for id, l := range s.sparse.recs {
+		if int64(id) < int64(size) {
+			s.recs[id], s.raw[id] = l, s.sparse.raw[id]
+			s.n++
+			delete(s.sparse.recs, id)
+			delete(s.sparse.raw, id)
+		}
+	}
+}
+
+func (s *denseLocations) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.len()
+}
+
+func (s *denseLocations) len() int {
+	return s.n + s.sparse.Len()
+}
+
+// RangeJSON calls f outside of lock, for records stored when it started
+func (s *denseLocations) RangeJSON(f func(b []byte)) {
+	s.mu.RLock()
+	list := make([][]byte, 0, s.n)
+	for _, b := range s.raw {
+		if b != nil {
+			list = append(list, b)
+		}
+	}
+	list = append(list, s.sparse.rawList()...)
+	s.mu.RUnlock()
+
+	for _, b := range list {
+		f(b)
+	}
+}
+
+// VisitStore keeps visits with their marshalled JSON
+type VisitStore interface {
+	Get(id uint32) (Visit, bool)
+	JSON(id uint32) ([]byte, bool)
+	Set(v Visit)
+	Delete(id uint32)
+	Len() int
+	RangeJSON(f func(b []byte))
+}
+
+type mapVisits struct {
+	mu   sync.RWMutex
+	recs map[uint32]Visit
+	raw  map[uint32][]byte
+}
+
+func newMapVisits() *mapVisits {
+	return &mapVisits{recs: make(map[uint32]Visit), raw: make(map[uint32][]byte)}
+}
+
+func (s *mapVisits) Get(id uint32) (Visit, bool) {
+	s.mu.RLock()
+	v, ok := s.recs[id]
+	s.mu.RUnlock()
+
+	return v, ok
+}
+
+func (s *mapVisits) JSON(id uint32) ([]byte, bool) {
+	s.mu.RLock()
+	b, ok := s.raw[id]
+	s.mu.RUnlock()
+
+	return b, ok
+}
+
+func (s *mapVisits) Set(v Visit) {
+	raw, _ := v.MarshalJSON()
+
+	s.mu.Lock()
+	s.recs[v.ID], s.raw[v.ID] = v, raw
+	s.mu.Unlock()
+}
+
+func (s *mapVisits) Delete(id uint32) {
+	s.mu.Lock()
+	delete(s.recs, id)
+	delete(s.raw, id)
+	s.mu.Unlock()
+}
+
+func (s *mapVisits) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.recs)
+}
+
+// RangeJSON calls f outside of lock, for records stored when it started
+func (s *mapVisits) RangeJSON(f func(b []byte)) {
+	for _, b := range s.rawList() {
+		f(b)
+	}
+}
+
+func (s *mapVisits) rawList() [][]byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([][]byte, 0, len(s.raw))
+	for _, b := range s.raw {
+		list = append(list, b)
+	}
+
+	return list
+}
+
+// denseVisits keeps visits in slices indexed by id, outliers go to sparse map
+type denseVisits struct {
+	mu     sync.RWMutex
+	recs   []Visit
+	raw    [][]byte
+	n      int
+	sparse *mapVisits
+}
+
+func newDenseVisits() *denseVisits {
+	return &denseVisits{sparse: newMapVisits()}
+}
+
+func (s *denseVisits) Get(id uint32) (Visit, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if int64(id) < int64(len(s.recs)) {
+		return s.recs[id], s.raw[id] != nil
+	}
+	return s.sparse.Get(id)
+}
+
+func (s *denseVisits) JSON(id uint32) ([]byte, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if int64(id) < int64(len(s.recs)) {
+		return s.raw[id], s.raw[id] != nil
+	}
+	return s.sparse.JSON(id)
+}
+
+func (s *denseVisits) Set(v Visit) {
+	raw, _ := v.MarshalJSON()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if int64(v.ID) >= int64(len(s.recs)) && denseFits(v.ID, s.len()) {
+		s.grow(int(v.ID) + 1)
+	}
+	if int64(v.ID) >= int64(len(s.recs)) {
+		s.sparse.Set(v)
+		return
+	}
+
+	if s.raw[v.ID] == nil {
+		s.n++
+	}
+	s.recs[v.ID], s.raw[v.ID] = v, raw
+}
+
+// grow extends dense part to size and moves covered outliers into it,
+// called under write lock
+func (s *denseVisits) grow(size int) {
+	s.sparse.mu.Lock()
+	defer s.sparse.mu.Unlock()
+
+	s.recs = append(s.recs, make([]Visit, size-len(s.recs))...)
+	s.raw = append(s.raw, make([][]byte, size-len(s.raw))...)
+	for id, v := range s.sparse.recs {
+		if int64(id) < int64(size) {
+			s.recs[id], s.raw[id] = v, s.sparse.raw[id]
+			s.n++
+			delete(s.sparse.recs, id)
+			delete(s.sparse.raw, id)
+		}
+	}
+}
+
+func (s *denseVisits) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.len()
+}
+
+func (s *denseVisits) len() int {
+	return s.n + s.sparse.Len()
+}
+
+// RangeJSON calls f outside of lock, for records stored when it started
+func (s *denseVisits) RangeJSON(f func(b []byte)) {
+	s.mu.RLock()
+	list := make([][]byte, 0, s.n)
+	for _, b := range s.raw {
+		if b != nil {
+			list = append(list, b)
+		}
+	}
+	list = append(list, s.sparse.rawList()...)
+	s.mu.RUnlock()
+
+	for _, b := range list {
+		f(b)
+	}
+}
+
+// VisitIndex maps user or location id to ids of its visits
+type VisitIndex interface {
+	Get(id uint32) []uint32
+	Add(id uint32, visit uint32)
+	Remove(id uint32, visit uint32)
+	Len() int
+}
+
+type mapIndex struct {
+	mu   sync.RWMutex
+	sets map[uint32][]uint32
+}
+
+func newMapIndex() *mapIndex {
+	return &mapIndex{sets: make(map[uint32][]uint32)}
+}
+
+func (m *mapIndex) Get(id uint32) []uint32 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.sets[id]
+}
+
+func (m *mapIndex) Add(id uint32, visit uint32) {
+	m.mu.Lock()
+	m.sets[id] = append(m.sets[id], visit)
+	m.mu.Unlock()
+}
+
+func (m *mapIndex) Remove(id uint32, visit uint32) {
+	m.mu.Lock()
+	if m.sets[id] = removeVisit(m.sets[id], visit); len(m.sets[id]) == 0 {
+		delete(m.sets, id)
+	}
+	m.mu.Unlock()
+}
+
+func (m *mapIndex) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return len(m.sets)
+}
+
+// removeVisit returns ids without visit, order of visits does not matter.
+// Readers may still hold ids, so they are copied rather than changed in place
+func removeVisit(ids []uint32, visit uint32) []uint32 {
+	for i, id := range ids {
+		if id == visit {
+			out := make([]uint32, 0, len(ids)-1)
+			out = append(out, ids[:i]...)
+			return append(out, ids[i+1:]...)
+		}
+	}
+	return ids
+}
+
+// denseIndex keeps visit lists in slice indexed by id, outliers go to sparse map
+type denseIndex struct {
+	mu     sync.RWMutex
+	sets   [][]uint32
+	n      int
+	sparse *mapIndex
+}
+
+func newDenseIndex() *denseIndex {
+	return &denseIndex{sparse: newMapIndex()}
+}
+
+func (d *denseIndex) Get(id uint32) []uint32 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if int64(id) < int64(len(d.sets)) {
+		return d.sets[id]
+	}
+	return d.sparse.Get(id)
+}
+
+func (d *denseIndex) Add(id uint32, visit uint32) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if int64(id) >= int64(len(d.sets)) && denseFits(id, d.len()) {
+		size := int(id) + 1
+		d.sets = append(d.sets, make([][]uint32, size-len(d.sets))...)
+		d.sparse.mu.Lock()
+		for sid, ids := range d.sparse.sets {
+			if int64(sid) < int64(size) {
+				d.sets[sid] = ids
+				d.n++
+				delete(d.sparse.sets, sid)
+			}
+		}
+		d.sparse.mu.Unlock()
+	}
+	if int64(id) >= int64(len(d.sets)) {
+		d.sparse.Add(id, visit)
+		return
+	}
+
+	if len(d.sets[id]) == 0 {
+		d.n++
+	}
+	d.sets[id] = append(d.sets[id], visit)
+}
+
+func (d *denseIndex) Remove(id uint32, visit uint32) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if int64(id) >= int64(len(d.sets)) {
+		d.sparse.Remove(id, visit)
+		return
+	}
+
+	if len(d.sets[id]) == 0 {
+		return
+	}
+	if d.sets[id] = removeVisit(d.sets[id], visit); len(d.sets[id]) == 0 {
+		d.n--
+	}
+}
+
+func (d *denseIndex) Len() int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.len()
+}
+
+func (d *denseIndex) len() int {
+	return d.n + d.sparse.Len()
+}
+
+// InitStorage creates entity stores and visit indexes of given backend
+func (d *Database) InitStorage(kind string) error {
+	d.mu = &sync.Mutex{}
+	d.Dict = NewDict(dictLimit)
+	switch kind {
+	case StorageMap:
+		d.Users = newMapUsers(d.Dict)
+		d.Locations = newMapLocations(d.Dict)
+		d.Visits = newMapVisits()
+		d.UserVisit = newMapIndex()
+		d.LocationVisits = newMapIndex()
+	case StorageDense:
+		d.Users = newDenseUsers(d.Dict)
+		d.Locations = newDenseLocations(d.Dict)
+		d.Visits = newDenseVisits()
+		d.UserVisit = newDenseIndex()
+		d.LocationVisits = newDenseIndex()
+	default:
+		return fmt.Errorf("unknown storage %q", kind)
+	}
+
+	return nil
+}
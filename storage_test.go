@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestStoresJSON(t *testing.T) {
+	lat, lon := 55.75, 37.61
+	users := []User{
+		{ID: 1, Email: "a@example.com", FirstName: "Иван", LastName: "Петров", Gender: "m", Birthday: -100},
+		// outlier goes to sparse part of dense store
+		{ID: 1 << 30, Email: "b@example.com", FirstName: "Анна", LastName: "Иванова", Gender: "f", Birthday: 200},
+		{ID: 1, Email: "c@example.com", FirstName: "Иван", LastName: "Сидоров", Gender: "m", Birthday: -100},
+	}
+	locations := []Location{
+		{ID: 2, Place: "Музей", City: "Москва", Country: "Россия", Distance: 10, Lat: &lat, Lon: &lon},
+		{ID: 1 << 30, Place: "Парк", City: "Тверь", Country: "Россия", Distance: 5},
+	}
+	visits := []Visit{
+		{ID: 3, User: 1, Location: 2, Visited: 1000000000, Mark: 5},
+		{ID: 1 << 30, User: 1, Location: 2, Visited: 1100000000, Mark: 0},
+	}
+
+	for _, kind := range []string{StorageMap, StorageDense} {
+		d := newTestDatabase(t, kind)
+		for _, u := range users {
+			prev, _ := d.Users.JSON(u.ID)
+			d.SetUser(u)
+			want, _ := u.MarshalJSON()
+			got, ok := d.Users.JSON(u.ID)
+			if !ok || !bytes.Equal(got, want) {
+				t.Errorf("%s: user %d JSON = %s, want %s", kind, u.ID, got, want)
+			}
+			// compressed bytes are reused until entity is marshalled again
+			if prev != nil && sameBytes(prev, got) {
+				t.Errorf("%s: user %d JSON not replaced", kind, u.ID)
+			}
+			if got, _ := d.Users.Get(u.ID); got != u {
+				t.Errorf("%s: user %d = %+v, want %+v", kind, u.ID, got, u)
+			}
+		}
+		for _, l := range locations {
+			d.SetLocation(l)
+			want, _ := l.MarshalJSON()
+			if got, ok := d.Locations.JSON(l.ID); !ok || !bytes.Equal(got, want) {
+				t.Errorf("%s: location %d JSON = %s, want %s", kind, l.ID, got, want)
+			}
+		}
+		for _, v := range visits {
+			d.SetVisit(v)
+			want, _ := v.MarshalJSON()
+			if got, ok := d.Visits.JSON(v.ID); !ok || !bytes.Equal(got, want) {
+				t.Errorf("%s: visit %d JSON = %s, want %s", kind, v.ID, got, want)
+			}
+		}
+
+		for _, id := range []uint32{0, 4, 1<<30 - 1} {
+			if _, ok := d.Users.JSON(id); ok {
+				t.Errorf("%s: missing user %d found", kind, id)
+			}
+			if _, ok := d.Visits.JSON(id); ok {
+				t.Errorf("%s: missing visit %d found", kind, id)
+			}
+		}
+		if d.Users.Len() != 2 || d.Locations.Len() != 2 || d.Visits.Len() != 2 {
+			t.Errorf("%s: lengths %d, %d, %d", kind, d.Users.Len(), d.Locations.Len(), d.Visits.Len())
+		}
+		n := 0
+		d.Users.RangeJSON(func(b []byte) { n++ })
+		if n != 2 {
+			t.Errorf("%s: RangeJSON visited %d users", kind, n)
+		}
+	}
+}
+
+func TestStoresConcurrent(t *testing.T) {
+	for _, kind := range []string{StorageMap, StorageDense} {
+		d := newTestDatabase(t, kind)
+		d.SetUser(User{ID: 1, Gender: "m"})
+		d.SetLocation(Location{ID: 1})
+
+		// writer keeps growing dense slices while readers go through them
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for id := uint32(1); id <= 2000; id++ {
+				d.SetUser(User{ID: id, Gender: "f"})
+				d.SetLocation(Location{ID: id})
+				d.SetVisit(Visit{ID: id, User: 1, Location: id % 7})
+				if id%3 == 0 {
+					d.SetVisit(Visit{ID: id - 1, User: 2, Location: id % 7})
+				}
+			}
+		}()
+
+		for i := 0; i < 4; i++ {
+			go func() {
+				for {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					for id := uint32(0); id < 50; id++ {
+						d.Users.Get(id)
+						d.Locations.JSON(id)
+						for _, vID := range d.UserVisit.Get(id) {
+							d.Visits.Get(vID)
+						}
+						d.LocationVisits.Get(id)
+					}
+					d.Visits.Len()
+					d.Users.RangeJSON(func(b []byte) {})
+				}
+			}()
+		}
+		<-done
+
+		if n := len(d.UserVisit.Get(1)) + len(d.UserVisit.Get(2)); n != 2000 {
+			t.Errorf("%s: %d visits indexed, want 2000", kind, n)
+		}
+	}
+}
+
+func TestRemoveVisit(t *testing.T) {
+	tests := []struct {
+		ids   []uint32
+		visit uint32
+		want  []uint32
+	}{
+		{[]uint32{1, 2, 3}, 2, []uint32{1, 3}},
+		{[]uint32{1, 2, 3}, 4, []uint32{1, 2, 3}},
+		{[]uint32{1}, 1, []uint32{}},
+		{nil, 1, nil},
+	}
+	for _, tt := range tests {
+		held := append([]uint32(nil), tt.ids...)
+		got := removeVisit(held, tt.visit)
+		if len(got) != len(tt.want) {
+			t.Errorf("removeVisit(%v, %d) = %v, want %v", tt.ids, tt.visit, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("removeVisit(%v, %d) = %v, want %v", tt.ids, tt.visit, got, tt.want)
+			}
+		}
+		// slice held by readers is left as is
+		for i := range held {
+			if held[i] != tt.ids[i] {
+				t.Errorf("removeVisit(%v, %d) changed input to %v", tt.ids, tt.visit, held)
+			}
+		}
+	}
+}
+
+func TestDeleteVisit(t *testing.T) {
+	for _, kind := range []string{StorageMap, StorageDense} {
+		d := newTestDatabase(t, kind)
+		d.SetUser(User{ID: 1, Email: "a@example.com", Gender: "m"})
+		d.SetLocation(Location{ID: 2, Place: "Музей", City: "Москва", Country: "Россия"})
+		for _, id := range []uint32{3, 1 << 30} {
+			d.SetVisit(Visit{ID: id, User: 1, Location: 2, Mark: 5})
+		}
+
+		d.DeleteVisit(1 << 30)
+		d.DeleteVisit(4)
+		if _, ok := d.Visits.Get(1 << 30); ok {
+			t.Errorf("%s: deleted visit found", kind)
+		}
+		if _, ok := d.Visits.JSON(1 << 30); ok {
+			t.Errorf("%s: deleted visit JSON found", kind)
+		}
+		if d.Visits.Len() != 1 {
+			t.Errorf("%s: %d visits, want 1", kind, d.Visits.Len())
+		}
+		if got := d.UserVisit.Get(1); len(got) != 1 || got[0] != 3 {
+			t.Errorf("%s: user visits %v, want [3]", kind, got)
+		}
+		if got := d.LocationVisits.Get(2); len(got) != 1 || got[0] != 3 {
+			t.Errorf("%s: location visits %v, want [3]", kind, got)
+		}
+	}
+}
+
+// benchmarkStorage fills database of kind with n users, locations and
+// visits with sequential ids
+func benchmarkStorage(b *testing.B, kind string, n int) Database {
+	d := newTestDatabase(b, kind)
+	for id := uint32(1); id <= uint32(n); id++ {
+		d.SetUser(User{ID: id, Email: "user@example.com", FirstName: "Иван", LastName: "Петров", Gender: "m"})
+		d.SetLocation(Location{ID: id, Place: "Музей", City: "Москва", Country: "Россия"})
+		d.SetVisit(Visit{ID: id, User: id % 100, Location: id % 100, Mark: int(id % 6)})
+	}
+	b.ResetTimer()
+
+	return d
+}
+
+func BenchmarkStorageSet(b *testing.B) {
+	for _, kind := range []string{StorageMap, StorageDense} {
+		b.Run(kind, func(b *testing.B) {
+			d := benchmarkStorage(b, kind, 0)
+			for i := 0; i < b.N; i++ {
+				id := uint32(i%100000) + 1
+				d.SetVisit(Visit{ID: id, User: id % 100, Location: id % 100})
+			}
+		})
+	}
+}
+
+func BenchmarkStorageGet(b *testing.B) {
+	for _, kind := range []string{StorageMap, StorageDense} {
+		b.Run(kind, func(b *testing.B) {
+			d := benchmarkStorage(b, kind, 10000)
+			b.RunParallel(func(pb *testing.PB) {
+				id := uint32(1)
+				for pb.Next() {
+					d.Users.Get(id)
+					d.Visits.JSON(id)
+					id = id%10000 + 1
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkStorageUserVisits(b *testing.B) {
+	for _, kind := range []string{StorageMap, StorageDense} {
+		b.Run(kind, func(b *testing.B) {
+			d := benchmarkStorage(b, kind, 10000)
+			for i := 0; i < b.N; i++ {
+				d.LoadVisits(d.UserVisit.Get(uint32(i % 100)))
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// timeline bucket sizes
+const (
+	BucketDay   = "day"
+	BucketWeek  = "week"
+	BucketMonth = "month"
+)
+
+//easyjson:json
+type Timeline struct {
+	Buckets []Bucket `json:"buckets"`
+}
+
+// Bucket holds visits stats of a period starting at From (unix time)
+type Bucket struct {
+	From  int64   `json:"from"`
+	Count int     `json:"count"`
+	Avg   float64 `json:"avg"`
+}
+
+// ParseTimelineArgs reads bucket size and timezone from query
+func ParseTimelineArgs(args *fasthttp.Args) (string, *time.Location, error) {
+	bucket := BucketDay
+	if args.Has("bucket") {
+		bucket = string(args.Peek("bucket"))
+	}
+	if bucket != BucketDay && bucket != BucketWeek && bucket != BucketMonth {
+		return "", nil, fmt.Errorf("Bucket fail")
+	}
+
+	loc := time.UTC
+	if args.Has("tz") {
+		var err error
+		loc, err = time.LoadLocation(string(args.Peek("tz")))
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	return bucket, loc, nil
+}
+
+// BucketStart truncates t to the beginning of its day, ISO week or month
+func BucketStart(t time.Time, bucket string) time.Time {
+	y, m, d := t.Date()
+	switch bucket {
+	case BucketWeek:
+		// weeks start on monday
+		d -= (int(t.Weekday()) + 6) % 7
+	case BucketMonth:
+		d = 1
+	}
+
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// MakeTimeline groups visits into non-empty buckets ordered by time
+func MakeTimeline(recs []Visit, bucket string, loc *time.Location) []Bucket {
+	sums := make(map[int64]int)
+	counts := make(map[int64]int)
+	for _, rec := range recs {
+		from := BucketStart(time.Unix(int64(rec.Visited), 0).In(loc), bucket).Unix()
+		sums[from] += rec.Mark
+		counts[from]++
+	}
+
+	out := make([]Bucket, 0, len(counts))
+	for from, count := range counts {
+		out = append(out, Bucket{from, count, AvgMark(sums[from], count)})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].From < out[j].From
+	})
+
+	return out
+}
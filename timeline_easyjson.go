@@ -0,0 +1,173 @@
+// Code generated by easyjson for marshaling/unmarshaling. DO NOT EDIT.
+
+package main
+
+import (
+	json "encoding/json"
+	easyjson "github.com/mailru/easyjson"
+	jlexer "github.com/mailru/easyjson/jlexer"
+	jwriter "github.com/mailru/easyjson/jwriter"
+)
+
+// suppress unused package warning
+var (
+	_ *json.RawMessage
+	_ *jlexer.Lexer
+	_ *jwriter.Writer
+	_ easyjson.Marshaler
+)
+
+func easyjson4e46f5f5DecodeBitbucketOrgPdedkovHlcup(in *jlexer.Lexer, out *Timeline) {
+	isTopLevel := in.IsStart()
+	if in.IsNull() {
+		if isTopLevel {
+			in.Consumed()
+		}
+		in.Skip()
+		return
+	}
+	in.Delim('{')
+	for !in.IsDelim('}') {
+		key := in.UnsafeFieldName(false)
+		in.WantColon()
+		if in.IsNull() {
+			in.Skip()
+			in.WantComma()
+			continue
+		}
+		switch key {
+		case "buckets":
+			if in.IsNull() {
+				in.Skip()
+				out.Buckets = nil
+			} else {
+				in.Delim('[')
+				if out.Buckets == nil {
+					if !in.IsDelim(']') {
+						out.Buckets = make([]Bucket, 0, 2)
+					} else {
+						out.Buckets = []Bucket{}
+					}
+				} else {
+					out.Buckets = (out.Buckets)[:0]
+				}
+				for !in.IsDelim(']') {
+					var v1 Bucket
+					easyjson4e46f5f5DecodeBitbucketOrgPdedkovHlcup1(in, &v1)
+					out.Buckets = append(out.Buckets, v1)
+					in.WantComma()
+				}
+				in.Delim(']')
+			}
+		default:
+			in.SkipRecursive()
+		}
+		in.WantComma()
+	}
+	in.Delim('}')
+	if isTopLevel {
+		in.Consumed()
+	}
+}
+func easyjson4e46f5f5EncodeBitbucketOrgPdedkovHlcup(out *jwriter.Writer, in Timeline) {
+	out.RawByte('{')
+	first := true
+	_ = first
+	{
+		const prefix string = ",\"buckets\":"
+		out.RawString(prefix[1:])
+		if in.Buckets == nil && (out.Flags&jwriter.NilSliceAsEmpty) == 0 {
+			out.RawString("null")
+		} else {
+			out.RawByte('[')
+			for v2, v3 := range in.Buckets {
+				if v2 > 0 {
+					out.RawByte(',')
+				}
+				easyjson4e46f5f5EncodeBitbucketOrgPdedkovHlcup1(out, v3)
+			}
+			out.RawByte(']')
+		}
+	}
+	out.RawByte('}')
+}
+
+// MarshalJSON supports json.Marshaler interface
+func (v Timeline) MarshalJSON() ([]byte, error) {
+	w := jwriter.Writer{}
+	easyjson4e46f5f5EncodeBitbucketOrgPdedkovHlcup(&w, v)
+	return w.Buffer.BuildBytes(), w.Error
+}
+
+// MarshalEasyJSON supports easyjson.Marshaler interface
+func (v Timeline) MarshalEasyJSON(w *jwriter.Writer) {
+	easyjson4e46f5f5EncodeBitbucketOrgPdedkovHlcup(w, v)
+}
+
+// UnmarshalJSON supports json.Unmarshaler interface
+func (v *Timeline) UnmarshalJSON(data []byte) error {
+	r := jlexer.Lexer{Data: data}
+	easyjson4e46f5f5DecodeBitbucketOrgPdedkovHlcup(&r, v)
+	return r.Error()
+}
+
+// UnmarshalEasyJSON supports easyjson.Unmarshaler interface
+func (v *Timeline) UnmarshalEasyJSON(l *jlexer.Lexer) {
+	easyjson4e46f5f5DecodeBitbucketOrgPdedkovHlcup(l, v)
+}
+func easyjson4e46f5f5DecodeBitbucketOrgPdedkovHlcup1(in *jlexer.Lexer, out *Bucket) {
+	isTopLevel := in.IsStart()
+	if in.IsNull() {
+		if isTopLevel {
+			in.Consumed()
+		}
+		in.Skip()
+		return
+	}
+	in.Delim('{')
+	for !in.IsDelim('}') {
+		key := in.UnsafeFieldName(false)
+		in.WantColon()
+		if in.IsNull() {
+			in.Skip()
+			in.WantComma()
+			continue
+		}
+		switch key {
+		case "from":
+			out.From = int64(in.Int64())
+		case "count":
+			out.Count = int(in.Int())
+		case "avg":
+			out.Avg = float64(in.Float64())
+		default:
+			in.SkipRecursive()
+		}
+		in.WantComma()
+	}
+	in.Delim('}')
+	if isTopLevel {
+		in.Consumed()
+	}
+}
+func easyjson4e46f5f5EncodeBitbucketOrgPdedkovHlcup1(out *jwriter.Writer, in Bucket) {
+	out.RawByte('{')
+	first := true
+	_ = first
+	{
+		const prefix string = ",\"from\":"
+		out.RawString(prefix[1:])
+		out.Int64(int64(in.From))
+	}
+	{
+		const prefix string = ",\"count\":"
+		out.RawString(prefix)
+		out.Int(int(in.Count))
+	}
+	{
+		const prefix string = ",\"avg\":"
+		out.RawString(prefix)
+		out.Float64(float64(in.Avg))
+	}
+	out.RawByte('}')
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestParseTimelineArgs(t *testing.T) {
+	tests := []struct {
+		query  string
+		bucket string
+		tz     string
+		ok     bool
+	}{
+		{"", BucketDay, "UTC", true},
+		{"bucket=week", BucketWeek, "UTC", true},
+		{"bucket=month&tz=Europe/Moscow", BucketMonth, "Europe/Moscow", true},
+		{"bucket=year", "", "", false},
+		{"tz=Nowhere/City", "", "", false},
+	}
+	for _, tt := range tests {
+		var args fasthttp.Args
+		args.Parse(tt.query)
+		bucket, loc, err := ParseTimelineArgs(&args)
+		if (err == nil) != tt.ok {
+			t.Errorf("ParseTimelineArgs(%q) error %v", tt.query, err)
+			continue
+		}
+		if tt.ok && (bucket != tt.bucket || loc.String() != tt.tz) {
+			t.Errorf("ParseTimelineArgs(%q) = %s, %s", tt.query, bucket, loc)
+		}
+	}
+}
+
+func TestBucketStart(t *testing.T) {
+	moscow, err := time.LoadLocation("Europe/Moscow")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	tests := []struct {
+		t      time.Time
+		bucket string
+		want   time.Time
+	}{
+		{time.Date(2017, 8, 16, 13, 5, 0, 0, time.UTC), BucketDay, time.Date(2017, 8, 16, 0, 0, 0, 0, time.UTC)},
+		// wednesday → monday
+		{time.Date(2017, 8, 16, 13, 5, 0, 0, time.UTC), BucketWeek, time.Date(2017, 8, 14, 0, 0, 0, 0, time.UTC)},
+		// sunday belongs to week started on monday before
+		{time.Date(2017, 8, 20, 23, 0, 0, 0, time.UTC), BucketWeek, time.Date(2017, 8, 14, 0, 0, 0, 0, time.UTC)},
+		// week crossing month boundary
+		{time.Date(2017, 9, 2, 0, 0, 0, 0, time.UTC), BucketWeek, time.Date(2017, 8, 28, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2017, 8, 16, 13, 5, 0, 0, time.UTC), BucketMonth, time.Date(2017, 8, 1, 0, 0, 0, 0, time.UTC)},
+		// 22:30 UTC is next day in Moscow
+		{time.Date(2017, 8, 31, 22, 30, 0, 0, time.UTC).In(moscow), BucketMonth, time.Date(2017, 9, 1, 0, 0, 0, 0, moscow)},
+	}
+	for _, tt := range tests {
+		if got := BucketStart(tt.t, tt.bucket); !got.Equal(tt.want) {
+			t.Errorf("BucketStart(%s, %s) = %s, want %s", tt.t, tt.bucket, got, tt.want)
+		}
+	}
+}
+
+func TestMakeTimeline(t *testing.T) {
+	day := int(time.Date(2017, 8, 14, 0, 0, 0, 0, time.UTC).Unix())
+	recs := []Visit{
+		{Visited: day + 3600, Mark: 5},
+		{Visited: day + 7200, Mark: 2},
+		{Visited: day + 86400*2, Mark: 4},
+		{Visited: day + 86400*8, Mark: 1},
+	}
+
+	tests := []struct {
+		bucket string
+		want   []Bucket
+	}{
+		{BucketDay, []Bucket{
+			{int64(day), 2, 3.5},
+			{int64(day + 86400*2), 1, 4},
+			{int64(day + 86400*8), 1, 1},
+		}},
+		{BucketWeek, []Bucket{
+			{int64(day), 3, 3.66667},
+			{int64(day + 86400*7), 1, 1},
+		}},
+		{BucketMonth, []Bucket{
+			{time.Date(2017, 8, 1, 0, 0, 0, 0, time.UTC).Unix(), 4, 3},
+		}},
+	}
+	for _, tt := range tests {
+		if got := MakeTimeline(recs, tt.bucket, time.UTC); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("MakeTimeline(%s) = %v, want %v", tt.bucket, got, tt.want)
+		}
+	}
+	if got := MakeTimeline(nil, BucketDay, time.UTC); len(got) != 0 {
+		t.Errorf("MakeTimeline(nil) = %v", got)
+	}
+}
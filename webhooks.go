@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// events of webhook filter
+const (
+	EventCreated = "created"
+	EventUpdated = "updated"
+)
+
+// webhook delivery tuning: queued deliveries, concurrent senders,
+// request timeout and longest backoff between attempts
+const (
+	webhookQueue      = 10000
+	webhookWorkers    = 4
+	webhookTimeout    = 5 * time.Second
+	webhookMaxBackoff = time.Minute
+)
+
+// Webhook subscribes URL to entity changes, zero filter fields match anything
+type Webhook struct {
+	ID  int    `json:"id"`
+	URL string `json:"url"`
+	// HMAC-SHA256 key of X-Hlcup-Signature header, masked in listing
+	Secret string `json:"secret,omitempty"`
+
+	Type  string `json:"type,omitempty"`
+	Event string `json:"event,omitempty"`
+	// visits of user or at location
+	User     uint32 `json:"user,omitempty"`
+	Location uint32 `json:"location,omitempty"`
+	// visits with mark strictly below
+	MarkBelow int `json:"mark_below,omitempty"`
+}
+
+// WebhookPayload is JSON posted to webhook URL
+type WebhookPayload struct {
+	Hook   int    `json:"hook"`
+	Event  string `json:"event"`
+	Change Change `json:"change"`
+}
+
+func changeEvent(ch Change) string {
+	if ch.Before == nil {
+		return EventCreated
+	}
+	return EventUpdated
+}
+
+// Match tells whether change passes hook filter
+func (h *Webhook) Match(ch Change) bool {
+	if h.Type != "" && h.Type != ch.Type {
+		return false
+	}
+	if h.Event != "" && h.Event != changeEvent(ch) {
+		return false
+	}
+	if h.User == 0 && h.Location == 0 && h.MarkBelow == 0 {
+		return true
+	}
+
+	// visit filters
+	var v Visit
+	if ch.Type != ChangeVisit || v.UnmarshalJSON(ch.After) != nil {
+		return false
+	}
+	if h.User != 0 && v.User != h.User {
+		return false
+	}
+	if h.Location != 0 && v.Location != h.Location {
+		return false
+	}
+	if h.MarkBelow != 0 && v.Mark >= h.MarkBelow {
+		return false
+	}
+
+	return true
+}
+
+type delivery struct {
+	hook    Webhook
+	seq     uint64
+	event   string
+	body    []byte
+	attempt int
+}
+
+// Webhooks posts signed changes of feed to registered hooks, failed
+// deliveries are retried with exponential backoff and then written to
+// dead-letter log
+type Webhooks struct {
+	mu    sync.RWMutex
+	hooks map[int]Webhook
+	next  int
+
+	client  *http.Client
+	queue   chan delivery
+	retries int
+	backoff time.Duration
+	dead    *log.Logger
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+
+	// deliveries waiting for retry by their timers
+	retryMu  sync.Mutex
+	retrying map[*time.Timer]delivery
+	closed   bool
+}
+
+// NewWebhooks makes up to retries attempts after the first one, waiting
+// backoff, then twice as long and so on. Dead letters are written to w
+func NewWebhooks(retries int, backoff time.Duration, w io.Writer) *Webhooks {
+	wh := &Webhooks{
+		hooks:   make(map[int]Webhook),
+		client:  &http.Client{Timeout: webhookTimeout},
+		queue:   make(chan delivery, webhookQueue),
+		retries: retries,
+		backoff: backoff,
+		stop:    make(chan struct{}),
+
+		retrying: make(map[*time.Timer]delivery),
+	}
+	wh.dead = log.New()
+	wh.dead.Formatter = &log.JSONFormatter{}
+	wh.dead.Out = w
+
+	return wh
+}
+
+// Add registers hook and returns its id
+func (wh *Webhooks) Add(h Webhook) (int, error) {
+	u, err := url.Parse(h.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return 0, fmt.Errorf("bad webhook url %q", h.URL)
+	}
+	switch h.Type {
+	case "", ChangeUser, ChangeLocation, ChangeVisit:
+	default:
+		return 0, fmt.Errorf("bad webhook type %q", h.Type)
+	}
+	switch h.Event {
+	case "", EventCreated, EventUpdated:
+	default:
+		return 0, fmt.Errorf("bad webhook event %q", h.Event)
+	}
+	if (h.User != 0 || h.Location != 0 || h.MarkBelow != 0) && h.Type != ChangeVisit {
+		return 0, fmt.Errorf("user, location and mark filters need visit type")
+	}
+
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	wh.next++
+	h.ID = wh.next
+	wh.hooks[h.ID] = h
+
+	return h.ID, nil
+}
+
+// Remove unregisters hook
+func (wh *Webhooks) Remove(id int) bool {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+
+	_, ok := wh.hooks[id]
+	delete(wh.hooks, id)
+
+	return ok
+}
+
+// List returns registered hooks
+func (wh *Webhooks) List() []Webhook {
+	wh.mu.RLock()
+	defer wh.mu.RUnlock()
+
+	hooks := make([]Webhook, 0, len(wh.hooks))
+	for _, h := range wh.hooks {
+		hooks = append(hooks, h)
+	}
+
+	return hooks
+}
+
+// Start follows feed from its current end and starts senders
+func (wh *Webhooks) Start(feed *ChangeFeed) {
+	wh.wg.Add(1)
+	go wh.follow(feed, feed.Last())
+	for i := 0; i < webhookWorkers; i++ {
+		wh.wg.Add(1)
+		go wh.send()
+	}
+}
+
+// Close stops following feed, deliveries not done by then, queued or
+// waiting for retry, go to dead letters
+func (wh *Webhooks) Close() {
+	close(wh.stop)
+	wh.wg.Wait()
+
+	wh.retryMu.Lock()
+	wh.closed = true
+	for t, d := range wh.retrying {
+		// fired timers dead-letter their deliveries themselves
+		if t.Stop() {
+			wh.deadLetter(d, fmt.Errorf("shutdown"))
+		}
+	}
+	wh.retrying = nil
+	wh.retryMu.Unlock()
+
+	for {
+		select {
+		case d := <-wh.queue:
+			wh.deadLetter(d, fmt.Errorf("shutdown"))
+		default:
+			return
+		}
+	}
+}
+
+func (wh *Webhooks) follow(feed *ChangeFeed, seq uint64) {
+	defer wh.wg.Done()
+
+	for {
+		changes, notify, ok := feed.Since(seq, changesBatch)
+		if !ok {
+			last := feed.Last()
+			log.Printf("webhooks: changes %d..%d lost, feed overrun", seq+1, last)
+			seq = last
+			continue
+		}
+		for _, ch := range changes {
+			wh.dispatch(ch)
+			seq = ch.Seq
+		}
+		if len(changes) > 0 {
+			continue
+		}
+
+		select {
+		case <-notify:
+		case <-wh.stop:
+			return
+		}
+	}
+}
+
+func (wh *Webhooks) dispatch(ch Change) {
+	wh.mu.RLock()
+	defer wh.mu.RUnlock()
+
+	for _, h := range wh.hooks {
+		if !h.Match(ch) {
+			continue
+		}
+		event := ch.Type + "." + changeEvent(ch)
+		body, _ := json.Marshal(WebhookPayload{h.ID, event, ch})
+		wh.enqueue(delivery{h, ch.Seq, event, body, 0})
+	}
+}
+
+func (wh *Webhooks) enqueue(d delivery) {
+	select {
+	case wh.queue <- d:
+	default:
+		wh.deadLetter(d, fmt.Errorf("queue full"))
+	}
+}
+
+func (wh *Webhooks) send() {
+	defer wh.wg.Done()
+
+	for {
+		select {
+		case d := <-wh.queue:
+			wh.deliver(d)
+		case <-wh.stop:
+			return
+		}
+	}
+}
+
+// Sign returns signature of body sent in X-Hlcup-Signature header
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (wh *Webhooks) deliver(d delivery) {
+	err := wh.post(d)
+	if err == nil {
+		return
+	}
+
+	d.attempt++
+	if d.attempt > wh.retries {
+		wh.deadLetter(d, err)
+		return
+	}
+
+	// exponential backoff with jitter, retry does not hold sender
+	wait := wh.backoff << uint(d.attempt-1)
+	if wait <= 0 || wait > webhookMaxBackoff {
+		wait = webhookMaxBackoff
+	}
+	wait += time.Duration(rand.Int63n(int64(wait)/2 + 1))
+	wh.retryMu.Lock()
+	defer wh.retryMu.Unlock()
+	if wh.closed {
+		wh.deadLetter(d, err)
+		return
+	}
+	var t *time.Timer
+	t = time.AfterFunc(wait, func() {
+		wh.retryMu.Lock()
+		defer wh.retryMu.Unlock()
+		delete(wh.retrying, t)
+		// queue is drained by Close after it is closed
+		if wh.closed {
+			wh.deadLetter(d, err)
+			return
+		}
+		wh.enqueue(d)
+	})
+	wh.retrying[t] = d
+}
+
+func (wh *Webhooks) post(d delivery) error {
+	req, err := http.NewRequest("POST", d.hook.URL, bytes.NewReader(d.body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Hlcup-Delivery", strconv.FormatUint(d.seq, 10))
+	req.Header.Set("X-Hlcup-Event", d.event)
+	if d.hook.Secret != "" {
+		req.Header.Set("X-Hlcup-Signature", Sign(d.hook.Secret, d.body))
+	}
+
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func (wh *Webhooks) deadLetter(d delivery, err error) {
+	wh.dead.WithFields(log.Fields{
+		"hook":     d.hook.ID,
+		"url":      d.hook.URL,
+		"seq":      d.seq,
+		"attempts": d.attempt,
+		"payload":  json.RawMessage(d.body),
+		"error":    err.Error(),
+	}).Warn("webhook dead letter")
+}
+
+// AdminHandler lists hooks on GET, registers hook from JSON body on POST
+// and removes hook given by id argument on DELETE
+func (wh *Webhooks) AdminHandler() http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+
+		switch r.Method {
+		case "GET":
+			hooks := wh.List()
+			for i := range hooks {
+				if hooks[i].Secret != "" {
+					hooks[i].Secret = "********"
+				}
+			}
+			json.NewEncoder(rw).Encode(hooks)
+		case "POST":
+			var h Webhook
+			if err := json.NewDecoder(r.Body).Decode(&h); err != nil {
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+				return
+			}
+			id, err := wh.Add(h)
+			if err != nil {
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(rw).Encode(map[string]int{"id": id})
+		case "DELETE":
+			id, err := strconv.Atoi(r.URL.Query().Get("id"))
+			if err != nil || !wh.Remove(id) {
+				http.Error(rw, "no such webhook", http.StatusNotFound)
+				return
+			}
+			rw.Write([]byte("{}"))
+		default:
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
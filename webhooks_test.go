@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhookMatch(t *testing.T) {
+	visit := Change{Type: ChangeVisit, After: []byte(`{"id":1,"user":2,"location":3,"visited_at":1000000000,"mark":2}`)}
+	updated := visit
+	updated.Before = []byte(`{}`)
+	user := Change{Type: ChangeUser, After: []byte(`{"id":2}`)}
+
+	tests := []struct {
+		hook Webhook
+		ch   Change
+		want bool
+	}{
+		{Webhook{}, user, true},
+		{Webhook{Type: ChangeUser}, visit, false},
+		{Webhook{Event: EventCreated}, visit, true},
+		{Webhook{Event: EventCreated}, updated, false},
+		{Webhook{Event: EventUpdated}, updated, true},
+		{Webhook{Type: ChangeVisit, User: 2}, visit, true},
+		{Webhook{Type: ChangeVisit, User: 5}, visit, false},
+		{Webhook{Type: ChangeVisit, Location: 3, MarkBelow: 3}, visit, true},
+		{Webhook{Type: ChangeVisit, MarkBelow: 2}, visit, false},
+		{Webhook{User: 2}, user, false},
+	}
+	for _, tt := range tests {
+		if got := tt.hook.Match(tt.ch); got != tt.want {
+			t.Errorf("%+v Match(%s %s) = %v, want %v", tt.hook, tt.ch.Type, tt.ch.Before, got, tt.want)
+		}
+	}
+}
+
+func TestWebhooksAdd(t *testing.T) {
+	wh := NewWebhooks(0, time.Millisecond, ioutil.Discard)
+	tests := []struct {
+		hook Webhook
+		ok   bool
+	}{
+		{Webhook{URL: "http://example.com/hook"}, true},
+		{Webhook{URL: "ftp://example.com/hook"}, false},
+		{Webhook{URL: "http://example.com/hook", Type: "place"}, false},
+		{Webhook{URL: "http://example.com/hook", Event: "deleted"}, false},
+		{Webhook{URL: "http://example.com/hook", User: 1}, false},
+		{Webhook{URL: "https://example.com/hook", Type: ChangeVisit, User: 1}, true},
+	}
+	for _, tt := range tests {
+		if _, err := wh.Add(tt.hook); (err == nil) != tt.ok {
+			t.Errorf("Add(%+v) = %v, want ok %v", tt.hook, err, tt.ok)
+		}
+	}
+	if n := len(wh.List()); n != 2 {
+		t.Errorf("%d hooks registered, want 2", n)
+	}
+}
+
+// deadLetters collects dead letter log lines
+type deadLetters struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (dl *deadLetters) Write(p []byte) (int, error) {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	return dl.buf.Write(p)
+}
+
+func (dl *deadLetters) lines() []string {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	return strings.Split(strings.TrimSpace(dl.buf.String()), "\n")
+}
+
+func TestWebhooksDeliver(t *testing.T) {
+	// fails twice, then accepts
+	var calls int32
+	got := make(chan *http.Request, 10)
+	bodies := make(chan []byte, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) <= 2 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		got <- r
+		bodies <- body
+	}))
+	defer srv.Close()
+
+	var dead deadLetters
+	wh := NewWebhooks(3, time.Millisecond, &dead)
+	wh.Add(Webhook{URL: srv.URL, Secret: "s3cret", Type: ChangeUser})
+	wh.Add(Webhook{URL: srv.URL, Type: ChangeLocation})
+	feed := NewChangeFeed(10)
+	wh.Start(feed)
+	feed.Append(ChangeUser, 1, nil, []byte(`{"id":1}`))
+
+	select {
+	case r := <-got:
+		body := <-bodies
+		if r.Header.Get("X-Hlcup-Event") != "user.created" || r.Header.Get("X-Hlcup-Delivery") != "1" {
+			t.Errorf("headers %v", r.Header)
+		}
+		if sig := r.Header.Get("X-Hlcup-Signature"); sig != Sign("s3cret", body) {
+			t.Errorf("signature %s, want %s", sig, Sign("s3cret", body))
+		}
+		var p WebhookPayload
+		if err := json.Unmarshal(body, &p); err != nil || p.Hook != 1 || p.Change.ID != 1 {
+			t.Errorf("payload %s: %v", body, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("delivery not retried")
+	}
+	wh.Close()
+
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Errorf("%d attempts, want 3", n)
+	}
+	if lines := dead.lines(); lines[0] != "" {
+		t.Errorf("dead letters %v", lines)
+	}
+}
+
+func TestWebhooksDeadLetter(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name    string
+		retries int
+		backoff time.Duration
+		// attempts made before dead letter
+		attempts int
+		err      string
+	}{
+		{"retries exhausted", 2, time.Millisecond, 3, "status 500"},
+		// pending retry is dead-lettered on close
+		{"closed", 5, time.Hour, 1, "shutdown"},
+	}
+	for _, tt := range tests {
+		var dead deadLetters
+		wh := NewWebhooks(tt.retries, tt.backoff, &dead)
+		wh.Add(Webhook{URL: srv.URL})
+		feed := NewChangeFeed(10)
+		wh.Start(feed)
+		feed.Append(ChangeVisit, 5, nil, []byte(`{"id":5}`))
+
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			wh.retryMu.Lock()
+			n := len(wh.retrying)
+			wh.retryMu.Unlock()
+			if tt.attempts == 1 && n == 1 || tt.attempts > 1 && dead.lines()[0] != "" {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		wh.Close()
+
+		lines := dead.lines()
+		if len(lines) != 1 {
+			t.Fatalf("%s: dead letters %v", tt.name, lines)
+		}
+		var e struct {
+			Seq      uint64 `json:"seq"`
+			Attempts int    `json:"attempts"`
+			Error    string `json:"error"`
+		}
+		if err := json.Unmarshal([]byte(lines[0]), &e); err != nil || e.Seq != 1 || e.Attempts != tt.attempts || e.Error != tt.err {
+			t.Errorf("%s: dead letter %s, want %d attempts, %s", tt.name, lines[0], tt.attempts, tt.err)
+		}
+	}
+}
+
+func TestWebhooksAdminHandler(t *testing.T) {
+	wh := NewWebhooks(0, time.Millisecond, ioutil.Discard)
+	h := wh.AdminHandler()
+	do := func(method, uri, body string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		h(rw, httptest.NewRequest(method, uri, strings.NewReader(body)))
+		return rw
+	}
+
+	if rw := do("POST", "/webhooks", `{"url":"http://example.com/hook","secret":"s3cret"}`); rw.Code != 200 || rw.Body.String() != "{\"id\":1}\n" {
+		t.Errorf("POST: %d %s", rw.Code, rw.Body)
+	}
+	if rw := do("POST", "/webhooks", `{"url":"mailto:a@example.com"}`); rw.Code != 400 {
+		t.Errorf("POST bad url: %d", rw.Code)
+	}
+	rw := do("GET", "/webhooks", "")
+	if strings.Contains(rw.Body.String(), "s3cret") || !strings.Contains(rw.Body.String(), `"secret":"********"`) {
+		t.Errorf("GET exposes secret: %s", rw.Body)
+	}
+	if wh.List()[0].Secret != "s3cret" {
+		t.Error("secret lost")
+	}
+	if rw := do("DELETE", "/webhooks?id=1", ""); rw.Code != 200 {
+		t.Errorf("DELETE: %d", rw.Code)
+	}
+	if rw := do("DELETE", "/webhooks?id=1", ""); rw.Code != 404 {
+		t.Errorf("DELETE again: %d", rw.Code)
+	}
+	if rw := do("PUT", "/webhooks", ""); rw.Code != 405 {
+		t.Errorf("PUT: %d", rw.Code)
+	}
+}